@@ -0,0 +1,78 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/auth"
+)
+
+// HandleListAPIKeys lists the user's API keys, or every key for admins.
+func HandleListAPIKeys(keys *auth.APIKeyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := auth.PrincipalFrom(r.Context())
+		list := []*auth.APIKey{}
+		for _, k := range keys.List() {
+			if p.Role == auth.RoleAdmin || k.Owner == p.Username {
+				list = append(list, k)
+			}
+		}
+		writeJSON(w, http.StatusOK, list)
+	}
+}
+
+// HandleCreateAPIKey issues an API key acting as the signed-in user.
+func HandleCreateAPIKey(keys *auth.APIKeyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name      string       `json:"name"`
+			Scopes    []auth.Scope `json:"scopes"`
+			ExpiresIn string       `json:"expiresIn"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+			return
+		}
+		var lifetime time.Duration
+		if req.ExpiresIn != "" {
+			d, err := time.ParseDuration(req.ExpiresIn)
+			if err != nil || d <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid expiresIn"})
+				return
+			}
+			lifetime = d
+		}
+
+		p := auth.PrincipalFrom(r.Context())
+		k, key, err := keys.Create(p.Username, req.Name, req.Scopes, lifetime)
+		if errors.Is(err, auth.ErrAPIKeyExists) {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]any{"apiKey": k, "key": key})
+	}
+}
+
+func HandleRevokeAPIKey(keys *auth.APIKeyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := auth.PrincipalFrom(r.Context())
+		k, ok := keys.Get(chi.URLParam(r, "id"))
+		if !ok || (p.Role != auth.RoleAdmin && k.Owner != p.Username) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": auth.ErrAPIKeyNotFound.Error()})
+			return
+		}
+		if err := keys.Revoke(k.ID); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"success": true})
+	}
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/audit"
+	"github.com/shafqat-a/ai-dev-conductor/internal/auth"
+)
+
+const (
+	defaultAuditLimit = 1000
+	maxAuditLimit     = 10000
+)
+
+// AuditRequests records API calls that change something, with who made
+// them and how they ended. It must run after RequireAuth.
+func AuditRequests(auditLog *audit.Log) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, noted := audit.WithSessionNote(r.Context())
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			e := audit.Event{
+				Action:  audit.ActionAPI,
+				Addr:    auth.ClientIP(r),
+				Session: *noted,
+				Method:  r.Method,
+				Path:    r.URL.Path,
+				Status:  ww.Status(),
+			}
+			if p := auth.PrincipalFrom(ctx); p != nil {
+				e.User = p.Username
+			}
+			if e.Session == "" && strings.HasPrefix(r.URL.Path, "/api/sessions/") {
+				e.Session = chi.URLParam(r, "id")
+			}
+			auditLog.Record(e)
+		})
+	}
+}
+
+// HandleQueryAudit returns audit events, oldest first, filtered by ?user=,
+// ?session=, ?action= and the time range ?since= to ?until= (RFC 3339).
+// Only the latest ?limit= matches are returned.
+func HandleQueryAudit(auditLog *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		f := audit.Filter{
+			User:    q.Get("user"),
+			Session: q.Get("session"),
+			Action:  q.Get("action"),
+			Limit:   defaultAuditLimit,
+		}
+		for _, t := range []struct {
+			param string
+			dst   *time.Time
+		}{{"since", &f.Since}, {"until", &f.Until}} {
+			if v := q.Get(t.param); v != "" {
+				ts, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"error": t.param + " must be an RFC 3339 time"})
+					return
+				}
+				*t.dst = ts
+			}
+		}
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > maxAuditLimit {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and " + strconv.Itoa(maxAuditLimit)})
+				return
+			}
+			f.Limit = n
+		}
+
+		events, err := auditLog.Query(f)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, events)
+	}
+}
+
+// HandleVerifyAudit checks that the audit log hasn't been tampered with.
+func HandleVerifyAudit(auditLog *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, head, err := auditLog.Verify()
+		resp := map[string]any{"valid": err == nil, "events": n, "head": head}
+		if err != nil {
+			resp["error"] = err.Error()
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -2,76 +2,259 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"mime"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 
+	"github.com/shafqat-a/ai-dev-conductor/internal/audit"
 	"github.com/shafqat-a/ai-dev-conductor/internal/auth"
+	"github.com/shafqat-a/ai-dev-conductor/internal/runas"
 	"github.com/shafqat-a/ai-dev-conductor/internal/session"
 )
 
-func HandleHealthCheck() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
-	}
-}
-
-func HandleLogin(authSvc *auth.AuthService, store *auth.SessionStore, sessionTimeout time.Duration) http.HandlerFunc {
+// HandleLogin exchanges a username and password, plus a two-factor code
+// if the user has enrolled, for a login token. Attempts are throttled by
+// limiter, and logins are written to the audit log. With requireTOTP,
+// users who haven't enrolled get a token that can only enroll.
+func HandleLogin(users *auth.UserStore, store *auth.SessionStore, limiter *auth.LoginLimiter, auditLog *audit.Log, sessionTimeout time.Duration, requireTOTP bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
+			Username string `json:"username"`
 			Password string `json:"password"`
+			Code     string `json:"code"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
 			return
 		}
+		// Clients written for the single shared password send no username.
+		if req.Username == "" {
+			req.Username = auth.BootstrapUser
+		}
 
-		if !authSvc.VerifyPassword(req.Password) {
-			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid password"})
+		ip := auth.ClientIP(r)
+		if wait, ok := limiter.Allow(r.Context(), ip, req.Username); !ok {
+			setRetryAfter(w, wait)
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "too many login attempts, try again later"})
 			return
 		}
 
-		token, err := auth.GenerateSessionToken()
-		if err != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		fail := func(reason string) {
+			auditLog.Record(audit.Event{Action: audit.ActionLoginFailed, Via: "password", User: req.Username, Addr: ip, Detail: reason})
+			if limiter.Failure(ip, req.Username) {
+				auditLog.Record(audit.Event{Action: audit.ActionLockout, Addr: ip})
+			}
+		}
+		user, ok := users.Authenticate(req.Username, req.Password)
+		if !ok {
+			fail("invalid username or password")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid username or password"})
 			return
 		}
 
-		store.Add(token, sessionTimeout)
+		login := auth.LoginSession{Username: user.Username, Method: "password"}
+		if user.TOTPSecret != "" {
+			if req.Code == "" {
+				writeJSON(w, http.StatusUnauthorized, map[string]any{"error": "two-factor code required", "totpRequired": true})
+				return
+			}
+			err := users.VerifyTOTP(user.Username, req.Code)
+			if errors.Is(err, auth.ErrInvalidCode) {
+				fail("invalid two-factor code")
+				writeJSON(w, http.StatusUnauthorized, map[string]any{"error": "invalid two-factor code", "totpRequired": true})
+				return
+			}
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+				return
+			}
+		} else if requireTOTP {
+			login.Enrolling = true
+		}
+		limiter.Success(ip, user.Username)
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     auth.CookieName,
-			Value:    token,
-			Path:     "/",
-			HttpOnly: true,
-			SameSite: http.SameSiteStrictMode,
-			MaxAge:   int(sessionTimeout.Seconds()),
-		})
+		token, ok := startLogin(w, r, store, login, sessionTimeout, http.SameSiteStrictMode)
+		if !ok {
+			return
+		}
+		auditLog.Record(audit.Event{Action: audit.ActionLogin, Via: "password", User: user.Username, Addr: ip})
+		resp := map[string]any{
+			"success":  true,
+			"token":    token,
+			"username": user.Username,
+			"role":     user.Role,
+		}
+		if login.Enrolling {
+			resp["totpEnrollment"] = true
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// setRetryAfter tells a throttled client how long to wait, in whole
+// seconds.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
 
-		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "token": token})
+// startLogin issues a token for login and sets it as the login cookie. It
+// writes an error response and returns false if that fails.
+func startLogin(w http.ResponseWriter, r *http.Request, store *auth.SessionStore, login auth.LoginSession, timeout time.Duration, sameSite http.SameSite) (string, bool) {
+	token, err := auth.GenerateSessionToken()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		return "", false
 	}
+	login.RemoteAddr = r.RemoteAddr
+	login.UserAgent = r.UserAgent()
+	if err := store.Add(token, login, timeout); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		return "", false
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     auth.CookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: sameSite,
+		MaxAge:   int(timeout.Seconds()),
+	})
+	return token, true
 }
 
 func HandleListSessions(mgr *session.Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		writeJSON(w, http.StatusOK, mgr.List())
+		p := auth.PrincipalFrom(r.Context())
+		list := []session.SessionInfo{}
+		for _, info := range mgr.List() {
+			if p.CanView(info.ID, info.Owner) {
+				list = append(list, info)
+			}
+		}
+		writeJSON(w, http.StatusOK, list)
+	}
+}
+
+func HandleListEndedSessions(mgr *session.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := auth.PrincipalFrom(r.Context())
+		ended := []*session.Metadata{}
+		for _, meta := range mgr.Ended() {
+			if p.CanView(meta.ID, meta.Owner) {
+				ended = append(ended, meta)
+			}
+		}
+		writeJSON(w, http.StatusOK, ended)
+	}
+}
+
+func HandleGetSession(mgr *session.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		meta, ok := authorizeSession(w, r, mgr, false)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, meta)
+	}
+}
+
+// HandleSessionHistory returns the raw terminal output of a live or ended
+// session for replay.
+func HandleSessionHistory(mgr *session.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		if _, ok := authorizeSession(w, r, mgr, false); !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		history, err := session.OpenHistoryReader(mgr.DataDir(), id)
+		if os.IsNotExist(err) {
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		defer history.Close()
+		copyDownload(w, history)
+	}
+}
+
+// HandleSessionRecording downloads the asciicast v2 recording of a live or
+// ended session.
+func HandleSessionRecording(mgr *session.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		meta, ok := authorizeSession(w, r, mgr, false)
+		if !ok {
+			return
+		}
+		f, err := os.Open(session.RecordingPath(mgr.DataDir(), id))
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no recording for session " + id})
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "application/x-asciicast")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+			map[string]string{"filename": meta.Name + ".cast"}))
+		copyDownload(w, f)
+	}
+}
+
+func HandleListTemplates(mgr *session.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, mgr.Templates())
 	}
 }
 
-func HandleCreateSession(mgr *session.Manager) http.HandlerFunc {
+func HandleCreateSession(mgr *session.Manager, users *auth.UserStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		p := auth.PrincipalFrom(r.Context())
+		if !p.CanCreate() {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "not allowed to create sessions"})
+			return
+		}
+		// A user's own runAs policy wins over the template's.
+		var runAs *runas.Account
+		if u, ok := users.Get(p.Username); ok {
+			runAs = u.RunAs
+		}
+
 		var req struct {
-			Name string `json:"name"`
+			Name     string `json:"name"`
+			Template string `json:"template"`
 		}
-		// Body is optional — name defaults to ID if empty
+		// Body is optional — name defaults to ID if empty, template to the shell
 		json.NewDecoder(r.Body).Decode(&req)
 
-		s, err := mgr.Create(req.Name)
+		// Templates that run as another account are only for admins, unless
+		// the user's own policy applies instead.
+		if t, ok := mgr.Template(req.Template); ok && t.RunAs != nil && runAs == nil && p.Role != auth.RoleAdmin {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "template " + t.Name + " runs as another account; only admins may use it"})
+			return
+		}
+
+		s, err := mgr.Create(req.Name, req.Template, p.Username, runAs)
+		var unknown session.ErrUnknownTemplate
+		if errors.As(err, &unknown) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
 		if err != nil {
 			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 			return
 		}
+		audit.NoteSession(r.Context(), s.ID)
 		writeJSON(w, http.StatusCreated, map[string]string{"id": s.ID, "name": s.Name})
 	}
 }
@@ -79,6 +262,9 @@ func HandleCreateSession(mgr *session.Manager) http.HandlerFunc {
 func HandleRenameSession(mgr *session.Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := chi.URLParam(r, "id")
+		if _, ok := authorizeSession(w, r, mgr, true); !ok {
+			return
+		}
 		var req struct {
 			Name string `json:"name"`
 		}
@@ -97,6 +283,9 @@ func HandleRenameSession(mgr *session.Manager) http.HandlerFunc {
 func HandleDeleteSession(mgr *session.Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := chi.URLParam(r, "id")
+		if _, ok := authorizeSession(w, r, mgr, true); !ok {
+			return
+		}
 		if err := mgr.Delete(id); err != nil {
 			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
 			return
@@ -105,8 +294,47 @@ func HandleDeleteSession(mgr *session.Manager) http.HandlerFunc {
 	}
 }
 
+// authorizeSession loads the record of the session named in the URL and
+// checks that the principal may view it, or manage it if manage is set.
+// Sessions the principal can't see are reported as not found.
+func authorizeSession(w http.ResponseWriter, r *http.Request, mgr *session.Manager, manage bool) (*session.Metadata, bool) {
+	p := auth.PrincipalFrom(r.Context())
+	id := chi.URLParam(r, "id")
+	meta, err := mgr.Metadata(id)
+	if err != nil || !p.CanView(meta.ID, meta.Owner) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "session " + id + " not found"})
+		return nil, false
+	}
+	if manage && !p.CanManage(meta.Owner) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "read-only access to this session"})
+		return nil, false
+	}
+	return meta, true
+}
+
 func writeJSON(w http.ResponseWriter, status int, v any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(v)
 }
+
+// downloadIdleTimeout is how long a download may go without writing
+// anything. It replaces the server's WriteTimeout, which would cut large
+// downloads off on slow links.
+const downloadIdleTimeout = 30 * time.Second
+
+// copyDownload copies src to w, pushing the write deadline back before
+// every chunk.
+func copyDownload(w http.ResponseWriter, src io.Reader) (int64, error) {
+	return io.Copy(deadlineWriter{w, http.NewResponseController(w)}, src)
+}
+
+type deadlineWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (d deadlineWriter) Write(p []byte) (int, error) {
+	d.rc.SetWriteDeadline(time.Now().Add(downloadIdleTimeout))
+	return d.w.Write(p)
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/auth"
+	"github.com/shafqat-a/ai-dev-conductor/internal/runas"
+	"github.com/shafqat-a/ai-dev-conductor/internal/session"
+)
+
+func TestCreateSessionRefusesRunAsTemplate(t *testing.T) {
+	dir := t.TempDir()
+	users, err := auth.OpenUserStore(filepath.Join(dir, "users.json"), "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Create("olivia", "secret", auth.RoleOperator, nil); err != nil {
+		t.Fatal(err)
+	}
+	mgr := session.NewManager(session.Options{
+		DataDir: dir,
+		Templates: []session.Template{
+			{Name: "deploy", Spec: session.Spec{Command: "/bin/sh", RunAs: &runas.Account{User: "root"}}},
+		},
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/sessions", strings.NewReader(`{"template":"deploy"}`))
+	req = req.WithContext(auth.WithPrincipal(req.Context(), &auth.Principal{Username: "olivia", Role: auth.RoleOperator}))
+	rec := httptest.NewRecorder()
+	HandleCreateSession(mgr, users)(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403: %s", rec.Code, rec.Body)
+	}
+	if n := len(mgr.List()); n != 0 {
+		t.Errorf("%d sessions started", n)
+	}
+}
+
+// slowReader returns n chunks, pausing before each.
+type slowReader struct {
+	n     int
+	pause time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	r.n--
+	time.Sleep(r.pause)
+	return copy(p, "chunk\n"), nil
+}
+
+func TestCopyDownloadOutlastsWriteTimeout(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		copyDownload(w, &slowReader{n: 5, pause: 50 * time.Millisecond})
+	}))
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("download cut off after %d bytes: %v", len(b), err)
+	}
+	if want := strings.Repeat("chunk\n", 5); string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+}
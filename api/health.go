@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/health"
+	"github.com/shafqat-a/ai-dev-conductor/internal/session"
+)
+
+// LivenessChecks fail only when restarting the server could help: when the
+// session manager has stopped responding.
+func LivenessChecks(mgr *session.Manager) []health.Check {
+	return []health.Check{{Name: "sessions", Run: func() error {
+		mgr.Stats() // blocks if a session or the manager is stuck
+		return nil
+	}}}
+}
+
+// ReadinessChecks also check that sessions can be started and their output
+// and the server's state stored.
+func ReadinessChecks(mgr *session.Manager, stateDir string, minFree int64) []health.Check {
+	return append(LivenessChecks(mgr),
+		health.Check{Name: "dataDir", Run: health.Writable(mgr.DataDir(), 0o700)},
+		health.Check{Name: "stateDir", Run: health.Writable(stateDir, 0o700)},
+		health.Check{Name: "dataDirSpace", Run: health.FreeSpace(mgr.DataDir(), minFree)},
+		health.Check{Name: "stateDirSpace", Run: health.FreeSpace(stateDir, minFree)},
+		health.Check{Name: "pty", Run: health.PTY},
+	)
+}
+
+// HandleHealthChecks reports the result of each check, with status 503 if
+// any failed.
+func HandleHealthChecks(checker *health.Checker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rep := checker.Run(r.Context())
+		status := http.StatusOK
+		if rep.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, rep)
+	}
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/audit"
+	"github.com/shafqat-a/ai-dev-conductor/internal/auth"
+	"github.com/shafqat-a/ai-dev-conductor/internal/session"
+)
+
+const defaultInviteLifetime = 24 * time.Hour
+
+// HandleCreateInvite mints an invite link to one session. Only users who
+// can manage the session may share it.
+func HandleCreateInvite(mgr *session.Manager, invites *auth.InviteStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		meta, ok := authorizeSession(w, r, mgr, true)
+		if !ok {
+			return
+		}
+		var req struct {
+			Access    auth.Access `json:"access"`
+			ExpiresIn string      `json:"expiresIn"`
+		}
+		// Body is optional — read-only for a day by default
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Access == "" {
+			req.Access = auth.AccessRead
+		}
+		lifetime := defaultInviteLifetime
+		if req.ExpiresIn != "" {
+			d, err := time.ParseDuration(req.ExpiresIn)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid expiresIn"})
+				return
+			}
+			lifetime = d
+		}
+
+		p := auth.PrincipalFrom(r.Context())
+		inv, token, err := invites.Create(meta.ID, meta.Owner, req.Access, p.Username, lifetime)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		link := url.URL{Scheme: "http", Host: r.Host, Path: "/invite/" + token}
+		if r.TLS != nil {
+			link.Scheme = "https"
+		}
+		writeJSON(w, http.StatusCreated, map[string]any{
+			"invite": inv,
+			"token":  token,
+			"url":    link.String(),
+		})
+	}
+}
+
+// HandleListInvites lists outstanding invites: all of them for admins,
+// otherwise those the user created. ?session= narrows it to one session.
+func HandleListInvites(invites *auth.InviteStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := auth.PrincipalFrom(r.Context())
+		sessionID := r.URL.Query().Get("session")
+		list := []*auth.Invite{}
+		for _, inv := range invites.List() {
+			if !canAdministerInvite(p, inv) {
+				continue
+			}
+			if sessionID != "" && inv.SessionID != sessionID {
+				continue
+			}
+			list = append(list, inv)
+		}
+		writeJSON(w, http.StatusOK, list)
+	}
+}
+
+// HandleRevokeInvite revokes an invite. Open connections made with it are
+// closed shortly after.
+func HandleRevokeInvite(invites *auth.InviteStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := auth.PrincipalFrom(r.Context())
+		inv, ok := invites.Get(chi.URLParam(r, "id"))
+		if !ok || !canAdministerInvite(p, inv) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": auth.ErrInviteNotFound.Error()})
+			return
+		}
+		if err := invites.Revoke(inv.ID); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, auth.ErrInviteNotFound) {
+				status = http.StatusNotFound
+			}
+			writeJSON(w, status, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"success": true})
+	}
+}
+
+// HandleRedeemInvite is the target of invite links. It stores the invite
+// token in the invite cookie and opens the terminal on the shared session.
+func HandleRedeemInvite(authn *auth.Authenticator, auditLog *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := chi.URLParam(r, "token")
+		inv, ok := authn.ValidateInvite(token)
+		if !ok {
+			http.Error(w, "This invite link is invalid or has expired.", http.StatusNotFound)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     auth.InviteCookieName,
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			// Lax, as the link is usually followed from another site
+			SameSite: http.SameSiteLaxMode,
+			MaxAge:   int(time.Until(inv.ExpiresAt).Seconds()),
+		})
+		auditLog.Record(audit.Event{Action: audit.ActionLogin, Via: "invite", User: "invite:" + inv.ID, Addr: auth.ClientIP(r), Session: inv.SessionID})
+		http.Redirect(w, r, "/terminal#session="+url.QueryEscape(inv.SessionID), http.StatusSeeOther)
+	}
+}
+
+// canAdministerInvite reports whether p may see and revoke inv: admins may
+// for every invite, other users for their own.
+func canAdministerInvite(p *auth.Principal, inv *auth.Invite) bool {
+	if p.InviteID != "" || !p.Allows(auth.ScopeSessionsWrite) {
+		return false
+	}
+	return p.Role == auth.RoleAdmin || inv.CreatedBy == p.Username
+}
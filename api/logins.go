@@ -0,0 +1,61 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/auth"
+)
+
+// HandleLogout revokes the token the request was made with and clears the
+// login and invite cookies.
+func HandleLogout(store *auth.SessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store.Remove(auth.RequestToken(r))
+		for _, name := range []string{auth.CookieName, auth.InviteCookieName} {
+			http.SetCookie(w, &http.Cookie{
+				Name:     name,
+				Value:    "",
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteStrictMode,
+				MaxAge:   -1,
+			})
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"success": true})
+	}
+}
+
+// HandleListLogins lists the unexpired login sessions, optionally only
+// those of ?user=.
+func HandleListLogins(store *auth.SessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.URL.Query().Get("user")
+		list := []*auth.LoginSession{}
+		for _, ls := range store.List() {
+			if user == "" || ls.Username == user {
+				list = append(list, ls)
+			}
+		}
+		writeJSON(w, http.StatusOK, list)
+	}
+}
+
+// HandleRevokeLogin signs out a single login session.
+func HandleRevokeLogin(store *auth.SessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := store.RemoveID(chi.URLParam(r, "id"))
+		if errors.Is(err, auth.ErrLoginNotFound) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"success": true})
+	}
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/audit"
+	"github.com/shafqat-a/ai-dev-conductor/internal/metrics"
+	"github.com/shafqat-a/ai-dev-conductor/internal/session"
+)
+
+// Metrics are the server's Prometheus metrics.
+type Metrics struct {
+	reg      *metrics.Registry
+	requests *metrics.Histogram
+	logins   *metrics.Counter
+}
+
+// NewMetrics registers the metrics, reading session figures from mgr when
+// scraped.
+func NewMetrics(mgr *session.Manager) *Metrics {
+	reg := metrics.NewRegistry()
+	m := &Metrics{
+		reg: reg,
+		requests: reg.NewHistogram("ai_conductor_http_request_duration_seconds",
+			"Time taken to serve HTTP requests, by route. WebSocket connections are not included.",
+			metrics.DefBuckets, "method", "route", "code"),
+		logins: reg.NewCounter("ai_conductor_logins_total",
+			"Sign-in attempts, by method (password, oidc, invite, proxy, certificate) and result.",
+			"via", "result"),
+	}
+	reg.NewGaugeFunc("ai_conductor_sessions_active", "Live sessions.", nil, func(emit metrics.Emit) {
+		emit(float64(len(mgr.Stats())))
+	})
+	reg.NewGaugeFunc("ai_conductor_websocket_clients", "Connected WebSocket clients per session.",
+		[]string{"session"}, func(emit metrics.Emit) {
+			for _, s := range mgr.Stats() {
+				emit(float64(s.Clients), s.ID)
+			}
+		})
+	reg.NewCounterFunc("ai_conductor_pty_bytes_total",
+		"Bytes written to (in) and read from (out) session PTYs since the server attached to them.",
+		[]string{"session", "direction"}, func(emit metrics.Emit) {
+			for _, s := range mgr.Stats() {
+				emit(float64(s.BytesIn), s.ID, "in")
+				emit(float64(s.BytesOut), s.ID, "out")
+			}
+		})
+	reg.NewCounterFunc("ai_conductor_output_dropped_chunks_total",
+		"Output chunks skipped for WebSocket clients that fell behind.",
+		[]string{"session"}, func(emit metrics.Emit) {
+			for _, s := range mgr.Stats() {
+				emit(float64(s.DroppedChunks), s.ID)
+			}
+		})
+	reg.NewGaugeFunc("ai_conductor_history_bytes", "On-disk size of each live session's history.",
+		[]string{"session"}, func(emit metrics.Emit) {
+			for _, s := range mgr.Stats() {
+				emit(float64(session.HistorySize(mgr.DataDir(), s.ID)), s.ID)
+			}
+		})
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return m.reg.Handler()
+}
+
+// CountLogin counts the sign-ins in the audit log; subscribe it with
+// audit.Log.Subscribe.
+func (m *Metrics) CountLogin(e audit.Event) {
+	switch e.Action {
+	case audit.ActionLogin:
+		m.logins.Inc(e.Via, "success")
+	case audit.ActionLoginFailed:
+		m.logins.Inc(e.Via, "failure")
+	}
+}
+
+// Instrument measures how long requests take, labelled by their route
+// pattern so that IDs in paths don't create new series.
+func (m *Metrics) Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := chi.RouteContext(r.Context()).RoutePattern()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := r.Method
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		default:
+			method = "other"
+		}
+		m.requests.Observe(time.Since(start).Seconds(), method, route, strconv.Itoa(ww.Status()))
+	})
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/audit"
+	"github.com/shafqat-a/ai-dev-conductor/internal/session"
+)
+
+func TestMetricsLabelRequestsByRoute(t *testing.T) {
+	m := NewMetrics(session.NewManager(session.Options{DataDir: t.TempDir()}))
+	r := chi.NewRouter()
+	r.Use(m.Instrument)
+	r.Get("/api/sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	for _, path := range []string{"/api/sessions/a1", "/api/sessions/b2", "/nowhere"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	m.CountLogin(audit.Event{Action: audit.ActionLogin, Via: "password"})
+	m.CountLogin(audit.Event{Action: audit.ActionLoginFailed, Via: "oidc"})
+	m.CountLogin(audit.Event{Action: audit.ActionAttach})
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	b, _ := io.ReadAll(rec.Body)
+	out := string(b)
+	for _, want := range []string{
+		`ai_conductor_http_request_duration_seconds_count{method="GET",route="/api/sessions/{id}",code="404"} 2`,
+		`ai_conductor_http_request_duration_seconds_count{method="GET",route="unmatched",code="404"} 1`,
+		`ai_conductor_logins_total{via="password",result="success"} 1`,
+		`ai_conductor_logins_total{via="oidc",result="failure"} 1`,
+		"ai_conductor_sessions_active 0",
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("metrics lack %s:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "a1") || strings.Contains(out, `via=""`) {
+		t.Errorf("unexpected series:\n%s", out)
+	}
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/audit"
+	"github.com/shafqat-a/ai-dev-conductor/internal/auth"
+)
+
+// oidcStateCookie binds a single sign-on login to the browser that started
+// it.
+const oidcStateCookie = "ai_conductor_oidc_state"
+
+// HandleOIDCLogin sends the browser to the identity provider.
+func HandleOIDCLogin(provider *auth.OIDCProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authURL, state, err := provider.AuthCodeURL(r.Context(), oidcRedirectURL(r, provider))
+		if err != nil {
+			log.Printf("oidc: %v", err)
+			loginError(w, r, "Single sign-on is unavailable")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookie,
+			Value:    state,
+			Path:     "/auth/oidc",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			// Lax, so it comes back with the redirect from the provider
+			SameSite: http.SameSiteLaxMode,
+			MaxAge:   int((10 * time.Minute).Seconds()),
+		})
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+// HandleOIDCCallback is where the identity provider returns the browser. It
+// verifies the login, maps it to a user and signs them in.
+func HandleOIDCCallback(provider *auth.OIDCProvider, users *auth.UserStore, store *auth.SessionStore, auditLog *audit.Log, sessionTimeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/auth/oidc", MaxAge: -1})
+		if e := q.Get("error"); e != "" {
+			msg := q.Get("error_description")
+			if msg == "" {
+				msg = e
+			}
+			loginError(w, r, "Sign-in was cancelled or refused: "+msg)
+			return
+		}
+		state := q.Get("state")
+		if c, err := r.Cookie(oidcStateCookie); err != nil || c.Value != state {
+			loginError(w, r, "Sign-in expired, please try again")
+			return
+		}
+
+		ident, err := provider.Exchange(r.Context(), state, q.Get("code"))
+		if errors.Is(err, auth.ErrOIDCState) {
+			loginError(w, r, "Sign-in expired, please try again")
+			return
+		}
+		if err != nil {
+			auditLog.Record(audit.Event{Action: audit.ActionLoginFailed, Via: "oidc", Addr: auth.ClientIP(r), Detail: err.Error()})
+			loginError(w, r, "Single sign-on failed")
+			return
+		}
+		id := auth.ExternalID{Source: auth.SourceOIDC, Issuer: ident.Issuer, Subject: ident.Subject}
+		user, err := users.Provision(ident.Username, id, provider.Roles(), ident.Groups)
+		if err != nil {
+			reason := auth.ProvisionError(err, ident.Groups).Error()
+			auditLog.Record(audit.Event{Action: audit.ActionLoginFailed, Via: "oidc", User: ident.Username, Addr: auth.ClientIP(r), Detail: reason})
+			loginError(w, r, ident.Username+" is not allowed to sign in here")
+			return
+		}
+
+		login := auth.LoginSession{Username: user.Username, Method: "oidc"}
+		if _, ok := startLogin(w, r, store, login, sessionTimeout, http.SameSiteLaxMode); !ok {
+			return
+		}
+		auditLog.Record(audit.Event{Action: audit.ActionLogin, Via: "oidc", User: user.Username, Addr: auth.ClientIP(r)})
+		http.Redirect(w, r, "/terminal", http.StatusSeeOther)
+	}
+}
+
+// oidcRedirectURL is the callback URL: the configured one, or this server's.
+func oidcRedirectURL(r *http.Request, provider *auth.OIDCProvider) string {
+	if u := provider.RedirectURL(); u != "" {
+		return u
+	}
+	u := url.URL{Scheme: "http", Host: r.Host, Path: "/auth/oidc/callback"}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	return u.String()
+}
+
+// loginError sends the browser back to the login page with msg.
+func loginError(w http.ResponseWriter, r *http.Request, msg string) {
+	http.Redirect(w, r, "/?error="+url.QueryEscape(msg), http.StatusSeeOther)
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/audit"
+	"github.com/shafqat-a/ai-dev-conductor/internal/auth"
+)
+
+// HandleBeginTOTP starts two-factor enrollment for the current user and
+// returns the secret to add to an authenticator app.
+func HandleBeginTOTP(users *auth.UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := auth.PrincipalFrom(r.Context())
+		secret, err := users.BeginTOTP(p.Username)
+		if errors.Is(err, auth.ErrTOTPEnabled) {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{
+			"secret": secret,
+			"uri":    auth.TOTPURI(p.Username, secret),
+		})
+	}
+}
+
+// HandleConfirmTOTP enables two-factor authentication once the user proves
+// their authenticator works, and returns their recovery codes. The user is
+// signed out everywhere and signs in again with a code.
+func HandleConfirmTOTP(users *auth.UserStore, store *auth.SessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := auth.PrincipalFrom(r.Context())
+		code, ok := decodeCode(w, r)
+		if !ok {
+			return
+		}
+		codes, err := users.ConfirmTOTP(p.Username, code)
+		switch {
+		case errors.Is(err, auth.ErrTOTPEnabled):
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		case errors.Is(err, auth.ErrTOTPNotStarted), errors.Is(err, auth.ErrInvalidCode):
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		store.RemoveUser(p.Username)
+		writeJSON(w, http.StatusOK, map[string][]string{"recoveryCodes": codes})
+	}
+}
+
+// HandleDisableTOTP turns off two-factor authentication for the current
+// user, given a valid code.
+func HandleDisableTOTP(users *auth.UserStore, limiter *auth.LoginLimiter, auditLog *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := auth.PrincipalFrom(r.Context())
+		code, ok := decodeCode(w, r)
+		if !ok || !verifyCode(w, r, users, limiter, auditLog, p.Username, code) {
+			return
+		}
+		if err := users.DisableTOTP(p.Username); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"success": true})
+	}
+}
+
+// HandleNewRecoveryCodes replaces the current user's recovery codes, given a
+// valid code.
+func HandleNewRecoveryCodes(users *auth.UserStore, limiter *auth.LoginLimiter, auditLog *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := auth.PrincipalFrom(r.Context())
+		code, ok := decodeCode(w, r)
+		if !ok || !verifyCode(w, r, users, limiter, auditLog, p.Username, code) {
+			return
+		}
+		codes, err := users.NewRecoveryCodes(p.Username)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string][]string{"recoveryCodes": codes})
+	}
+}
+
+func decodeCode(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "code is required"})
+		return "", false
+	}
+	return req.Code, true
+}
+
+// verifyCode checks a two-factor or recovery code for username, writing an
+// error response if it doesn't match. Guesses are throttled like logins.
+func verifyCode(w http.ResponseWriter, r *http.Request, users *auth.UserStore, limiter *auth.LoginLimiter, auditLog *audit.Log, username, code string) bool {
+	ip := auth.ClientIP(r)
+	if wait, ok := limiter.Allow(r.Context(), ip, username); !ok {
+		setRetryAfter(w, wait)
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "too many attempts, try again later"})
+		return false
+	}
+	err := users.VerifyTOTP(username, code)
+	if errors.Is(err, auth.ErrInvalidCode) {
+		auditLog.Record(audit.Event{Action: audit.ActionLoginFailed, User: username, Addr: ip, Detail: "invalid two-factor code"})
+		if limiter.Failure(ip, username) {
+			auditLog.Record(audit.Event{Action: audit.ActionLockout, Addr: ip})
+		}
+	}
+	switch {
+	case errors.Is(err, auth.ErrTOTPNotEnabled):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	case errors.Is(err, auth.ErrInvalidCode):
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return err == nil
+}
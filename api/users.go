@@ -0,0 +1,196 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/audit"
+	"github.com/shafqat-a/ai-dev-conductor/internal/auth"
+	"github.com/shafqat-a/ai-dev-conductor/internal/runas"
+	"github.com/shafqat-a/ai-dev-conductor/internal/session"
+)
+
+// HandleMe returns the authenticated user and the API key used, or the
+// invite used.
+func HandleMe() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := auth.PrincipalFrom(r.Context())
+		if p.InviteID != "" {
+			writeJSON(w, http.StatusOK, map[string]any{
+				"username": p.Username,
+				"invite":   p.InviteID,
+				"session":  p.SessionID,
+				"access":   p.Access,
+			})
+			return
+		}
+		me := map[string]any{"username": p.Username, "role": p.Role}
+		if p.Enrolling {
+			me["totpEnrollment"] = true
+		}
+		if p.KeyID != "" {
+			me["apiKey"] = p.KeyID
+			me["scopes"] = p.Scopes
+		}
+		writeJSON(w, http.StatusOK, me)
+	}
+}
+
+// HandleChangePassword lets a user change their own password, signing them
+// out everywhere else. Wrong current passwords are throttled like logins.
+func HandleChangePassword(users *auth.UserStore, store *auth.SessionStore, limiter *auth.LoginLimiter, auditLog *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := auth.PrincipalFrom(r.Context())
+		var req struct {
+			CurrentPassword string `json:"currentPassword"`
+			NewPassword     string `json:"newPassword"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NewPassword == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "newPassword is required"})
+			return
+		}
+		ip := auth.ClientIP(r)
+		if wait, ok := limiter.Allow(r.Context(), ip, p.Username); !ok {
+			setRetryAfter(w, wait)
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "too many attempts, try again later"})
+			return
+		}
+		if _, ok := users.Authenticate(p.Username, req.CurrentPassword); !ok {
+			auditLog.Record(audit.Event{Action: audit.ActionLoginFailed, Via: "password", User: p.Username, Addr: ip, Detail: "incorrect current password"})
+			if limiter.Failure(ip, p.Username) {
+				auditLog.Record(audit.Event{Action: audit.ActionLockout, Addr: ip})
+			}
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "current password is incorrect"})
+			return
+		}
+		limiter.Success(ip, p.Username)
+		if _, err := users.Update(p.Username, auth.UserUpdate{Password: &req.NewPassword}); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		store.RemoveUserExcept(p.Username, auth.RequestToken(r))
+		writeJSON(w, http.StatusOK, map[string]bool{"success": true})
+	}
+}
+
+func HandleListUsers(users *auth.UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, users.List())
+	}
+}
+
+func HandleCreateUser(users *auth.UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Username string         `json:"username"`
+			Password string         `json:"password"`
+			Role     auth.Role      `json:"role"`
+			RunAs    *runas.Account `json:"runAs"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+			return
+		}
+		if req.RunAs != nil {
+			if err := session.CheckRunAs(req.RunAs); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		u, err := users.Create(req.Username, req.Password, req.Role, req.RunAs)
+		if errors.Is(err, auth.ErrUserExists) {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusCreated, u.Info())
+	}
+}
+
+// HandleUpdateUser changes a user's password, role, runAs policy or
+// sign-on source, or turns off their two-factor authentication. A password
+// change signs the user out everywhere.
+func HandleUpdateUser(users *auth.UserStore, store *auth.SessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "username")
+		var req struct {
+			Password *string         `json:"password"`
+			Role     *auth.Role      `json:"role"`
+			RunAs    json.RawMessage `json:"runAs"`
+			TOTP     *bool           `json:"totp"`
+			Source   *string         `json:"source"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
+			return
+		}
+		if req.TOTP != nil && *req.TOTP {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "users enroll in two-factor authentication themselves"})
+			return
+		}
+		upd := auth.UserUpdate{Password: req.Password, Role: req.Role, Source: req.Source}
+		if req.RunAs != nil {
+			// An explicit null clears the policy.
+			var runAs *runas.Account
+			if err := json.Unmarshal(req.RunAs, &runAs); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid runAs"})
+				return
+			}
+			if runAs != nil {
+				if err := session.CheckRunAs(runAs); err != nil {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+					return
+				}
+			}
+			upd.RunAs = &runAs
+		}
+
+		u, err := users.Update(username, upd)
+		if errors.Is(err, auth.ErrUserNotFound) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if req.TOTP != nil {
+			if err := users.DisableTOTP(username); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			u.TOTPSecret = ""
+		}
+		if req.Password != nil {
+			store.RemoveUser(username)
+		}
+		writeJSON(w, http.StatusOK, u.Info())
+	}
+}
+
+// HandleDeleteUser deletes a user along with their login tokens, API keys
+// and the invites they created.
+func HandleDeleteUser(users *auth.UserStore, store *auth.SessionStore, keys *auth.APIKeyStore, invites *auth.InviteStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "username")
+		err := users.Delete(username)
+		if errors.Is(err, auth.ErrUserNotFound) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		store.RemoveUser(username)
+		keys.RevokeOwner(username)
+		invites.RevokeCreator(username)
+		writeJSON(w, http.StatusOK, map[string]bool{"success": true})
+	}
+}
@@ -1,34 +1,187 @@
 package config
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/auth"
+	"github.com/shafqat-a/ai-dev-conductor/internal/cgroup"
+	"github.com/shafqat-a/ai-dev-conductor/internal/listen"
+	"github.com/shafqat-a/ai-dev-conductor/internal/runas"
+	"github.com/shafqat-a/ai-dev-conductor/internal/session"
 )
 
 type Config struct {
 	Password       string
-	ListenAddr     string
+	ListenAddrs    []string    // host:port or unix:/path; ignored under socket activation
+	SocketMode     os.FileMode // permissions of Unix domain sockets
+	SocketGroup    string      // group owning Unix domain sockets
 	DataDir        string
+	StateDir       string // users and other server state
 	Shell          string
 	SessionTimeout time.Duration
+	PersistLogins  bool // keep login tokens in the state dir across restarts
+	LoginLimits    auth.LoginLimits
+	RequireTOTP    bool     // password logins must use two-factor authentication
+	AllowedOrigins []string // other origins whose pages may use the server
+	TrustedProxies []string // reverse proxies whose X-Forwarded-For is believed
+	AuditLog       string   // hash-chained audit log file
+	AuditInput     bool     // also audit everything typed into sessions
+	MetricsAuth    bool     // /metrics needs an admin login or key
+	MinFreeDisk    int64    // readiness fails with less free space than this
 	PIDFile        string
+
+	TLSCert       string
+	TLSKey        string
+	TLSClientCA   string // enables client certificate logins
+	TLSClientAuth string // "optional" or "require"
+	TLSClientUser string // certificate field naming the user: "cn" or "email"
+
+	HistorySegmentSize int64
+	HistoryMaxSize     int64
+	HistoryMaxAge      time.Duration
+	HistoryCompress    bool
+
+	Scrollback    int
+	Record        bool
+	RecordMaxSize int64
+
+	CgroupRoot   string
+	CgroupLimits cgroup.Limits
+
+	// Loaded from the JSON file named by AI_CONDUCTOR_CONFIG_FILE.
+	ConfigFile string
+	Templates  []session.Template
+	RunAs      *runas.Account
+	OIDC       *auth.OIDCConfig
+	ProxyAuth  *auth.ProxyAuthConfig
+}
+
+// File is the optional JSON configuration file for settings that don't fit
+// in environment variables.
+type File struct {
+	Templates []session.Template    `json:"templates"`
+	RunAs     *runas.Account        `json:"runAs"`     // default account for sessions
+	OIDC      *auth.OIDCConfig      `json:"oidc"`      // single sign-on
+	ProxyAuth *auth.ProxyAuthConfig `json:"proxyAuth"` // identity headers from a reverse proxy
 }
 
 func Load() (*Config, error) {
 	cfg := &Config{
 		Password:       envOrDefault("AI_CONDUCTOR_PASSWORD", "admin"),
-		ListenAddr:     envOrDefault("AI_CONDUCTOR_ADDR", "0.0.0.0:8080"),
+		ListenAddrs:    envList("AI_CONDUCTOR_ADDR"),
+		SocketGroup:    os.Getenv("AI_CONDUCTOR_SOCKET_GROUP"),
 		DataDir:        envOrDefault("AI_CONDUCTOR_DATA_DIR", "./data/sessions"),
+		StateDir:       envOrDefault("AI_CONDUCTOR_STATE_DIR", "./data"),
 		Shell:          envOrDefault("AI_CONDUCTOR_SHELL", ""),
 		SessionTimeout: 24 * time.Hour,
+		AllowedOrigins: envList("AI_CONDUCTOR_ALLOWED_ORIGINS"),
+		TrustedProxies: envList("AI_CONDUCTOR_TRUSTED_PROXIES"),
+		AuditLog:       os.Getenv("AI_CONDUCTOR_AUDIT_LOG"),
 		PIDFile:        os.Getenv("AI_CONDUCTOR_PID_FILE"),
+		TLSCert:        os.Getenv("AI_CONDUCTOR_TLS_CERT"),
+		TLSKey:         os.Getenv("AI_CONDUCTOR_TLS_KEY"),
+		TLSClientCA:    os.Getenv("AI_CONDUCTOR_TLS_CLIENT_CA"),
+		TLSClientAuth:  envOrDefault("AI_CONDUCTOR_TLS_CLIENT_AUTH", "optional"),
+		TLSClientUser:  envOrDefault("AI_CONDUCTOR_TLS_CLIENT_USER", "cn"),
 	}
 
+	if len(cfg.ListenAddrs) == 0 {
+		cfg.ListenAddrs = []string{"0.0.0.0:8080"}
+	}
 	if cfg.Shell == "" {
 		cfg.Shell = detectShell()
 	}
+	if cfg.AuditLog == "" {
+		cfg.AuditLog = filepath.Join(cfg.StateDir, "audit.log")
+	}
+
+	cfg.ConfigFile = os.Getenv("AI_CONDUCTOR_CONFIG_FILE")
+	if cfg.ConfigFile != "" {
+		if err := cfg.loadFile(cfg.ConfigFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if secret := os.Getenv("AI_CONDUCTOR_OIDC_CLIENT_SECRET"); secret != "" && cfg.OIDC != nil {
+		cfg.OIDC.ClientSecret = secret
+	}
+
+	var err error
+	if cfg.SessionTimeout, err = envDuration("AI_CONDUCTOR_SESSION_TIMEOUT", cfg.SessionTimeout); err != nil {
+		return nil, err
+	}
+	if cfg.PersistLogins, err = envBool("AI_CONDUCTOR_PERSIST_LOGINS", true); err != nil {
+		return nil, err
+	}
+	if cfg.RequireTOTP, err = envBool("AI_CONDUCTOR_REQUIRE_TOTP", false); err != nil {
+		return nil, err
+	}
+	if cfg.AuditInput, err = envBool("AI_CONDUCTOR_AUDIT_INPUT", false); err != nil {
+		return nil, err
+	}
+	if cfg.MetricsAuth, err = envBool("AI_CONDUCTOR_METRICS_AUTH", true); err != nil {
+		return nil, err
+	}
+	if cfg.SocketMode, err = envMode("AI_CONDUCTOR_SOCKET_MODE", 0o660); err != nil {
+		return nil, err
+	}
+	if cfg.MinFreeDisk, err = envBytes("AI_CONDUCTOR_MIN_FREE_DISK", 100<<20); err != nil {
+		return nil, err
+	}
+	if cfg.LoginLimits.PerIP, err = envInt("AI_CONDUCTOR_LOGIN_RATE_IP", 10); err != nil {
+		return nil, err
+	}
+	if cfg.LoginLimits.Global, err = envInt("AI_CONDUCTOR_LOGIN_RATE_GLOBAL", 60); err != nil {
+		return nil, err
+	}
+	if cfg.LoginLimits.LockoutFailures, err = envInt("AI_CONDUCTOR_LOGIN_LOCKOUT_FAILURES", 10); err != nil {
+		return nil, err
+	}
+	if cfg.LoginLimits.Lockout, err = envDuration("AI_CONDUCTOR_LOGIN_LOCKOUT", 15*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.HistorySegmentSize, err = envBytes("AI_CONDUCTOR_HISTORY_SEGMENT_SIZE", 4<<20); err != nil {
+		return nil, err
+	}
+	if cfg.HistoryMaxSize, err = envBytes("AI_CONDUCTOR_HISTORY_MAX_SIZE", 64<<20); err != nil {
+		return nil, err
+	}
+	if cfg.HistoryMaxAge, err = envDuration("AI_CONDUCTOR_HISTORY_MAX_AGE", 0); err != nil {
+		return nil, err
+	}
+	if cfg.HistoryCompress, err = envBool("AI_CONDUCTOR_HISTORY_COMPRESS", true); err != nil {
+		return nil, err
+	}
+	if cfg.Scrollback, err = envInt("AI_CONDUCTOR_SCROLLBACK", 1000); err != nil {
+		return nil, err
+	}
+	if cfg.Record, err = envBool("AI_CONDUCTOR_RECORD", true); err != nil {
+		return nil, err
+	}
+	if cfg.RecordMaxSize, err = envBytes("AI_CONDUCTOR_RECORD_MAX_SIZE", 64<<20); err != nil {
+		return nil, err
+	}
+	cfg.CgroupRoot = os.Getenv("AI_CONDUCTOR_CGROUP_ROOT")
+	if cfg.CgroupLimits.CPU, err = envFloat("AI_CONDUCTOR_CGROUP_CPU", 0); err != nil {
+		return nil, err
+	}
+	if cfg.CgroupLimits.Memory, err = envBytes("AI_CONDUCTOR_CGROUP_MEMORY", 0); err != nil {
+		return nil, err
+	}
+	pids, err := envInt("AI_CONDUCTOR_CGROUP_PIDS", 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.CgroupLimits.Pids = int64(pids)
 
 	if err := cfg.Validate(); err != nil {
 		return nil, err
@@ -41,8 +194,14 @@ func (c *Config) Validate() error {
 	if c.Password == "" {
 		return fmt.Errorf("password must not be empty")
 	}
-	if c.ListenAddr == "" {
-		return fmt.Errorf("listen address must not be empty")
+	for _, addr := range c.ListenAddrs {
+		if path, ok := strings.CutPrefix(addr, listen.UnixPrefix); ok {
+			if !filepath.IsAbs(path) {
+				return fmt.Errorf("AI_CONDUCTOR_ADDR: unix socket path %q must be absolute", path)
+			}
+		} else if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("AI_CONDUCTOR_ADDR: %w", err)
+		}
 	}
 	if c.Shell == "" {
 		return fmt.Errorf("no shell found; set AI_CONDUCTOR_SHELL")
@@ -50,6 +209,78 @@ func (c *Config) Validate() error {
 	if _, err := exec.LookPath(c.Shell); err != nil {
 		return fmt.Errorf("shell %q not found: %w", c.Shell, err)
 	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("TLS needs both AI_CONDUCTOR_TLS_CERT and AI_CONDUCTOR_TLS_KEY")
+	}
+	if c.TLSClientCA != "" {
+		if c.TLSCert == "" {
+			return fmt.Errorf("client certificates need TLS; set AI_CONDUCTOR_TLS_CERT and AI_CONDUCTOR_TLS_KEY")
+		}
+		if c.TLSClientAuth != "optional" && c.TLSClientAuth != "require" {
+			return fmt.Errorf("AI_CONDUCTOR_TLS_CLIENT_AUTH must be optional or require")
+		}
+		if err := (&auth.CertAuth{Field: c.TLSClientUser}).Validate(); err != nil {
+			return err
+		}
+	}
+	if _, err := auth.NewOriginPolicy(c.AllowedOrigins); err != nil {
+		return fmt.Errorf("AI_CONDUCTOR_ALLOWED_ORIGINS: %w", err)
+	}
+	if _, err := auth.NewTrustedProxies(c.TrustedProxies); err != nil {
+		return fmt.Errorf("AI_CONDUCTOR_TRUSTED_PROXIES: %w", err)
+	}
+	if c.SessionTimeout <= 0 {
+		return fmt.Errorf("session timeout must be positive")
+	}
+	if c.LoginLimits.PerIP < 0 || c.LoginLimits.Global < 0 || c.LoginLimits.LockoutFailures < 0 {
+		return fmt.Errorf("login limits must not be negative")
+	}
+	if c.LoginLimits.LockoutFailures > 0 && c.LoginLimits.Lockout <= 0 {
+		return fmt.Errorf("login lockout duration must be positive")
+	}
+	if c.HistorySegmentSize <= 0 {
+		return fmt.Errorf("history segment size must be positive")
+	}
+	if c.HistoryMaxSize != 0 && c.HistoryMaxSize < c.HistorySegmentSize {
+		return fmt.Errorf("history max size must be at least the segment size")
+	}
+	if c.CgroupRoot == "" && !c.CgroupLimits.IsZero() {
+		return fmt.Errorf("cgroup limits require AI_CONDUCTOR_CGROUP_ROOT")
+	}
+	if c.RunAs != nil && c.RunAs.User == "" {
+		return fmt.Errorf("%s: runAs needs a user", c.ConfigFile)
+	}
+	if c.OIDC != nil {
+		if err := c.OIDC.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", c.ConfigFile, err)
+		}
+	}
+	if c.ProxyAuth != nil {
+		if err := c.ProxyAuth.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", c.ConfigFile, err)
+		}
+	}
+	if err := session.ValidateTemplates(c.Templates); err != nil {
+		return fmt.Errorf("%s: %w", c.ConfigFile, err)
+	}
+	return nil
+}
+
+func (c *Config) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	var f File
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	c.Templates = f.Templates
+	c.RunAs = f.RunAs
+	c.OIDC = f.OIDC
+	c.ProxyAuth = f.ProxyAuth
 	return nil
 }
 
@@ -71,3 +302,99 @@ func envOrDefault(key, fallback string) string {
 	}
 	return fallback
 }
+
+// envList splits a comma-separated list, dropping empty items.
+func envList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func envInt(key string, fallback int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return n, nil
+}
+
+func envFloat(key string, fallback float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("%s: invalid number %q", key, v)
+	}
+	return f, nil
+}
+
+func envDuration(key string, fallback time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return d, nil
+}
+
+func envBool(key string, fallback bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", key, err)
+	}
+	return b, nil
+}
+
+// envMode parses file permissions in octal, such as "0660".
+func envMode(key string, fallback os.FileMode) (os.FileMode, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	m, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || m > 0o777 {
+		return 0, fmt.Errorf("%s: invalid mode %q", key, v)
+	}
+	return os.FileMode(m), nil
+}
+
+// envBytes parses a byte size such as "4096", "512K", "64M" or "1G"
+// (binary multiples).
+func envBytes(key string, fallback int64) (int64, error) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return fallback, nil
+	}
+	mult := int64(1)
+	upper := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(v), "B"), "I")
+	switch {
+	case strings.HasSuffix(upper, "K"):
+		mult, upper = 1<<10, strings.TrimSuffix(upper, "K")
+	case strings.HasSuffix(upper, "M"):
+		mult, upper = 1<<20, strings.TrimSuffix(upper, "M")
+	case strings.HasSuffix(upper, "G"):
+		mult, upper = 1<<30, strings.TrimSuffix(upper, "G")
+	}
+	n, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s: invalid size %q", key, v)
+	}
+	return n * mult, nil
+}
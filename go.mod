@@ -3,9 +3,9 @@ module github.com/shafqat-a/ai-dev-conductor
 go 1.24.0
 
 require (
-	github.com/creack/pty v1.1.24 // indirect
-	github.com/go-chi/chi/v5 v5.2.5 // indirect
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
-	golang.org/x/crypto v0.47.0 // indirect
+	github.com/creack/pty v1.1.24
+	github.com/go-chi/chi/v5 v5.2.5
+	github.com/google/uuid v1.6.0
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/crypto v0.47.0
 )
@@ -0,0 +1,378 @@
+// Package audit keeps an append-only, hash-chained log of who did what:
+// sign-ins, API calls that change things, terminal attaches and, if
+// enabled, everything typed into sessions.
+//
+// Each event is a line of JSON carrying the hash of the event before it,
+// and its own hash covers that, so editing, removing or reordering events
+// breaks the chain from that point on. Verify checks it. Removing events
+// from the end leaves a valid chain, so the head of the chain is written
+// to the server log when the log is opened and closed, and Verify checks
+// that the events this process recorded are still there.
+//
+// Appends are locked, so two servers can share the log while one hands
+// over to the other during an upgrade.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Actions.
+const (
+	ActionLogin       = "login"         // signed in; Via says how
+	ActionLoginFailed = "login.failed"  // wrong credentials or not allowed in; Detail says why
+	ActionLockout     = "login.lockout" // an address was locked out after repeated failures
+	ActionAPI         = "api"           // an API call that changes something
+	ActionAttach      = "session.attach"
+	ActionDetach      = "session.detach"
+	ActionInput       = "session.input" // text typed in Detail, or binary input in Data
+)
+
+// logged actions are also written to the server log, for tools like
+// fail2ban.
+var logged = map[string]bool{ActionLoginFailed: true, ActionLockout: true}
+
+// Event is one entry in the audit log.
+type Event struct {
+	Seq     int64     `json:"seq"`
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	User    string    `json:"user,omitempty"`
+	Addr    string    `json:"addr,omitempty"`
+	Via     string    `json:"via,omitempty"` // how a user signed in: password, oidc, invite, proxy or certificate
+	Session string    `json:"session,omitempty"`
+	Method  string    `json:"method,omitempty"` // HTTP method and path of API calls
+	Path    string    `json:"path,omitempty"`
+	Status  int       `json:"status,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+	Data    []byte    `json:"data,omitempty"`
+	Prev    string    `json:"prev"` // hash of the previous event
+	Hash    string    `json:"hash,omitempty"`
+}
+
+// hash returns the hash of e, computed over its JSON without the hash.
+func (e Event) hash() (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// String formats e for the server log.
+func (e Event) String() string {
+	var b strings.Builder
+	b.WriteString("audit: " + e.Action)
+	for _, f := range [][2]string{{"via", e.Via}, {"user", e.User}, {"addr", e.Addr}, {"session", e.Session}, {"reason", e.Detail}} {
+		if f[1] != "" {
+			fmt.Fprintf(&b, " %s=%q", f[0], f[1])
+		}
+	}
+	return b.String()
+}
+
+// Log is an audit log file. A nil *Log records nothing.
+type Log struct {
+	path string
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64 // file size after the last event seen
+	seq  int64
+	last string // hash of the last event
+	subs []func(Event)
+
+	recent map[string]time.Time // events recorded by RecordOnce -> when
+}
+
+// Open opens the log at path, creating it if needed, and continues its
+// chain.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("audit log: %w", err)
+	}
+	l := &Log{path: path, f: f}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("audit log: %w", err)
+	}
+	l.catchUp()
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	l.logHead("opened")
+	return l, nil
+}
+
+// logHead writes the head of the chain to the server log, so events
+// removed from the end of the file can be noticed.
+func (l *Log) logHead(what string) {
+	log.Printf("audit log %s %s: head is event %d, hash %q", l.path, what, l.seq, l.last)
+}
+
+// Record appends e to the log, filling in its sequence number, time and
+// hashes. Failures are logged rather than returned, as there is nothing
+// the caller could do about them.
+func (l *Log) Record(e Event) {
+	if l == nil {
+		return
+	}
+	if logged[e.Action] {
+		log.Print(e)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_EX); err != nil {
+		log.Printf("audit log: %v", err)
+		return
+	}
+	defer syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	l.catchUp()
+	e.Seq = l.seq + 1
+	e.Time = time.Now().UTC()
+	e.Prev = l.last
+	h, err := e.hash()
+	if err != nil {
+		log.Printf("audit log: %v", err)
+		return
+	}
+	e.Hash = h
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("audit log: %v", err)
+		return
+	}
+	n, err := l.f.Write(append(b, '\n'))
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("audit log: %v", err)
+		return
+	}
+	l.seq, l.last = e.Seq, e.Hash
+	for _, fn := range l.subs {
+		fn(e)
+	}
+}
+
+// RecordOnce records e unless RecordOnce recorded the same event, apart
+// from its time, within interval. It is for sign-ins that come with every
+// request, such as by a proxy header.
+func (l *Log) RecordOnce(e Event, interval time.Duration) {
+	if l == nil {
+		return
+	}
+	key := strings.Join([]string{e.Action, e.Via, e.User, e.Addr, e.Session, e.Detail}, "\x00")
+	now := time.Now()
+	l.mu.Lock()
+	if t, ok := l.recent[key]; ok && now.Sub(t) < interval {
+		l.mu.Unlock()
+		return
+	}
+	if l.recent == nil {
+		l.recent = make(map[string]time.Time)
+	}
+	for k, t := range l.recent {
+		if now.Sub(t) >= interval {
+			delete(l.recent, k)
+		}
+	}
+	l.recent[key] = now
+	l.mu.Unlock()
+	l.Record(e)
+}
+
+// catchUp continues the chain from events another process appended since
+// the last one seen. Events are appended whole with the file locked, so
+// the caller, holding the lock, cuts off a line a crash left unfinished.
+func (l *Log) catchUp() {
+	fi, err := l.f.Stat()
+	if err != nil || fi.Size() == l.size {
+		return
+	}
+	if fi.Size() < l.size {
+		// Carry on from the last event seen, so the chain shows the gap.
+		log.Printf("audit log %s: shrank from %d to %d bytes", l.path, l.size, fi.Size())
+		l.size = fi.Size()
+		return
+	}
+	end := l.size
+	br := bufio.NewReader(io.NewSectionReader(l.f, l.size, fi.Size()-l.size))
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		end += int64(len(line))
+		var e Event
+		if json.Unmarshal(line, &e) == nil && e.Hash != "" {
+			l.seq, l.last = e.Seq, e.Hash
+		}
+	}
+	if end < fi.Size() {
+		if err := l.f.Truncate(end); err != nil {
+			log.Printf("audit log %s: %v", l.path, err)
+		} else {
+			log.Printf("audit log %s: removed an unfinished event of %d bytes", l.path, fi.Size()-end)
+		}
+	}
+	l.size = end
+}
+
+// Subscribe calls fn with every event recorded from now on. fn must be
+// quick, as it runs with the log locked.
+func (l *Log) Subscribe(fn func(Event)) {
+	l.mu.Lock()
+	l.subs = append(l.subs, fn)
+	l.mu.Unlock()
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logHead("closed")
+	return l.f.Close()
+}
+
+// Filter selects events. Zero fields match everything.
+type Filter struct {
+	User    string
+	Session string
+	Action  string
+	Since   time.Time
+	Until   time.Time
+	Limit   int // the most recent Limit matches are returned
+}
+
+func (f *Filter) match(e *Event) bool {
+	return (f.User == "" || e.User == f.User) &&
+		(f.Session == "" || e.Session == f.Session) &&
+		(f.Action == "" || e.Action == f.Action || strings.HasPrefix(e.Action, f.Action+".")) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// Query returns the events matching f, oldest first.
+func (l *Log) Query(f Filter) ([]Event, error) {
+	events := []Event{}
+	err := l.scan(func(e *Event, err error) error {
+		if err == nil && f.match(e) {
+			events = append(events, *e)
+			if f.Limit > 0 && len(events) > 2*f.Limit {
+				events = append(events[:0], events[len(events)-f.Limit:]...)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if f.Limit > 0 && len(events) > f.Limit {
+		events = events[len(events)-f.Limit:]
+	}
+	return events, nil
+}
+
+// Verify checks the whole chain and returns the number of events in it and
+// the hash of the last. It fails at the first event that was altered,
+// removed or added out of place, and if the chain ends before the last
+// event this process has seen.
+func (l *Log) Verify() (int64, string, error) {
+	l.mu.Lock()
+	if err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_EX); err == nil {
+		l.catchUp()
+		syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	}
+	seq, last := l.seq, l.last
+	l.mu.Unlock()
+
+	var n int64
+	prev := ""
+	err := l.scan(func(e *Event, err error) error {
+		if err != nil {
+			return fmt.Errorf("after event %d: %w", n, err)
+		}
+		h, err := e.hash()
+		if err != nil {
+			return err
+		}
+		switch {
+		case e.Seq != n+1:
+			return fmt.Errorf("event %d: expected sequence number %d", e.Seq, n+1)
+		case e.Prev != prev:
+			return fmt.Errorf("event %d: does not follow event %d", e.Seq, n)
+		case e.Hash != h:
+			return fmt.Errorf("event %d: hash mismatch", e.Seq)
+		case e.Seq == seq && e.Hash != last:
+			return fmt.Errorf("event %d: not the event recorded", e.Seq)
+		}
+		n, prev = e.Seq, e.Hash
+		return nil
+	})
+	if err == nil && n < seq {
+		err = fmt.Errorf("log ends at event %d, but event %d was recorded", n, seq)
+	}
+	return n, prev, err
+}
+
+// scan calls fn with every event in the file, or the error decoding it.
+// It stops when fn returns an error.
+func (l *Log) scan(fn func(*Event, error) error) error {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var e Event
+		var derr error
+		if uerr := json.Unmarshal(line, &e); uerr != nil {
+			derr = fmt.Errorf("damaged line: %w", uerr)
+		}
+		if ferr := fn(&e, derr); ferr != nil {
+			return ferr
+		}
+	}
+}
+
+type sessionKey struct{}
+
+// WithSessionNote returns a context in which handlers can name the session
+// an API call was about with NoteSession.
+func WithSessionNote(ctx context.Context) (context.Context, *string) {
+	id := new(string)
+	return context.WithValue(ctx, sessionKey{}, id), id
+}
+
+// NoteSession records that the API call in ctx was about session id, for
+// calls that don't name it in their path, such as creating one.
+func NoteSession(ctx context.Context, id string) {
+	if p, ok := ctx.Value(sessionKey{}).(*string); ok {
+		*p = id
+	}
+}
@@ -0,0 +1,218 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openLog(t *testing.T, path string) *Log {
+	t.Helper()
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func readLines(t *testing.T, path string) [][]byte {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	return lines[:len(lines)-1]
+}
+
+func writeLines(t *testing.T, path string, lines [][]byte) {
+	t.Helper()
+	if err := os.WriteFile(path, bytes.Join(lines, nil), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordChainsEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := openLog(t, path)
+	var seen []Event
+	l.Subscribe(func(e Event) { seen = append(seen, e) })
+	l.Record(Event{Action: ActionLogin, Via: "password", User: "olivia"})
+	l.Record(Event{Action: ActionAttach, User: "olivia", Session: "s1"})
+	l.Record(Event{Action: ActionLoginFailed, User: "adam"})
+
+	n, last, err := l.Verify()
+	if err != nil || n != 3 {
+		t.Fatalf("Verify() = %d, %v", n, err)
+	}
+	if len(seen) != 3 || seen[2].Hash != last || seen[1].Prev != seen[0].Hash {
+		t.Errorf("subscribers saw %+v", seen)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("log mode = %o, want 600", perm)
+	}
+
+	events, err := l.Query(Filter{User: "olivia", Action: "session"})
+	if err != nil || len(events) != 1 || events[0].Session != "s1" {
+		t.Errorf("Query = %+v, %v", events, err)
+	}
+	if events, _ := l.Query(Filter{Action: "login", Limit: 1}); len(events) != 1 || events[0].User != "adam" {
+		t.Errorf("Query with limit = %+v", events)
+	}
+
+	// Reopened, the log carries on from the same chain.
+	l.Close()
+	l = openLog(t, path)
+	l.Record(Event{Action: ActionDetach, User: "olivia", Session: "s1"})
+	if n, _, err := l.Verify(); err != nil || n != 4 {
+		t.Errorf("Verify() after reopening = %d, %v", n, err)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func([][]byte) [][]byte
+		want   string
+	}{
+		{"edited", func(lines [][]byte) [][]byte {
+			lines[1] = bytes.Replace(lines[1], []byte("olivia"), []byte("adam"), 1)
+			return lines
+		}, "event 2: hash mismatch"},
+		{"removed", func(lines [][]byte) [][]byte {
+			return append(lines[:1], lines[2:]...)
+		}, "event 3: expected sequence number 2"},
+		{"reordered", func(lines [][]byte) [][]byte {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, "event 3: expected sequence number 2"},
+		{"damaged", func(lines [][]byte) [][]byte {
+			lines[1] = []byte("{not json\n")
+			return lines
+		}, "after event 1: damaged line"},
+		{"cut short", func(lines [][]byte) [][]byte {
+			return lines[:2]
+		}, "log ends at event 2, but event 3 was recorded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			l := openLog(t, path)
+			for _, user := range []string{"adam", "olivia", "adam"} {
+				l.Record(Event{Action: ActionLogin, User: user})
+			}
+			writeLines(t, path, tt.tamper(readLines(t, path)))
+			_, _, err := l.Verify()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Verify() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyDetectsReplacedLastEvent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := openLog(t, path)
+	l.Record(Event{Action: ActionLogin, User: "olivia"})
+	l.Record(Event{Action: ActionLogin, User: "olivia"})
+
+	// A forged last event with a valid hash still isn't the one recorded.
+	lines := readLines(t, path)
+	var e Event
+	if err := json.Unmarshal(lines[1], &e); err != nil {
+		t.Fatal(err)
+	}
+	e.User = "adam"
+	e.Hash, _ = e.hash()
+	b, _ := json.Marshal(e)
+	lines[1] = append(b, '\n')
+	writeLines(t, path, lines)
+
+	if _, _, err := l.Verify(); err == nil || !strings.Contains(err.Error(), "not the event recorded") {
+		t.Errorf("Verify() = %v", err)
+	}
+}
+
+func TestCatchUpFollowsOtherWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a := openLog(t, path)
+	b := openLog(t, path)
+	a.Record(Event{Action: ActionLogin, User: "olivia"})
+	b.Record(Event{Action: ActionLogin, User: "adam"})
+	a.Record(Event{Action: ActionDetach, User: "olivia"})
+	for _, l := range []*Log{a, b} {
+		if n, _, err := l.Verify(); err != nil || n != 3 {
+			t.Errorf("Verify() = %d, %v", n, err)
+		}
+	}
+}
+
+func TestCatchUpTruncatesUnfinishedEvent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := openLog(t, path)
+	l.Record(Event{Action: ActionLogin, User: "olivia"})
+
+	// Another server crashed halfway through writing an event.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":2,"action":"log`)
+	f.Close()
+
+	l.Record(Event{Action: ActionLogin, User: "adam"})
+	var e Event
+	if lines := readLines(t, path); len(lines) != 2 || json.Unmarshal(lines[1], &e) != nil || e.Seq != 2 || e.User != "adam" {
+		t.Errorf("log = %q", lines)
+	}
+	if n, _, err := l.Verify(); err != nil || n != 2 {
+		t.Errorf("Verify() = %d, %v", n, err)
+	}
+
+	// Opening the log cuts off an unfinished event too.
+	l.Close()
+	f, _ = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString(`{"seq":3`)
+	f.Close()
+	l = openLog(t, path)
+	if n, _, err := l.Verify(); err != nil || n != 2 {
+		t.Errorf("Verify() after reopening = %d, %v", n, err)
+	}
+}
+
+func TestRecordOnce(t *testing.T) {
+	l := openLog(t, filepath.Join(t.TempDir(), "audit.log"))
+	e := Event{Action: ActionLogin, Via: "proxy", User: "olivia", Addr: "10.0.0.1"}
+	for i := 0; i < 3; i++ {
+		l.RecordOnce(e, time.Hour)
+	}
+	other := e
+	other.Addr = "10.0.0.2"
+	l.RecordOnce(other, time.Hour)
+	if n, _, _ := l.Verify(); n != 2 {
+		t.Errorf("%d events recorded, want 2", n)
+	}
+
+	// Once the interval has passed, the event is recorded again.
+	l.RecordOnce(e, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	l.RecordOnce(e, time.Nanosecond)
+	if n, _, _ := l.Verify(); n != 4 {
+		t.Errorf("%d events recorded, want 4", n)
+	}
+}
+
+func TestNilLogRecordsNothing(t *testing.T) {
+	var l *Log
+	l.Record(Event{Action: ActionLogin})
+	l.RecordOnce(Event{Action: ActionLogin}, time.Minute)
+}
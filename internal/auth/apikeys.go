@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKeyPrefix marks API keys so they can be told apart from login tokens.
+const APIKeyPrefix = "adc_"
+
+// lastUsedInterval throttles how often a key's last use is written to disk.
+const lastUsedInterval = time.Minute
+
+var (
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	ErrAPIKeyExists   = errors.New("API key with this name already exists")
+)
+
+// Scope limits what an API key may do, on top of its owner's role.
+type Scope string
+
+const (
+	ScopeSessionsRead  Scope = "sessions:read"  // list and watch sessions, read history and recordings
+	ScopeSessionsWrite Scope = "sessions:write" // create, rename and delete sessions, create invites
+	ScopeSessionsInput Scope = "sessions:input" // type into and resize sessions
+	ScopeMetricsRead   Scope = "metrics:read"   // scrape /metrics (admins' keys only)
+)
+
+func (s Scope) Valid() bool {
+	return s == ScopeSessionsRead || s == ScopeSessionsWrite || s == ScopeSessionsInput || s == ScopeMetricsRead
+}
+
+// APIKey is a long-lived credential for automation. It acts as its owner,
+// restricted to its scopes. Only a hash of the key is kept.
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Owner      string     `json:"owner"`
+	Scopes     []Scope    `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	KeyHash    string     `json:"keyHash,omitempty"` // empty outside the store
+}
+
+func (k *APIKey) expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// public returns a copy of k without its key hash.
+func (k *APIKey) public() *APIKey {
+	c := *k
+	c.KeyHash = ""
+	c.Scopes = append([]Scope(nil), k.Scopes...)
+	return &c
+}
+
+// APIKeyStore keeps API keys in a JSON file.
+type APIKeyStore struct {
+	mu     sync.RWMutex
+	path   string
+	keys   map[string]*APIKey // ID -> key
+	byHash map[string]*APIKey
+}
+
+func OpenAPIKeyStore(path string) (*APIKeyStore, error) {
+	s := &APIKeyStore{path: path, keys: make(map[string]*APIKey), byHash: make(map[string]*APIKey)}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the key file again, for a server taking over from one that
+// may have changed it.
+func (s *APIKeyStore) Reload() error {
+	b, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*APIKey
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	keys := make(map[string]*APIKey, len(list))
+	byHash := make(map[string]*APIKey, len(list))
+	for _, k := range list {
+		keys[k.ID] = k
+		byHash[k.KeyHash] = k
+	}
+	s.mu.Lock()
+	s.keys, s.byHash = keys, byHash
+	s.mu.Unlock()
+	return nil
+}
+
+// Create issues a key named name for owner and returns it with the secret
+// key, which is not stored and can't be retrieved later. A zero lifetime
+// never expires.
+func (s *APIKeyStore) Create(owner, name string, scopes []Scope, lifetime time.Duration) (*APIKey, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", fmt.Errorf("name is required")
+	}
+	if len(scopes) == 0 {
+		return nil, "", fmt.Errorf("at least one scope is required")
+	}
+	for _, sc := range scopes {
+		if !sc.Valid() {
+			return nil, "", fmt.Errorf("invalid scope %q", sc)
+		}
+	}
+	if lifetime < 0 {
+		return nil, "", fmt.Errorf("expiresIn must be positive")
+	}
+	secret, err := GenerateSessionToken()
+	if err != nil {
+		return nil, "", err
+	}
+	id, err := GenerateSessionToken()
+	if err != nil {
+		return nil, "", err
+	}
+	key := APIKeyPrefix + secret
+	now := time.Now()
+	k := &APIKey{
+		ID:        id[:12],
+		Name:      name,
+		Owner:     owner,
+		Scopes:    scopes,
+		CreatedAt: now,
+		KeyHash:   hashToken(key),
+	}
+	if lifetime > 0 {
+		exp := now.Add(lifetime)
+		k.ExpiresAt = &exp
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, other := range s.keys {
+		if other.Owner == owner && other.Name == name {
+			return nil, "", ErrAPIKeyExists
+		}
+	}
+	s.keys[k.ID] = k
+	s.byHash[k.KeyHash] = k
+	if err := s.save(); err != nil {
+		delete(s.keys, k.ID)
+		delete(s.byHash, k.KeyHash)
+		return nil, "", err
+	}
+	return k.public(), key, nil
+}
+
+// Validate returns the unexpired key matching key and records its use.
+func (s *APIKeyStore) Validate(key string) (*APIKey, bool) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return nil, false
+	}
+	h := hashToken(key)
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.byHash[h]
+	if !ok || k.expired(now) {
+		return nil, false
+	}
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) >= lastUsedInterval {
+		k.LastUsedAt = &now
+		s.save()
+	}
+	return k.public(), true
+}
+
+// Active reports whether the key id exists and hasn't expired.
+func (s *APIKeyStore) Active(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.keys[id]
+	return ok && !k.expired(time.Now())
+}
+
+func (s *APIKeyStore) Get(id string) (*APIKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return nil, false
+	}
+	return k.public(), true
+}
+
+// List returns all keys, including expired ones, oldest first.
+func (s *APIKeyStore) List() []*APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]*APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k.public())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// Revoke deletes the key id.
+func (s *APIKeyStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return ErrAPIKeyNotFound
+	}
+	delete(s.keys, id)
+	delete(s.byHash, k.KeyHash)
+	if err := s.save(); err != nil {
+		s.keys[id] = k
+		s.byHash[k.KeyHash] = k
+		return err
+	}
+	return nil
+}
+
+// RevokeOwner deletes every key owned by owner.
+func (s *APIKeyStore) RevokeOwner(owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := false
+	for id, k := range s.keys {
+		if k.Owner == owner {
+			delete(s.keys, id)
+			delete(s.byHash, k.KeyHash)
+			removed = true
+		}
+	}
+	if !removed {
+		return nil
+	}
+	return s.save()
+}
+
+// save writes the key file atomically. Called with s.mu held.
+func (s *APIKeyStore) save() error {
+	list := make([]*APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return writeFile(s.path, list)
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newAuthenticator(t *testing.T) *Authenticator {
+	t.Helper()
+	dir := t.TempDir()
+	invites, err := OpenInviteStore(filepath.Join(dir, "invites.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := OpenAPIKeyStore(filepath.Join(dir, "apikeys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Authenticator{Sessions: NewSessionStore(), Users: newUserStore(t), Invites: invites, APIKeys: keys}
+}
+
+func TestAPIKeyCreateValidates(t *testing.T) {
+	a := newAuthenticator(t)
+	tests := []struct {
+		name     string
+		scopes   []Scope
+		lifetime time.Duration
+	}{
+		{"", []Scope{ScopeSessionsRead}, 0},
+		{"ci", nil, 0},
+		{"ci", []Scope{"sessions:everything"}, 0},
+		{"ci", []Scope{ScopeSessionsRead}, -time.Hour},
+	}
+	for _, tt := range tests {
+		if _, _, err := a.APIKeys.Create("olivia", tt.name, tt.scopes, tt.lifetime); err == nil {
+			t.Errorf("Create(%q, %v, %v) succeeded", tt.name, tt.scopes, tt.lifetime)
+		}
+	}
+	if _, _, err := a.APIKeys.Create("olivia", "ci", []Scope{ScopeSessionsRead}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.APIKeys.Create("olivia", "ci", []Scope{ScopeSessionsRead}, 0); err != ErrAPIKeyExists {
+		t.Errorf("duplicate name: got %v, want ErrAPIKeyExists", err)
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	a := newAuthenticator(t)
+	if _, err := a.Users.Create("olivia", "secret", RoleOperator, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, key, err := a.APIKeys.Create("olivia", "ci", []Scope{ScopeSessionsRead}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ok := a.Authenticate(key)
+	if !ok {
+		t.Fatal("key rejected")
+	}
+	if p.IsUser() || p.Username != "olivia" || p.Role != RoleOperator {
+		t.Errorf("principal = %+v", p)
+	}
+	// A read-only key sees its owner's sessions and can do nothing else.
+	if !p.CanView("s1", "olivia") {
+		t.Error("read key can't view its owner's session")
+	}
+	if p.CanView("s2", "adam") {
+		t.Error("read key can view another user's session")
+	}
+	if p.CanControl("s1", "olivia") || p.CanManage("olivia") || p.CanCreate() {
+		t.Error("read key can change sessions")
+	}
+
+	_, key, err = a.APIKeys.Create("olivia", "bot", []Scope{ScopeSessionsInput, ScopeSessionsWrite}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, _ = a.Authenticate(key); p.CanView("s1", "olivia") {
+		t.Error("key without sessions:read can view")
+	}
+	if !p.CanControl("s1", "olivia") || !p.CanManage("olivia") || !p.CanCreate() {
+		t.Error("key can't use its scopes")
+	}
+	// Scopes never reach past the owner's role.
+	if p.CanControl("s2", "adam") || p.CanManage("adam") {
+		t.Error("key can change another user's session")
+	}
+}
+
+func TestAPIKeyRequireAdminScope(t *testing.T) {
+	a := newAuthenticator(t)
+	for _, u := range []struct {
+		name string
+		role Role
+	}{{"adam", RoleAdmin}, {"olivia", RoleOperator}} {
+		if _, err := a.Users.Create(u.name, "secret", u.role, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, adminMetrics, _ := a.APIKeys.Create("adam", "prometheus", []Scope{ScopeMetricsRead}, 0)
+	_, adminRead, _ := a.APIKeys.Create("adam", "ci", []Scope{ScopeSessionsRead}, 0)
+	_, operatorMetrics, _ := a.APIKeys.Create("olivia", "prometheus", []Scope{ScopeMetricsRead}, 0)
+
+	handler := RequireAuth(a)(RequireAdminScope(ScopeMetricsRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	for key, want := range map[string]int{
+		adminMetrics:    http.StatusOK,
+		adminRead:       http.StatusForbidden,
+		operatorMetrics: http.StatusForbidden,
+		"adc_unknown":   http.StatusUnauthorized,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		r.Header.Set("Authorization", "Bearer "+key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if rec.Code != want {
+			t.Errorf("key %.8s...: status %d, want %d", key, rec.Code, want)
+		}
+	}
+
+	// Keys never pass for a signed-in user.
+	r := httptest.NewRequest(http.MethodGet, "/api/me/password", nil)
+	r.Header.Set("Authorization", "Bearer "+adminMetrics)
+	rec := httptest.NewRecorder()
+	RequireAuth(a)(RequireUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))).ServeHTTP(rec, r)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("key on a user-only route: status %d, want 403", rec.Code)
+	}
+}
+
+func TestAPIKeyLapses(t *testing.T) {
+	a := newAuthenticator(t)
+	if _, err := a.Users.Create("olivia", "secret", RoleOperator, nil); err != nil {
+		t.Fatal(err)
+	}
+	k, key, err := a.APIKeys.Create("olivia", "ci", []Scope{ScopeSessionsRead}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ok := a.Authenticate(key)
+	if !ok {
+		t.Fatal("key rejected")
+	}
+	if _, ok := a.Authenticate(APIKeyPrefix + "x" + key[len(APIKeyPrefix):]); ok {
+		t.Error("altered key accepted")
+	}
+
+	// Demoting the owner ends connections made with the key.
+	viewer := RoleViewer
+	if _, err := a.Users.Update("olivia", UserUpdate{Role: &viewer}); err != nil {
+		t.Fatal(err)
+	}
+	if p.Active() {
+		t.Error("connection still active after the owner's role changed")
+	}
+	if p, ok = a.Authenticate(key); !ok || p.Role != RoleViewer {
+		t.Fatalf("key after demotion: %+v, %v", p, ok)
+	}
+	if err := a.APIKeys.Revoke(k.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.Authenticate(key); ok {
+		t.Error("revoked key accepted")
+	}
+	if p.Active() {
+		t.Error("connection on a revoked key still active")
+	}
+
+	// Expired keys are refused.
+	k, key, _ = a.APIKeys.Create("olivia", "short", []Scope{ScopeSessionsRead}, time.Hour)
+	past := time.Now().Add(-time.Minute)
+	a.APIKeys.keys[k.ID].ExpiresAt = &past
+	if _, ok := a.Authenticate(key); ok {
+		t.Error("expired key accepted")
+	}
+	if a.APIKeys.Active(k.ID) {
+		t.Error("expired key active")
+	}
+}
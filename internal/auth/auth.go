@@ -1,32 +1,134 @@
 package auth
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
-type AuthService struct {
-	passwordHash []byte
+func GenerateSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Principal is the authenticated identity behind a request: a user signed
+// in directly or through one of their API keys, or the holder of an invite
+// to a single session.
+type Principal struct {
+	Username string
+	Role     Role
+
+	// Set for a login that must enroll in two-factor authentication before
+	// it may do anything else.
+	Enrolling bool
+
+	// Set for API keys, which act as their owner limited to Scopes.
+	KeyID  string
+	Scopes []Scope
+
+	// Set for invite holders, who may only access SessionID.
+	InviteID  string
+	SessionID string
+	Access    Access
+
+	// Set when the browser supplied the credentials by itself, so the
+	// request needs a CSRF token to change anything.
+	ambient bool
+
+	active func() bool
+}
+
+// IsUser reports whether p is a user signed in with a password, rather
+// than an API key or invite.
+func (p *Principal) IsUser() bool {
+	return p.KeyID == "" && p.InviteID == ""
 }
 
-func NewAuthService(password string) (*AuthService, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return nil, err
+// Allows reports whether p's scopes include s. Only API keys have scopes.
+func (p *Principal) Allows(s Scope) bool {
+	if p.KeyID == "" {
+		return true
+	}
+	for _, sc := range p.Scopes {
+		if sc == s {
+			return true
+		}
 	}
-	return &AuthService{passwordHash: hash}, nil
+	return false
 }
 
-func (a *AuthService) VerifyPassword(password string) bool {
-	return bcrypt.CompareHashAndPassword(a.passwordHash, []byte(password)) == nil
+// Active reports whether the credential the principal authenticated with is
+// still valid, so long-lived connections can end when it is revoked.
+func (p *Principal) Active() bool {
+	return p.active == nil || p.active()
 }
 
-func GenerateSessionToken() (string, error) {
-	b := make([]byte, 32)
-	if _, err := rand.Read(b); err != nil {
-		return "", err
+// CanCreate reports whether p may start new sessions.
+func (p *Principal) CanCreate() bool {
+	return p.InviteID == "" && p.Allows(ScopeSessionsWrite) &&
+		(p.Role == RoleAdmin || p.Role == RoleOperator)
+}
+
+// CanView reports whether p may see and watch session id, owned by owner.
+// Sessions without an owner predate user accounts; only admins and viewers
+// see them.
+func (p *Principal) CanView(id, owner string) bool {
+	if p.InviteID != "" {
+		return id == p.SessionID
 	}
-	return hex.EncodeToString(b), nil
+	if !p.Allows(ScopeSessionsRead) {
+		return false
+	}
+	switch p.Role {
+	case RoleAdmin, RoleViewer:
+		return true
+	case RoleOperator:
+		return owner != "" && owner == p.Username
+	}
+	return false
+}
+
+// CanControl reports whether p may type into and resize session id, owned
+// by owner.
+func (p *Principal) CanControl(id, owner string) bool {
+	if p.InviteID != "" {
+		return id == p.SessionID && p.Access == AccessWrite
+	}
+	return p.Allows(ScopeSessionsInput) && p.owns(owner)
+}
+
+// CanManage reports whether p may rename, delete and invite others to a
+// session owned by owner.
+func (p *Principal) CanManage(owner string) bool {
+	return p.InviteID == "" && p.Allows(ScopeSessionsWrite) && p.owns(owner)
+}
+
+// owns reports whether p's role gives it control of a session owned by
+// owner.
+func (p *Principal) owns(owner string) bool {
+	switch {
+	case p.InviteID != "":
+		return false
+	case p.Role == RoleAdmin:
+		return true
+	case p.Role == RoleOperator:
+		return owner != "" && owner == p.Username
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying p.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the principal stored by RequireAuth.
+func PrincipalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
 }
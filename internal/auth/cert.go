@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// CertAuth signs in clients that present a verified TLS client certificate
+// as the existing user named in the certificate.
+type CertAuth struct {
+	Field string // "cn" for the subject common name, "email" for the first email SAN
+}
+
+func (c *CertAuth) Validate() error {
+	if c.Field != "cn" && c.Field != "email" {
+		return fmt.Errorf("client certificate user field must be cn or email, not %q", c.Field)
+	}
+	return nil
+}
+
+// Identity returns the username in r's client certificate, if r has one
+// that was verified against the client CAs.
+func (c *CertAuth) Identity(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	switch c.Field {
+	case "cn":
+		return leaf.Subject.CommonName, leaf.Subject.CommonName != ""
+	case "email":
+		if len(leaf.EmailAddresses) > 0 {
+			return leaf.EmailAddresses[0], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// writeFile atomically replaces the JSON file at path with v. The file holds
+// credentials, so it is only readable by the server's user.
+func writeFile(path string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	// A temporary file of its own, as two servers may save the same store
+	// during an upgrade.
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
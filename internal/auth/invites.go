@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InvitePrefix marks invite tokens so they can be told apart from login
+// tokens.
+const InvitePrefix = "inv_"
+
+// MaxInviteLifetime caps how long an invite may stay valid.
+const MaxInviteLifetime = 30 * 24 * time.Hour
+
+var ErrInviteNotFound = errors.New("invite not found")
+
+// Access is the capability an invite grants on its session.
+type Access string
+
+const (
+	AccessRead  Access = "read"  // watch as a spectator
+	AccessWrite Access = "write" // type into and resize the session
+)
+
+func (a Access) Valid() bool {
+	return a == AccessRead || a == AccessWrite
+}
+
+// Invite grants access to a single session to whoever holds its token.
+// Only a hash of the token is kept.
+type Invite struct {
+	ID        string    `json:"id"`
+	SessionID string    `json:"sessionId"`
+	Owner     string    `json:"owner,omitempty"` // owner of the session
+	Access    Access    `json:"access"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	TokenHash string    `json:"tokenHash,omitempty"` // empty outside the store
+}
+
+func (i *Invite) expired(now time.Time) bool {
+	return !now.Before(i.ExpiresAt)
+}
+
+// public returns a copy of i without its token hash.
+func (i *Invite) public() *Invite {
+	c := *i
+	c.TokenHash = ""
+	return &c
+}
+
+// InviteStore keeps outstanding invites in a JSON file. Expired invites are
+// dropped periodically.
+type InviteStore struct {
+	mu      sync.RWMutex
+	path    string
+	invites map[string]*Invite // ID -> invite
+}
+
+func OpenInviteStore(path string) (*InviteStore, error) {
+	s := &InviteStore{path: path, invites: make(map[string]*Invite)}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	go s.cleanup()
+	return s, nil
+}
+
+// Reload reads the invite file again, for a server taking over from one
+// that may have changed it.
+func (s *InviteStore) Reload() error {
+	b, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*Invite
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	invites := make(map[string]*Invite, len(list))
+	for _, inv := range list {
+		invites[inv.ID] = inv
+	}
+	s.mu.Lock()
+	s.invites = invites
+	s.mu.Unlock()
+	return nil
+}
+
+// Create mints an invite to sessionID, owned by owner, and returns it with
+// its token, which is not stored and can't be retrieved later.
+func (s *InviteStore) Create(sessionID, owner string, access Access, createdBy string, lifetime time.Duration) (*Invite, string, error) {
+	if !access.Valid() {
+		return nil, "", fmt.Errorf("invalid access %q", access)
+	}
+	if lifetime <= 0 || lifetime > MaxInviteLifetime {
+		return nil, "", fmt.Errorf("invite lifetime must be between 0 and %s", MaxInviteLifetime)
+	}
+	secret, err := GenerateSessionToken()
+	if err != nil {
+		return nil, "", err
+	}
+	id, err := GenerateSessionToken()
+	if err != nil {
+		return nil, "", err
+	}
+	token := InvitePrefix + secret
+	now := time.Now()
+	inv := &Invite{
+		ID:        id[:12],
+		SessionID: sessionID,
+		Owner:     owner,
+		Access:    access,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+		ExpiresAt: now.Add(lifetime),
+		TokenHash: hashToken(token),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.invites[inv.ID] = inv
+	if err := s.save(); err != nil {
+		delete(s.invites, inv.ID)
+		return nil, "", err
+	}
+	return inv.public(), token, nil
+}
+
+// Validate returns the unexpired invite a token belongs to.
+func (s *InviteStore) Validate(token string) (*Invite, bool) {
+	if !strings.HasPrefix(token, InvitePrefix) {
+		return nil, false
+	}
+	h := hashToken(token)
+	now := time.Now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, inv := range s.invites {
+		if inv.TokenHash == h && !inv.expired(now) {
+			return inv.public(), true
+		}
+	}
+	return nil, false
+}
+
+// Active reports whether the invite id exists and hasn't expired.
+func (s *InviteStore) Active(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	inv, ok := s.invites[id]
+	return ok && !inv.expired(time.Now())
+}
+
+func (s *InviteStore) Get(id string) (*Invite, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	inv, ok := s.invites[id]
+	if !ok || inv.expired(time.Now()) {
+		return nil, false
+	}
+	return inv.public(), true
+}
+
+// List returns the unexpired invites, newest first.
+func (s *InviteStore) List() []*Invite {
+	now := time.Now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]*Invite, 0, len(s.invites))
+	for _, inv := range s.invites {
+		if !inv.expired(now) {
+			list = append(list, inv.public())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Revoke deletes the invite id.
+func (s *InviteStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inv, ok := s.invites[id]
+	if !ok {
+		return ErrInviteNotFound
+	}
+	delete(s.invites, id)
+	if err := s.save(); err != nil {
+		s.invites[id] = inv
+		return err
+	}
+	return nil
+}
+
+// RevokeCreator deletes every invite created by username.
+func (s *InviteStore) RevokeCreator(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := false
+	for id, inv := range s.invites {
+		if inv.CreatedBy == username {
+			delete(s.invites, id)
+			removed = true
+		}
+	}
+	if !removed {
+		return nil
+	}
+	return s.save()
+}
+
+func (s *InviteStore) cleanup() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		now := time.Now()
+		removed := false
+		for id, inv := range s.invites {
+			if inv.expired(now) {
+				delete(s.invites, id)
+				removed = true
+			}
+		}
+		if removed {
+			s.save()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// save writes the invite file atomically. Called with s.mu held.
+func (s *InviteStore) save() error {
+	list := make([]*Invite, 0, len(s.invites))
+	for _, inv := range s.invites {
+		list = append(list, inv)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return writeFile(s.path, list)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
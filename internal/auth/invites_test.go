@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInviteLapsesWithCreator(t *testing.T) {
+	a := newAuthenticator(t)
+	users, invites := a.Users, a.Invites
+	if _, err := users.Create("olivia", "secret", RoleOperator, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Create("adam", "secret", RoleAdmin, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// olivia shares her own session; adam, as an admin, shares hers too.
+	_, own, _ := invites.Create("s1", "olivia", AccessRead, "olivia", time.Hour)
+	_, byAdmin, _ := invites.Create("s1", "olivia", AccessWrite, "adam", time.Hour)
+	p, ok := a.Authenticate(own)
+	if !ok || p.SessionID != "s1" {
+		t.Fatalf("invite from owner rejected: %+v", p)
+	}
+	pAdmin, ok := a.Authenticate(byAdmin)
+	if !ok {
+		t.Fatal("invite from admin rejected")
+	}
+
+	// Demoted, adam may no longer share olivia's session.
+	operator := RoleOperator
+	if _, err := users.Update("adam", UserUpdate{Role: &operator}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.Authenticate(byAdmin); ok {
+		t.Error("invite from demoted admin accepted")
+	}
+	if pAdmin.Active() {
+		t.Error("connection on demoted admin's invite still active")
+	}
+
+	// Deleted, olivia's invites go with her.
+	if err := users.Delete("olivia"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.Authenticate(own); ok {
+		t.Error("invite from deleted user accepted")
+	}
+	if p.Active() {
+		t.Error("connection on deleted user's invite still active")
+	}
+	invites.RevokeCreator("olivia")
+	for _, inv := range invites.List() {
+		if inv.CreatedBy == "olivia" {
+			t.Errorf("invite %s not revoked", inv.ID)
+		}
+	}
+}
+
+func TestRedactURI(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"/invite/inv_abc123", "/invite/REDACTED"},
+		{"/ws/s1?token=abc123", "/ws/s1?token=REDACTED"},
+		{"/auth/oidc/callback?code=c&state=s", "/auth/oidc/callback?code=REDACTED&state=REDACTED"},
+		{"/api/sessions?owner=alice", "/api/sessions?owner=alice"},
+		{"/api/sessions", "/api/sessions"},
+	}
+	for _, tt := range tests {
+		if got := RedactURI(tt.in); got != tt.want {
+			t.Errorf("RedactURI(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -1,77 +1,355 @@
 package auth
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
-	"sync"
+	"net/netip"
+	"net/url"
+	"strings"
 	"time"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/audit"
 )
 
 const CookieName = "ai_conductor_session"
 
-type SessionStore struct {
-	mu       sync.RWMutex
-	sessions map[string]time.Time // token -> expiry
+// InviteCookieName holds the token of a redeemed invite, apart from the
+// login cookie so following an invite link doesn't sign the browser out.
+const InviteCookieName = "ai_conductor_invite"
+
+// externalAuditInterval is how often sign-ins by proxy header or client
+// certificate, which come with every request, are audited for the same
+// user and address.
+const externalAuditInterval = 10 * time.Minute
+
+// Authenticator resolves requests to principals.
+type Authenticator struct {
+	Sessions *SessionStore
+	Users    *UserStore
+	Invites  *InviteStore
+	APIKeys  *APIKeyStore
+	Proxy    *ProxyAuth // nil unless reverse-proxy authentication is set up
+	Certs    *CertAuth  // nil unless client certificates are accepted
+	Audit    *audit.Log
+}
+
+// AuthenticateRequest returns the principal behind r: the user a trusted
+// proxy asserts, if any, else the user named by a verified client
+// certificate, else the owner of the request's token.
+func (a *Authenticator) AuthenticateRequest(r *http.Request) (*Principal, bool) {
+	p, asserted := a.external(r)
+	if asserted {
+		return p, p != nil
+	}
+	if p != nil {
+		return p, true
+	}
+	token, fromCookie := requestToken(r)
+	p, ok := a.Authenticate(token)
+	if !ok && (token == "" || fromCookie) {
+		// A browser's own login takes precedence over an invite it followed.
+		if c, err := r.Cookie(InviteCookieName); err == nil {
+			p, ok = a.Authenticate(c.Value)
+			ok = ok && p.InviteID != ""
+			fromCookie = true
+		}
+	}
+	if ok {
+		p.ambient = fromCookie
+	}
+	return p, ok
+}
+
+// SignedInExternally reports whether r is signed in by a proxy or client
+// certificate, without a login of its own.
+func (a *Authenticator) SignedInExternally(r *http.Request) bool {
+	p, _ := a.external(r)
+	return p != nil
+}
+
+// external returns the user signed in by a proxy header or client
+// certificate. asserted is set if a trusted proxy named a user, whether or
+// not they may sign in, as other credentials must not be tried then.
+func (a *Authenticator) external(r *http.Request) (p *Principal, asserted bool) {
+	if a.Proxy != nil {
+		if username, groups, ok := a.Proxy.Identity(r); ok {
+			user, err := a.Users.Provision(username, ExternalID{Source: SourceProxy}, a.Proxy.Roles(), groups)
+			if err != nil {
+				err = ProvisionError(err, groups)
+				a.Audit.RecordOnce(audit.Event{Action: audit.ActionLoginFailed, Via: "proxy", User: username, Addr: ClientIP(r), Detail: err.Error()}, externalAuditInterval)
+				return nil, true
+			}
+			a.Audit.RecordOnce(audit.Event{Action: audit.ActionLogin, Via: "proxy", User: user.Username, Addr: ClientIP(r)}, externalAuditInterval)
+			return a.userPrincipal(user), true
+		}
+	}
+	if a.Certs != nil {
+		if username, ok := a.Certs.Identity(r); ok {
+			if user, ok := a.Users.Get(username); ok {
+				a.Audit.RecordOnce(audit.Event{Action: audit.ActionLogin, Via: "certificate", User: user.Username, Addr: ClientIP(r)}, externalAuditInterval)
+				return a.userPrincipal(user), false
+			}
+			a.Audit.RecordOnce(audit.Event{Action: audit.ActionLoginFailed, Via: "certificate", User: username, Addr: ClientIP(r), Detail: "no such user"}, externalAuditInterval)
+		}
+	}
+	return nil, false
 }
 
-func NewSessionStore() *SessionStore {
-	s := &SessionStore{
-		sessions: make(map[string]time.Time),
+// ProvisionError explains why Provision refused a single sign-on login by
+// a user in groups.
+func ProvisionError(err error, groups []string) error {
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		return fmt.Errorf("no account, and groups %v grant no role", groups)
+	case errors.Is(err, ErrNoRole):
+		return fmt.Errorf("groups %v grant no role", groups)
 	}
-	go s.cleanup()
-	return s
+	return err
 }
 
-func (s *SessionStore) Add(token string, duration time.Duration) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.sessions[token] = time.Now().Add(duration)
+// userPrincipal returns the principal for a user signed in by proxy or
+// certificate, which stays valid as long as the user and role do.
+func (a *Authenticator) userPrincipal(user *User) *Principal {
+	return &Principal{
+		Username: user.Username,
+		Role:     user.Role,
+		ambient:  true,
+		active: func() bool {
+			u, ok := a.Users.Get(user.Username)
+			return ok && u.Role == user.Role
+		},
+	}
 }
 
-func (s *SessionStore) Validate(token string) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	expiry, ok := s.sessions[token]
-	return ok && time.Now().Before(expiry)
+// ValidateInvite returns the unexpired invite a token belongs to, as long as
+// its creator may still share the session.
+func (a *Authenticator) ValidateInvite(token string) (*Invite, bool) {
+	inv, ok := a.Invites.Validate(token)
+	if !ok || !a.inviterAllowed(inv) {
+		return nil, false
+	}
+	return inv, true
 }
 
-func (s *SessionStore) Remove(token string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	delete(s.sessions, token)
+// inviterAllowed reports whether the creator of inv still exists and may
+// still share its session, so invites lapse when their creator is deleted
+// or demoted.
+func (a *Authenticator) inviterAllowed(inv *Invite) bool {
+	u, ok := a.Users.Get(inv.CreatedBy)
+	if !ok {
+		return false
+	}
+	owner := inv.Owner
+	if owner == "" {
+		// Invites made before owners were recorded.
+		owner = inv.CreatedBy
+	}
+	return (&Principal{Username: u.Username, Role: u.Role}).CanManage(owner)
 }
 
-func (s *SessionStore) cleanup() {
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
-	for range ticker.C {
-		s.mu.Lock()
-		now := time.Now()
-		for token, expiry := range s.sessions {
-			if now.After(expiry) {
-				delete(s.sessions, token)
-			}
+// Authenticate returns the principal behind token. Users are looked up on
+// every request so role changes and deletions apply immediately.
+func (a *Authenticator) Authenticate(token string) (*Principal, bool) {
+	if token == "" {
+		return nil, false
+	}
+	if inv, ok := a.ValidateInvite(token); ok {
+		return &Principal{
+			Username:  "invite:" + inv.ID,
+			InviteID:  inv.ID,
+			SessionID: inv.SessionID,
+			Access:    inv.Access,
+			active:    func() bool { return a.Invites.Active(inv.ID) && a.inviterAllowed(inv) },
+		}, true
+	}
+	if key, ok := a.APIKeys.Validate(token); ok {
+		user, ok := a.Users.Get(key.Owner)
+		if !ok {
+			return nil, false
 		}
-		s.mu.Unlock()
+		return &Principal{
+			Username: user.Username,
+			Role:     user.Role,
+			KeyID:    key.ID,
+			Scopes:   key.Scopes,
+			active: func() bool {
+				u, ok := a.Users.Get(key.Owner)
+				return ok && u.Role == user.Role && a.APIKeys.Active(key.ID)
+			},
+		}, true
+	}
+	login, ok := a.Sessions.Validate(token)
+	if !ok {
+		return nil, false
 	}
+	user, ok := a.Users.Get(login.Username)
+	if !ok {
+		return nil, false
+	}
+	return &Principal{
+		Username:  user.Username,
+		Role:      user.Role,
+		Enrolling: login.Enrolling,
+		active: func() bool {
+			u, ok := a.Users.Get(login.Username)
+			_, valid := a.Sessions.Validate(token)
+			return ok && valid && u.Role == user.Role
+		},
+	}, true
 }
 
-func RequireAuth(store *SessionStore) func(http.Handler) http.Handler {
+// UnixPeer is the client address of requests made over a Unix domain
+// socket, which have no IP address.
+const UnixPeer = "unix"
+
+type (
+	clientIPKey     struct{}
+	clientSchemeKey struct{}
+)
+
+// ForwardedFor makes ClientIP return the client a trusted proxy forwarded a
+// request for, as named in X-Forwarded-For, rather than the proxy. Proxies
+// append the address they got the request from, so the header is read from
+// the end, skipping trusted proxies. Likewise RequestScheme returns the
+// scheme the client used, from X-Forwarded-Proto.
+func ForwardedFor(trusted *TrustedProxies) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			var token string
-
-			// Check X-Session-Token header first (cross-origin REST requests)
-			if headerToken := r.Header.Get("X-Session-Token"); headerToken != "" {
-				token = headerToken
-			} else if queryToken := r.URL.Query().Get("token"); queryToken != "" {
-				// Query param (cross-origin WebSocket connections)
-				token = queryToken
-			} else if cookie, err := r.Cookie(CookieName); err == nil {
-				// Cookie (local requests)
-				token = cookie.Value
+			if ip, ok := forwardedClient(r, trusted); ok {
+				r = r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip))
 			}
+			if scheme, ok := forwardedProto(r, trusted); ok {
+				r = r.WithContext(context.WithValue(r.Context(), clientSchemeKey{}, scheme))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedProto returns the scheme in X-Forwarded-Proto of a request from
+// a trusted proxy. The first proxy a request passed sets it, so with
+// several the first value is the client's.
+func forwardedProto(r *http.Request, trusted *TrustedProxies) (string, bool) {
+	if !trusted.Contains(peerAddr(r)) {
+		return "", false
+	}
+	proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	switch proto = strings.ToLower(strings.TrimSpace(proto)); proto {
+	case "http", "https":
+		return proto, true
+	}
+	return "", false
+}
+
+func forwardedClient(r *http.Request, trusted *TrustedProxies) (string, bool) {
+	if !trusted.Contains(peerAddr(r)) {
+		return "", false
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			// Nothing before a malformed hop can be believed.
+			return "", false
+		}
+		ip := addr.Unmap().String()
+		if i == 0 || !trusted.Contains(ip) {
+			return ip, true
+		}
+	}
+	return "", false
+}
+
+// ClientIP returns the address a request came from, without its port, or
+// UnixPeer for requests over a Unix domain socket. Behind a trusted proxy
+// it is the proxy's client; see ForwardedFor.
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return peerAddr(r)
+}
+
+// RequestScheme returns the scheme, "http" or "https", a request was made
+// with. Behind a trusted proxy it is the one the proxy's client used; see
+// ForwardedFor.
+func RequestScheme(r *http.Request) string {
+	if scheme, ok := r.Context().Value(clientSchemeKey{}).(string); ok {
+		return scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// peerAddr returns the address of the other end of r's connection, without
+// its port, or UnixPeer.
+func peerAddr(r *http.Request) string {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+		return UnixPeer
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RequestToken returns the token a request authenticates with.
+func RequestToken(r *http.Request) string {
+	token, _ := requestToken(r)
+	return token
+}
+
+// requestToken returns the token a request authenticates with, and whether
+// it came from the login cookie.
+func requestToken(r *http.Request) (string, bool) {
+	// Check X-Session-Token header first (cross-origin REST requests)
+	if headerToken := r.Header.Get("X-Session-Token"); headerToken != "" {
+		return headerToken, false
+	}
+	// Authorization: Bearer (API keys and other automation)
+	if scheme, bearer, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(bearer), false
+	}
+	// Query param (cross-origin WebSocket connections)
+	if queryToken := r.URL.Query().Get("token"); queryToken != "" {
+		return queryToken, false
+	}
+	// Cookie (local requests)
+	if cookie, err := r.Cookie(CookieName); err == nil {
+		return cookie.Value, true
+	}
+	return "", false
+}
+
+// RequireAuth rejects requests without a valid token and stores the
+// token's principal in the request context. Logins that still have to
+// enroll in two-factor authentication are rejected too.
+func RequireAuth(a *Authenticator) func(http.Handler) http.Handler {
+	return requireAuth(a, false)
+}
+
+// RequireAuthOrEnrolling is RequireAuth for the routes a login needs to
+// enroll in two-factor authentication.
+func RequireAuthOrEnrolling(a *Authenticator) func(http.Handler) http.Handler {
+	return requireAuth(a, true)
+}
 
-			if token == "" || !store.Validate(token) {
+func requireAuth(a *Authenticator, allowEnrolling bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := a.AuthenticateRequest(r)
+			if !ok {
 				if isAPIRequest(r) {
 					http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
 				} else {
@@ -79,6 +357,60 @@ func RequireAuth(store *SessionStore) func(http.Handler) http.Handler {
 				}
 				return
 			}
+			if p.Enrolling && !allowEnrolling {
+				if isAPIRequest(r) {
+					http.Error(w, `{"error":"two-factor enrollment required"}`, http.StatusForbidden)
+				} else {
+					http.Redirect(w, r, "/", http.StatusSeeOther)
+				}
+				return
+			}
+			if p.ambient && !validCSRF(r) {
+				http.Error(w, `{"error":"missing or invalid CSRF token"}`, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+		})
+	}
+}
+
+// RequireUser rejects requests not made by a user signed in with a
+// password, such as those made with API keys and invites. It must run after
+// RequireAuth.
+func RequireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := PrincipalFrom(r.Context()); p == nil || !p.IsUser() {
+			http.Error(w, `{"error":"forbidden"}`, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireRole rejects requests not made by a signed-in user with role. It
+// must run after RequireAuth.
+func RequireRole(role Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if p := PrincipalFrom(r.Context()); p == nil || !p.IsUser() || p.Role != role {
+				http.Error(w, `{"error":"forbidden"}`, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireAdminScope rejects requests not made by an admin, either signed
+// in or with one of their API keys that has scope. It must run after
+// RequireAuth.
+func RequireAdminScope(scope Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if p := PrincipalFrom(r.Context()); p == nil || p.InviteID != "" || p.Role != RoleAdmin || !p.Allows(scope) {
+				http.Error(w, `{"error":"forbidden"}`, http.StatusForbidden)
+				return
+			}
 			next.ServeHTTP(w, r)
 		})
 	}
@@ -86,5 +418,32 @@ func RequireAuth(store *SessionStore) func(http.Handler) http.Handler {
 
 func isAPIRequest(r *http.Request) bool {
 	return len(r.URL.Path) >= 4 && r.URL.Path[:4] == "/api" ||
-		len(r.URL.Path) >= 3 && r.URL.Path[:3] == "/ws"
+		len(r.URL.Path) >= 3 && r.URL.Path[:3] == "/ws" ||
+		r.URL.Path == "/metrics"
+}
+
+// redactedParams are query parameters that carry credentials: login and
+// invite tokens, and the OpenID Connect code and state.
+var redactedParams = []string{"token", "code", "state"}
+
+// RedactURI returns a request URI with the credentials it may carry
+// replaced, for logging.
+func RedactURI(uri string) string {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return "[unparsable URI]"
+	}
+	if strings.HasPrefix(u.Path, "/invite/") {
+		u.Path, u.RawPath = "/invite/REDACTED", ""
+	}
+	if u.RawQuery != "" {
+		q := u.Query()
+		for _, k := range redactedParams {
+			if q.Has(k) {
+				q.Set(k, "REDACTED")
+			}
+		}
+		u.RawQuery = q.Encode()
+	}
+	return u.RequestURI()
 }
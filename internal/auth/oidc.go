@@ -0,0 +1,462 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// oidcLoginTimeout is how long a user has to sign in at the provider.
+	oidcLoginTimeout = 10 * time.Minute
+	// maxPendingOIDC caps logins in progress, as starting one needs no
+	// credentials.
+	maxPendingOIDC = 10000
+	// jwksRefreshInterval limits refetching keys for unknown key IDs.
+	jwksRefreshInterval = time.Minute
+	// clockSkew is the leeway allowed on token timestamps.
+	clockSkew = time.Minute
+)
+
+var ErrOIDCState = errors.New("login expired or was started in another browser")
+
+// OIDCConfig configures single sign-on with an OpenID Connect provider.
+type OIDCConfig struct {
+	Name          string   `json:"name"`   // shown on the login button
+	Issuer        string   `json:"issuer"` // e.g. https://accounts.example.com
+	ClientID      string   `json:"clientId"`
+	ClientSecret  string   `json:"clientSecret"`  // empty for public clients
+	RedirectURL   string   `json:"redirectUrl"`   // default <server>/auth/oidc/callback
+	Scopes        []string `json:"scopes"`        // default openid, email, profile
+	UsernameClaim string   `json:"usernameClaim"` // default email
+	GroupsClaim   string   `json:"groupsClaim"`   // default groups
+	RoleMapping
+}
+
+func (c *OIDCConfig) Validate() error {
+	u, err := url.Parse(c.Issuer)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("oidc: issuer must be an http(s) URL")
+	}
+	if c.ClientID == "" {
+		return fmt.Errorf("oidc: clientId is required")
+	}
+	if err := c.RoleMapping.Validate(); err != nil {
+		return fmt.Errorf("oidc: %w", err)
+	}
+	return nil
+}
+
+// OIDCIdentity is a user as asserted by a verified ID token.
+type OIDCIdentity struct {
+	Issuer   string
+	Subject  string
+	Username string
+	Groups   []string
+}
+
+// OIDCProvider runs the authorization code flow, with PKCE, against an
+// OpenID Connect provider. The provider's metadata and keys are fetched on
+// first use, so the server starts even if it is unreachable.
+type OIDCProvider struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	meta        *oidcMetadata
+	keys        map[string]jwk // kid -> key
+	keysFetched time.Time
+	pending     map[string]*oidcPending // state -> login in progress
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcPending struct {
+	verifier    string
+	nonce       string
+	redirectURL string
+	expires     time.Time
+}
+
+func NewOIDCProvider(cfg OIDCConfig) *OIDCProvider {
+	if cfg.Name == "" {
+		cfg.Name = "SSO"
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "email"
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	return &OIDCProvider{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		pending: make(map[string]*oidcPending),
+	}
+}
+
+func (p *OIDCProvider) Name() string { return p.cfg.Name }
+
+// RedirectURL returns the configured callback URL, or "" to derive it from
+// the request.
+func (p *OIDCProvider) RedirectURL() string { return p.cfg.RedirectURL }
+
+// AuthCodeURL starts a login that returns to redirectURL. It returns the
+// provider URL to send the browser to and the state, which the browser must
+// present again when it comes back.
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, redirectURL string) (string, string, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	state, err := GenerateSessionToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := GenerateSessionToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := GenerateSessionToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	p.mu.Lock()
+	for s, pl := range p.pending {
+		if now.After(pl.expires) {
+			delete(p.pending, s)
+		}
+	}
+	if len(p.pending) >= maxPendingOIDC {
+		p.mu.Unlock()
+		return "", "", fmt.Errorf("too many logins in progress")
+	}
+	p.pending[state] = &oidcPending{
+		verifier:    verifier,
+		nonce:       nonce,
+		redirectURL: redirectURL,
+		expires:     now.Add(oidcLoginTimeout),
+	}
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {redirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + q.Encode(), state, nil
+}
+
+// Exchange finishes the login identified by state, redeeming code for an ID
+// token and verifying it.
+func (p *OIDCProvider) Exchange(ctx context.Context, state, code string) (*OIDCIdentity, error) {
+	p.mu.Lock()
+	pl, ok := p.pending[state]
+	delete(p.pending, state)
+	p.mu.Unlock()
+	if !ok || time.Now().After(pl.expires) {
+		return nil, ErrOIDCState
+	}
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {pl.redirectURL},
+		"code_verifier": {pl.verifier},
+	}
+	if p.cfg.ClientSecret == "" {
+		form.Set("client_id", p.cfg.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	var tok struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.fetchJSON(req, &tok)
+	if err != nil {
+		return nil, fmt.Errorf("token endpoint: %w", err)
+	}
+	if status != http.StatusOK || tok.IDToken == "" {
+		if tok.Error != "" {
+			return nil, fmt.Errorf("token endpoint: %s %s", tok.Error, tok.ErrorDescription)
+		}
+		return nil, fmt.Errorf("token endpoint: no ID token (status %d)", status)
+	}
+
+	claims, err := p.verify(ctx, tok.IDToken, pl.nonce)
+	if err != nil {
+		return nil, fmt.Errorf("ID token: %w", err)
+	}
+	return p.identity(claims)
+}
+
+// Roles returns how users' groups map to roles.
+func (p *OIDCProvider) Roles() *RoleMapping {
+	return &p.cfg.RoleMapping
+}
+
+// verify checks an ID token's signature and standard claims and returns
+// its claims.
+func (p *OIDCProvider) verify(ctx context.Context, token, nonce string) (map[string]any, error) {
+	h, claims, signed, sig, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	if h.Alg != "RS256" && h.Alg != "ES256" {
+		return nil, fmt.Errorf("unsupported algorithm %q", h.Alg)
+	}
+	key, err := p.key(ctx, h.Kid, h.Alg)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(h.Alg, key, signed, sig); err != nil {
+		// The provider may have replaced the key under the same ID.
+		if p.fetchKeys(ctx) != nil {
+			return nil, err
+		}
+		if key, err = p.key(ctx, h.Kid, h.Alg); err != nil {
+			return nil, err
+		}
+		if err := verifySignature(h.Alg, key, signed, sig); err != nil {
+			return nil, err
+		}
+	}
+
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != meta.Issuer {
+		return nil, fmt.Errorf("issuer %q does not match", iss)
+	}
+	aud := stringsClaim(claims["aud"])
+	if !slices.Contains(aud, p.cfg.ClientID) {
+		return nil, fmt.Errorf("not issued for this client")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.cfg.ClientID {
+		return nil, fmt.Errorf("not issued for this client")
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return nil, fmt.Errorf("expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && time.Unix(int64(iat), 0).After(now.Add(clockSkew)) {
+		return nil, fmt.Errorf("issued in the future")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, fmt.Errorf("nonce does not match")
+	}
+	return claims, nil
+}
+
+// identity extracts the user from verified claims.
+func (p *OIDCProvider) identity(claims map[string]any) (*OIDCIdentity, error) {
+	username, _ := claims[p.cfg.UsernameClaim].(string)
+	if username == "" {
+		return nil, fmt.Errorf("ID token has no %q claim", p.cfg.UsernameClaim)
+	}
+	if p.cfg.UsernameClaim == "email" {
+		if verified, ok := claims["email_verified"].(bool); ok && !verified {
+			return nil, fmt.Errorf("email address %s is not verified", username)
+		}
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, fmt.Errorf("ID token has no subject")
+	}
+	iss, _ := claims["iss"].(string)
+	return &OIDCIdentity{
+		Issuer:   iss,
+		Subject:  sub,
+		Username: username,
+		Groups:   stringsClaim(claims[p.cfg.GroupsClaim]),
+	}, nil
+}
+
+// metadata returns the provider's discovery document, fetching it the
+// first time.
+func (p *OIDCProvider) metadata(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	meta := p.meta
+	p.mu.Unlock()
+	if meta != nil {
+		return meta, nil
+	}
+
+	u := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	meta = &oidcMetadata{}
+	status, err := p.fetchJSON(req, meta)
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("status %d", status)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if meta.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("oidc discovery: provider reports issuer %q, expected %q", meta.Issuer, p.cfg.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc discovery: incomplete provider metadata")
+	}
+	p.mu.Lock()
+	p.meta = meta
+	p.mu.Unlock()
+	return meta, nil
+}
+
+// key returns the provider's signing key kid for alg, refetching the key
+// set if it isn't known.
+func (p *OIDCProvider) key(ctx context.Context, kid, alg string) (crypto.PublicKey, error) {
+	kty := "RSA"
+	if alg == "ES256" {
+		kty = "EC"
+	}
+	find := func() (jwk, bool) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if k, ok := p.keys[kid]; ok && k.Kty == kty {
+			return k, true
+		}
+		if kid == "" {
+			for _, k := range p.keys {
+				if k.Kty == kty {
+					return k, true
+				}
+			}
+		}
+		return jwk{}, false
+	}
+	k, ok := find()
+	if !ok {
+		if err := p.fetchKeys(ctx); err != nil {
+			return nil, err
+		}
+		if k, ok = find(); !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+	}
+	return k.publicKey()
+}
+
+func (p *OIDCProvider) fetchKeys(ctx context.Context) error {
+	p.mu.Lock()
+	recent := time.Since(p.keysFetched) < jwksRefreshInterval
+	p.mu.Unlock()
+	if recent {
+		return nil
+	}
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, meta.JWKSURI, nil)
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	status, err := p.fetchJSON(req, &set)
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("status %d", status)
+	}
+	if err != nil {
+		return fmt.Errorf("jwks: %w", err)
+	}
+	keys := make(map[string]jwk, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use == "" || k.Use == "sig" {
+			keys[k.Kid] = k
+		}
+	}
+	p.mu.Lock()
+	p.keys = keys
+	p.keysFetched = time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+// fetchJSON sends req and decodes a JSON response body into v, returning
+// the response status.
+func (p *OIDCProvider) fetchJSON(req *http.Request, v any) (int, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(b, v); err != nil && resp.StatusCode == http.StatusOK {
+		return 0, fmt.Errorf("invalid JSON response")
+	}
+	return resp.StatusCode, nil
+}
+
+// stringsClaim returns a claim that may be a string or a list of strings
+// as a list.
+func stringsClaim(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		list := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIdP is an OpenID Connect provider serving discovery, a key set and a
+// token endpoint that issues ID tokens signed with its RSA or EC key.
+type testIdP struct {
+	srv    *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]url.Values // code -> authorization request
+	// alg signs the next token; edit changes its claims and key.
+	alg  string
+	edit func(claims map[string]any) *rsa.PrivateKey
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{rsaKey: rsaKey, ecKey: ecKey, codes: make(map[string]url.Values), alg: "RS256"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.srv.URL,
+			"authorization_endpoint": idp.srv.URL + "/authorize",
+			"token_endpoint":         idp.srv.URL + "/token",
+			"jwks_uri":               idp.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+			{"kty": "EC", "kid": "ec", "use": "sig", "crv": "P-256",
+				"x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		}})
+	})
+	mux.HandleFunc("POST /token", idp.token)
+	idp.srv = httptest.NewServer(mux)
+	t.Cleanup(idp.srv.Close)
+	return idp
+}
+
+// authorize plays the browser signing in at authURL and returns the code
+// the provider redirects back with.
+func (idp *testIdP) authorize(t *testing.T, authURL string) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := GenerateSessionToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.mu.Lock()
+	idp.codes[code] = u.Query()
+	idp.mu.Unlock()
+	return code
+}
+
+func (idp *testIdP) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	idp.mu.Lock()
+	req, ok := idp.codes[r.PostForm.Get("code")]
+	delete(idp.codes, r.PostForm.Get("code"))
+	alg, edit := idp.alg, idp.edit
+	idp.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || r.PostForm.Get("redirect_uri") != req.Get("redirect_uri") ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != req.Get("code_challenge") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	now := time.Now()
+	claims := map[string]any{
+		"iss":    idp.srv.URL,
+		"sub":    "1234",
+		"aud":    req.Get("client_id"),
+		"exp":    now.Add(time.Hour).Unix(),
+		"iat":    now.Unix(),
+		"nonce":  req.Get("nonce"),
+		"email":  "alice@example.com",
+		"groups": []string{"devs"},
+	}
+	key := idp.rsaKey
+	if edit != nil {
+		if k := edit(claims); k != nil {
+			key = k
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(alg, key, claims)})
+}
+
+// sign returns a compact JWS of claims, with RS256 and rsaKey or ES256 and
+// the provider's EC key.
+func (idp *testIdP) sign(alg string, rsaKey *rsa.PrivateKey, claims map[string]any) string {
+	kid := "rsa"
+	if alg == "ES256" {
+		kid = "ec"
+	}
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	if alg == "ES256" {
+		r, s, err := ecdsa.Sign(rand.Reader, idp.ecKey, sum[:])
+		if err != nil {
+			panic(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	} else {
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum[:]); err != nil {
+			panic(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// login runs a full login against idp, with the next token signed with alg
+// and changed by edit.
+func (idp *testIdP) login(t *testing.T, p *OIDCProvider, alg string, edit func(map[string]any) *rsa.PrivateKey) (*OIDCIdentity, error) {
+	t.Helper()
+	idp.mu.Lock()
+	idp.alg, idp.edit = alg, edit
+	idp.mu.Unlock()
+	ctx := context.Background()
+	authURL, state, err := p.AuthCodeURL(ctx, "https://conductor.example.com/auth/oidc/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Exchange(ctx, state, idp.authorize(t, authURL))
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newTestIdP(t)
+	p := NewOIDCProvider(OIDCConfig{Issuer: idp.srv.URL, ClientID: "conductor"})
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		ident, err := idp.login(t, p, alg, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		if ident.Username != "alice@example.com" || ident.Issuer != idp.srv.URL || ident.Subject != "1234" ||
+			len(ident.Groups) != 1 || ident.Groups[0] != "devs" {
+			t.Errorf("%s: identity = %+v", alg, ident)
+		}
+	}
+}
+
+func TestOIDCRejectsTokens(t *testing.T) {
+	idp := newTestIdP(t)
+	p := NewOIDCProvider(OIDCConfig{Issuer: idp.srv.URL, ClientID: "conductor"})
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		alg  string
+		edit func(claims map[string]any) *rsa.PrivateKey
+		want string
+	}{
+		{"nonce", "RS256", func(c map[string]any) *rsa.PrivateKey { c["nonce"] = "replayed"; return nil }, "nonce"},
+		{"no nonce", "ES256", func(c map[string]any) *rsa.PrivateKey { delete(c, "nonce"); return nil }, "nonce"},
+		{"issuer", "RS256", func(c map[string]any) *rsa.PrivateKey { c["iss"] = "https://evil.example.com"; return nil }, "issuer"},
+		{"audience", "ES256", func(c map[string]any) *rsa.PrivateKey { c["aud"] = []string{"other"}; return nil }, "client"},
+		{"authorized party", "RS256", func(c map[string]any) *rsa.PrivateKey { c["azp"] = "other"; return nil }, "client"},
+		{"expired", "RS256", func(c map[string]any) *rsa.PrivateKey {
+			c["exp"] = time.Now().Add(-clockSkew - time.Minute).Unix()
+			return nil
+		}, "expired"},
+		{"no expiry", "ES256", func(c map[string]any) *rsa.PrivateKey { delete(c, "exp"); return nil }, "expired"},
+		{"issued in the future", "RS256", func(c map[string]any) *rsa.PrivateKey {
+			c["iat"] = time.Now().Add(clockSkew + time.Minute).Unix()
+			return nil
+		}, "future"},
+		{"signature", "RS256", func(c map[string]any) *rsa.PrivateKey { return otherKey }, "verification"},
+		{"no subject", "RS256", func(c map[string]any) *rsa.PrivateKey { delete(c, "sub"); return nil }, "subject"},
+		{"unverified email", "ES256", func(c map[string]any) *rsa.PrivateKey { c["email_verified"] = false; return nil }, "not verified"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := idp.login(t, p, tt.alg, tt.edit)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error about %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOIDCRejectsForgedSignatures(t *testing.T) {
+	idp := newTestIdP(t)
+	p := NewOIDCProvider(OIDCConfig{Issuer: idp.srv.URL, ClientID: "conductor"})
+	ctx := context.Background()
+	if _, err := idp.login(t, p, "RS256", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	claims := map[string]any{"iss": idp.srv.URL, "sub": "1234", "aud": "conductor", "exp": time.Now().Add(time.Hour).Unix()}
+	token := idp.sign("ES256", nil, claims)
+	parts := strings.Split(token, ".")
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"unsigned", parts[0] + "." + parts[1] + "."},
+		{"alg none", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "." + parts[2]},
+		{"HS256", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","kid":"rsa"}`)) + "." + parts[1] + "." + parts[2]},
+		{"EC signature for RSA key", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"ec"}`)) + "." + parts[1] + "." + parts[2]},
+		{"tampered claims", parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`)) + "." + parts[2]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := p.verify(ctx, tt.token, ""); err == nil {
+				t.Error("forged token accepted")
+			}
+		})
+	}
+}
+
+func TestOIDCExchangeState(t *testing.T) {
+	idp := newTestIdP(t)
+	p := NewOIDCProvider(OIDCConfig{Issuer: idp.srv.URL, ClientID: "conductor"})
+	ctx := context.Background()
+
+	authURL, state, err := p.AuthCodeURL(ctx, "https://conductor.example.com/auth/oidc/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := idp.authorize(t, authURL)
+	if _, err := p.Exchange(ctx, "unknown", code); !errors.Is(err, ErrOIDCState) {
+		t.Errorf("unknown state: got %v, want ErrOIDCState", err)
+	}
+	if _, err := p.Exchange(ctx, state, code); err != nil {
+		t.Fatal(err)
+	}
+	// A state is good for one login only.
+	if _, err := p.Exchange(ctx, state, code); !errors.Is(err, ErrOIDCState) {
+		t.Errorf("reused state: got %v, want ErrOIDCState", err)
+	}
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OriginPolicy decides which web pages may call the server from a browser:
+// its own pages, plus those of the listed origins, such as other
+// conductors that add this one as a server.
+type OriginPolicy struct {
+	any     bool
+	origins map[string]bool
+}
+
+// NewOriginPolicy allows the listed origins, written as
+// scheme://host[:port]. "*" allows every origin.
+func NewOriginPolicy(origins []string) (*OriginPolicy, error) {
+	p := &OriginPolicy{origins: make(map[string]bool)}
+	for _, o := range origins {
+		if o == "*" {
+			p.any = true
+			continue
+		}
+		norm, ok := normalizeOrigin(o)
+		if !ok {
+			return nil, fmt.Errorf("invalid origin %q; use scheme://host[:port]", o)
+		}
+		p.origins[norm] = true
+	}
+	return p, nil
+}
+
+// Allowed reports whether r may be served. Requests without an Origin
+// header don't come from another page's scripts and are always allowed, as
+// are requests from the server's own pages: those with r's scheme and Host.
+func (p *OriginPolicy) Allowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || p.any {
+		return true
+	}
+	norm, ok := normalizeOrigin(origin)
+	if !ok {
+		return false
+	}
+	if own, ok := normalizeOrigin(RequestScheme(r) + "://" + r.Host); ok && norm == own {
+		return true
+	}
+	return p.origins[norm]
+}
+
+// normalizeOrigin lower-cases origin and drops a default port, the way
+// browsers send it.
+func normalizeOrigin(origin string) (string, bool) {
+	u, err := url.Parse(strings.ToLower(strings.TrimSuffix(origin, "/")))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", false
+	}
+	host := u.Host
+	if u.Scheme == "http" {
+		host = strings.TrimSuffix(host, ":80")
+	} else {
+		host = strings.TrimSuffix(host, ":443")
+	}
+	return u.Scheme + "://" + host, true
+}
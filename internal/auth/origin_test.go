@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginPolicyAllowsOwnOriginOnly(t *testing.T) {
+	p, err := NewOriginPolicy([]string{"https://hub.example.com:8443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		origin, host string
+		tls          bool
+		want         bool
+	}{
+		{"", "conductor.example.com", false, true},
+		{"http://conductor.example.com", "conductor.example.com", false, true},
+		{"https://conductor.example.com", "conductor.example.com", true, true},
+		{"https://conductor.example.com", "conductor.example.com:443", true, true},
+		{"HTTPS://Conductor.Example.com/", "conductor.example.com", true, true},
+		{"http://conductor.example.com", "conductor.example.com", true, false},
+		{"https://conductor.example.com", "conductor.example.com", false, false},
+		{"https://conductor.example.com:8443", "conductor.example.com", true, false},
+		{"https://evil.example.com", "conductor.example.com", true, false},
+		{"https://hub.example.com:8443", "conductor.example.com", true, true},
+		{"null", "conductor.example.com", true, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/sessions", nil)
+		r.Host = tt.host
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if tt.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		if got := p.Allowed(r); got != tt.want {
+			t.Errorf("origin %q on %s (TLS %v): allowed = %v, want %v", tt.origin, tt.host, tt.tls, got, tt.want)
+		}
+	}
+}
+
+func TestOriginPolicyUsesForwardedProto(t *testing.T) {
+	p, err := NewOriginPolicy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := NewTrustedProxies([]string{"10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		peer, proto, origin string
+		want                bool
+	}{
+		{"10.0.0.1", "https", "https://conductor.example.com", true},
+		{"10.0.0.1", "https", "http://conductor.example.com", false},
+		{"10.0.0.1", "", "http://conductor.example.com", true},
+		{"10.0.0.1", "gopher", "http://conductor.example.com", true},
+		// Only a trusted proxy's word is taken.
+		{"192.0.2.7", "https", "https://conductor.example.com", false},
+		{"192.0.2.7", "https", "http://conductor.example.com", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/sessions", nil)
+		r.RemoteAddr = tt.peer + ":40000"
+		r.Host = "conductor.example.com"
+		r.Header.Set("Origin", tt.origin)
+		if tt.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		var got bool
+		ForwardedFor(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = p.Allowed(r)
+		})).ServeHTTP(httptest.NewRecorder(), r)
+		if got != tt.want {
+			t.Errorf("origin %q via %s with X-Forwarded-Proto %q: allowed = %v, want %v", tt.origin, tt.peer, tt.proto, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// ProxyAuthConfig configures signing users in from a header set by an
+// authenticating reverse proxy, such as oauth2-proxy or Tailscale serve.
+type ProxyAuthConfig struct {
+	Header         string   `json:"header"`         // e.g. X-Forwarded-User
+	GroupsHeader   string   `json:"groupsHeader"`   // optional, comma-separated groups
+	TrustedProxies []string `json:"trustedProxies"` // addresses, CIDRs or "unix" for the Unix domain socket
+	RoleMapping
+}
+
+func (c *ProxyAuthConfig) Validate() error {
+	if c.Header == "" {
+		return fmt.Errorf("proxyAuth: header is required")
+	}
+	if len(c.TrustedProxies) == 0 {
+		return fmt.Errorf("proxyAuth: trustedProxies is required")
+	}
+	if _, err := NewTrustedProxies(c.TrustedProxies); err != nil {
+		return fmt.Errorf("proxyAuth: %w", err)
+	}
+	if err := c.RoleMapping.Validate(); err != nil {
+		return fmt.Errorf("proxyAuth: %w", err)
+	}
+	return nil
+}
+
+// ProxyAuth reads the identity a trusted reverse proxy asserts for a
+// request. The headers are ignored on requests from any other address, so
+// clients can't set them themselves.
+type ProxyAuth struct {
+	cfg     ProxyAuthConfig
+	trusted *TrustedProxies
+}
+
+func NewProxyAuth(cfg ProxyAuthConfig) (*ProxyAuth, error) {
+	trusted, err := NewTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyAuth{cfg: cfg, trusted: trusted}, nil
+}
+
+// Identity returns the username and groups the proxy asserts for r, if r
+// came from a trusted proxy and carries the header.
+func (p *ProxyAuth) Identity(r *http.Request) (string, []string, bool) {
+	username := strings.TrimSpace(r.Header.Get(p.cfg.Header))
+	if username == "" || !p.Trusted(r) {
+		return "", nil, false
+	}
+	var groups []string
+	if p.cfg.GroupsHeader != "" {
+		for _, g := range strings.Split(r.Header.Get(p.cfg.GroupsHeader), ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				groups = append(groups, g)
+			}
+		}
+	}
+	return username, groups, true
+}
+
+// Trusted reports whether r was made by a trusted proxy.
+func (p *ProxyAuth) Trusted(r *http.Request) bool {
+	return p.trusted.Contains(peerAddr(r))
+}
+
+// Roles returns how users' groups map to roles.
+func (p *ProxyAuth) Roles() *RoleMapping {
+	return &p.cfg.RoleMapping
+}
+
+// TrustedProxies is a set of reverse proxy addresses: single addresses,
+// CIDRs, and UnixPeer for the Unix domain socket.
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+	unix     bool
+}
+
+func NewTrustedProxies(list []string) (*TrustedProxies, error) {
+	prefixes, err := parsePrefixes(list)
+	if err != nil {
+		return nil, err
+	}
+	return &TrustedProxies{prefixes: prefixes, unix: slices.Contains(list, UnixPeer)}, nil
+}
+
+// Contains reports whether the address ip, or UnixPeer, is a trusted proxy.
+func (t *TrustedProxies) Contains(ip string) bool {
+	if ip == UnixPeer {
+		return t.unix
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range t.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefixes parses CIDRs and single addresses, skipping UnixPeer.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if s == UnixPeer {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", s)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
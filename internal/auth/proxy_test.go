@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// proxyRequest returns a request from peer, which is "unix" for the Unix
+// domain socket, with the given headers.
+func proxyRequest(peer string, headers map[string]string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/api/sessions", nil)
+	if peer == UnixPeer {
+		r.RemoteAddr = "@"
+		r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "/run/adc.sock", Net: "unix"}))
+	} else {
+		r.RemoteAddr = net.JoinHostPort(peer, "40000")
+	}
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+func TestTrustedProxiesContains(t *testing.T) {
+	trusted, err := NewTrustedProxies([]string{"10.0.0.1", "192.168.0.0/16", "fd00::/8", "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"10.0.0.1":         true,
+		"::ffff:10.0.0.1":  true,
+		"10.0.0.2":         false,
+		"192.168.44.3":     true,
+		"fd12::1":          true,
+		"2001:db8::1":      false,
+		UnixPeer:           true,
+		"not-an-address":   false,
+		"192.168.44.3:443": false,
+	} {
+		if got := trusted.Contains(ip); got != want {
+			t.Errorf("Contains(%q) = %v, want %v", ip, got, want)
+		}
+	}
+	if tcpOnly, _ := NewTrustedProxies([]string{"10.0.0.1"}); tcpOnly.Contains(UnixPeer) {
+		t.Error("Unix socket trusted without \"unix\" in the list")
+	}
+	for _, bad := range []string{"10.0.0", "10.0.0.0/33", "proxy.example.com"} {
+		if _, err := NewTrustedProxies([]string{bad}); err == nil {
+			t.Errorf("NewTrustedProxies(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestProxyAuthIdentity(t *testing.T) {
+	p, err := NewProxyAuth(ProxyAuthConfig{
+		Header:         "X-Forwarded-User",
+		GroupsHeader:   "X-Forwarded-Groups",
+		TrustedProxies: []string{"10.0.0.1", "unix"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := map[string]string{"X-Forwarded-User": " alice ", "X-Forwarded-Groups": "devs, ops,,"}
+
+	for _, peer := range []string{"10.0.0.1", UnixPeer} {
+		username, groups, ok := p.Identity(proxyRequest(peer, headers))
+		if !ok || username != "alice" || len(groups) != 2 || groups[0] != "devs" || groups[1] != "ops" {
+			t.Errorf("from %s: %q, %q, %v", peer, username, groups, ok)
+		}
+	}
+	if _, _, ok := p.Identity(proxyRequest("192.0.2.7", headers)); ok {
+		t.Error("headers from an untrusted address accepted")
+	}
+	if _, _, ok := p.Identity(proxyRequest("10.0.0.1", map[string]string{"X-Forwarded-User": " "})); ok {
+		t.Error("blank user accepted")
+	}
+}
+
+func TestProxyAuthConfigValidate(t *testing.T) {
+	good := ProxyAuthConfig{Header: "X-Forwarded-User", TrustedProxies: []string{"127.0.0.1"}}
+	if err := good.Validate(); err != nil {
+		t.Errorf("valid config: %v", err)
+	}
+	for _, c := range []ProxyAuthConfig{
+		{TrustedProxies: []string{"127.0.0.1"}},
+		{Header: "X-Forwarded-User"},
+		{Header: "X-Forwarded-User", TrustedProxies: []string{"localhost"}},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", c)
+		}
+	}
+}
+
+func TestProxyAuthSignsInOnlyFromTrustedProxies(t *testing.T) {
+	a := newAuthenticator(t)
+	proxy, err := NewProxyAuth(ProxyAuthConfig{
+		Header:         "X-Forwarded-User",
+		GroupsHeader:   "X-Forwarded-Groups",
+		TrustedProxies: []string{"10.0.0.1"},
+		RoleMapping:    RoleMapping{Roles: map[Role][]string{RoleOperator: {"devs"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Proxy = proxy
+	if _, err := a.Users.Create("olivia", "secret", RoleOperator, nil); err != nil {
+		t.Fatal(err)
+	}
+	token, err := GenerateSessionToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Sessions.Add(token, LoginSession{Username: "olivia"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// A trusted proxy's user is provisioned from their groups.
+	p, ok := a.AuthenticateRequest(proxyRequest("10.0.0.1", map[string]string{"X-Forwarded-User": "alice", "X-Forwarded-Groups": "devs"}))
+	if !ok || p.Username != "alice" || p.Role != RoleOperator {
+		t.Fatalf("proxy sign-in: %+v, %v", p, ok)
+	}
+	// Anyone else setting the header gets nothing from it.
+	r := proxyRequest("192.0.2.7", map[string]string{"X-Forwarded-User": "alice", "X-Session-Token": token})
+	if p, ok := a.AuthenticateRequest(r); !ok || p.Username != "olivia" {
+		t.Errorf("untrusted header: %+v, %v; want olivia's login", p, ok)
+	}
+	// A proxy that names a user who may not sign in isn't overridden by a
+	// token riding along.
+	r = proxyRequest("10.0.0.1", map[string]string{"X-Forwarded-User": "mallory", "X-Forwarded-Groups": "sales", "X-Session-Token": token})
+	if p, ok := a.AuthenticateRequest(r); ok {
+		t.Errorf("refused proxy user fell back to a token: %+v", p)
+	}
+}
+
+func TestForwardedForSkipsTrustedHops(t *testing.T) {
+	trusted, err := NewTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		peer, xff, want string
+	}{
+		{"10.0.0.1", "203.0.113.9", "203.0.113.9"},
+		{"10.0.0.1", "203.0.113.9, 10.0.0.2", "203.0.113.9"},
+		// The client can write anything before the first trusted hop.
+		{"10.0.0.1", "198.51.100.1, 203.0.113.9", "203.0.113.9"},
+		{"10.0.0.1", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"10.0.0.1", "::ffff:203.0.113.9", "203.0.113.9"},
+		{"10.0.0.1", "junk, 203.0.113.9", "203.0.113.9"},
+		{"10.0.0.1", "203.0.113.9, junk", "10.0.0.1"},
+		{"10.0.0.1", "", "10.0.0.1"},
+		{"192.0.2.7", "203.0.113.9", "192.0.2.7"},
+	}
+	for _, tt := range tests {
+		r := proxyRequest(tt.peer, map[string]string{"X-Forwarded-For": tt.xff})
+		var got string
+		ForwardedFor(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = ClientIP(r)
+		})).ServeHTTP(httptest.NewRecorder(), r)
+		if got != tt.want {
+			t.Errorf("X-Forwarded-For %q via %s: ClientIP = %q, want %q", tt.xff, tt.peer, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package auth
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Failed logins before backoff starts, the longest backoff, and the longest
+// an attempt is held back when the overall limit is used up.
+const (
+	freeFailures   = 2
+	maxBackoff     = time.Minute
+	maxGlobalDelay = 5 * time.Second
+)
+
+// LoginLimits configures a LoginLimiter. Zero rates disable the limit, and
+// zero LockoutFailures disables lockouts.
+type LoginLimits struct {
+	PerIP           int // login attempts per minute from one address
+	Global          int // login attempts per minute overall
+	LockoutFailures int // consecutive failures that lock an address out
+	Lockout         time.Duration
+}
+
+// LoginLimiter throttles password logins. Attempts are rate limited per
+// client address, with IPv6 addresses counted by their /64, and slowed
+// down, never refused, past the overall rate. Consecutive failures from an
+// address, and for a username from an address, back off exponentially, and
+// too many from one address lock it out for a while. Failures only ever
+// slow down the address they came from, so guessing a user's password
+// elsewhere doesn't keep the user out.
+type LoginLimiter struct {
+	mu      sync.Mutex
+	limits  LoginLimits
+	global  bucket
+	buckets map[string]*bucket      // attempts per addrNet
+	clients map[string]*loginClient // failures by "ip:<net>" or "user:<net> <name>"
+}
+
+type loginClient struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+func NewLoginLimiter(limits LoginLimits) *LoginLimiter {
+	l := &LoginLimiter{
+		limits:  limits,
+		buckets: make(map[string]*bucket),
+		clients: make(map[string]*loginClient),
+	}
+	go l.cleanup()
+	return l
+}
+
+func addrKey(ip string) string           { return "ip:" + addrNet(ip) }
+func userKey(ip, username string) string { return "user:" + addrNet(ip) + " " + username }
+
+// addrNet returns what ip is limited as: an IPv4 address by itself, and an
+// IPv6 address by its /64, which a single client usually has all of.
+func addrNet(ip string) string {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	a = a.Unmap().WithZone("")
+	if a.Is4() {
+		return a.String()
+	}
+	p, _ := a.Prefix(64)
+	return p.String()
+}
+
+// Allow reports whether ip may try to log in as username now, and if not,
+// how long it should wait. An allowed attempt counts against the rate
+// limits. Past the overall limit, Allow holds the attempt back for up to
+// maxGlobalDelay before allowing it, or refuses it if ctx is done first.
+func (l *LoginLimiter) Allow(ctx context.Context, ip, username string) (time.Duration, bool) {
+	delay, ok := l.allow(time.Now(), ip, username)
+	if !ok || delay == 0 {
+		return delay, ok
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return 0, true
+	case <-ctx.Done():
+		return 0, false
+	}
+}
+
+// allow is Allow without the wait: if ok, delay is how long to hold the
+// attempt back.
+func (l *LoginLimiter) allow(now time.Time, ip, username string) (delay time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	addr := l.lookup(addrKey(ip), now)
+	user := l.lookup(userKey(ip, username), now)
+	if wait := addr.lockedUntil.Sub(now); wait > 0 {
+		return wait, false
+	}
+	wait := max(addr.backoffUntil().Sub(now), user.backoffUntil().Sub(now))
+	if wait > 0 {
+		return wait, false
+	}
+	if l.limits.PerIP > 0 {
+		key := addrNet(ip)
+		b, ok := l.buckets[key]
+		if !ok {
+			b = &bucket{}
+			l.buckets[key] = b
+		}
+		if wait, ok := b.take(now, l.limits.PerIP); !ok {
+			return wait, false
+		}
+	}
+	if l.limits.Global > 0 {
+		return l.global.reserve(now, l.limits.Global, maxGlobalDelay), true
+	}
+	return 0, true
+}
+
+// Failure records a failed login and reports whether it locked ip out.
+func (l *LoginLimiter) Failure(ip, username string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	user := l.client(userKey(ip, username), now)
+	user.failures++
+	user.lastFailure = now
+
+	addr := l.client(addrKey(ip), now)
+	addr.failures++
+	addr.lastFailure = now
+	if l.limits.LockoutFailures > 0 && addr.failures >= l.limits.LockoutFailures {
+		addr.lockedUntil = now.Add(l.limits.Lockout)
+		addr.failures = 0
+		return true
+	}
+	return false
+}
+
+// Success clears the failures of ip and username.
+func (l *LoginLimiter) Success(ip, username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c, ok := l.clients[addrKey(ip)]; ok {
+		c.failures = 0
+	}
+	delete(l.clients, userKey(ip, username))
+}
+
+// client returns the state for key, creating it if need be. Called with
+// l.mu held.
+func (l *LoginLimiter) client(key string, now time.Time) *loginClient {
+	c, ok := l.clients[key]
+	if !ok {
+		c = &loginClient{}
+		l.clients[key] = c
+	}
+	l.expire(c, now)
+	return c
+}
+
+// lookup returns the state for key, or a blank one if there is none.
+// Called with l.mu held.
+func (l *LoginLimiter) lookup(key string, now time.Time) loginClient {
+	c, ok := l.clients[key]
+	if !ok {
+		return loginClient{}
+	}
+	l.expire(c, now)
+	return *c
+}
+
+// expire forgets failures older than the lockout period.
+func (l *LoginLimiter) expire(c *loginClient, now time.Time) {
+	if c.failures > 0 && now.Sub(c.lastFailure) > l.forget() {
+		c.failures = 0
+	}
+}
+
+// forget is how long failures are remembered.
+func (l *LoginLimiter) forget() time.Duration {
+	return max(l.limits.Lockout, 15*time.Minute)
+}
+
+// backoffUntil is when the next attempt may be made after c's failures.
+func (c *loginClient) backoffUntil() time.Time {
+	if c.failures <= freeFailures {
+		return time.Time{}
+	}
+	d := maxBackoff
+	if n := c.failures - freeFailures - 1; n < 6 {
+		d = min(time.Second<<n, maxBackoff)
+	}
+	return c.lastFailure.Add(d)
+}
+
+func (l *LoginLimiter) cleanup() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		l.mu.Lock()
+		now := time.Now()
+		for key, c := range l.clients {
+			if now.After(c.lockedUntil) && now.Sub(c.lastFailure) > l.forget() {
+				delete(l.clients, key)
+			}
+		}
+		for key, b := range l.buckets {
+			// A bucket left alone for a minute is full again.
+			if now.Sub(b.last) > time.Minute {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// bucket is a token bucket refilled at perMinute tokens a minute, holding
+// at most perMinute tokens.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token if there is one, or returns how long until there is.
+func (b *bucket) take(now time.Time, perMinute int) (time.Duration, bool) {
+	limit := b.refill(now, perMinute)
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / limit * float64(time.Minute)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// reserve removes a token, borrowing it if there is none, and returns how
+// long until the borrowed token would have been there, at most maxDelay.
+// Borrowing stops at maxDelay's worth of tokens, so the bucket refills as
+// soon after a burst as it would have without one.
+func (b *bucket) reserve(now time.Time, perMinute int, maxDelay time.Duration) time.Duration {
+	limit := b.refill(now, perMinute)
+	b.tokens = max(b.tokens-1, -maxDelay.Minutes()*limit)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / limit * float64(time.Minute))
+}
+
+// refill adds the tokens accrued since the bucket was last used and returns
+// perMinute as a float.
+func (b *bucket) refill(now time.Time, perMinute int) float64 {
+	limit := float64(perMinute)
+	if b.last.IsZero() {
+		b.tokens = limit
+	} else {
+		b.tokens = min(limit, b.tokens+now.Sub(b.last).Minutes()*limit)
+	}
+	b.last = now
+	return limit
+}
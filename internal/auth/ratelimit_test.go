@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAddrNet(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"203.0.113.9", "203.0.113.9"},
+		{"::ffff:203.0.113.9", "203.0.113.9"},
+		{"2001:db8:1:2:aaaa::1", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2:bbbb::2", "2001:db8:1:2::/64"},
+		{"fe80::1%eth0", "fe80::/64"},
+		{"unix", "unix"},
+	}
+	for _, tt := range tests {
+		if got := addrNet(tt.in); got != tt.want {
+			t.Errorf("addrNet(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLoginLimiterCountsIPv6By64(t *testing.T) {
+	l := NewLoginLimiter(LoginLimits{PerIP: 3, LockoutFailures: 4, Lockout: time.Hour})
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, ok := l.allow(now, fmt.Sprintf("2001:db8::%x", i+1), "admin"); !ok {
+			t.Fatalf("attempt %d refused", i)
+		}
+	}
+	if _, ok := l.allow(now, "2001:db8::ffff", "admin"); ok {
+		t.Error("fresh address in the same /64 got a fresh bucket")
+	}
+	if _, ok := l.allow(now, "2001:db8:0:1::1", "admin"); !ok {
+		t.Error("address in another /64 refused")
+	}
+
+	for i := 0; i < 4; i++ {
+		l.Failure(fmt.Sprintf("2001:db8:0:2::%x", i+1), fmt.Sprintf("user%d", i))
+	}
+	if wait, ok := l.allow(now, "2001:db8:0:2::ffff", "other"); ok || wait < 50*time.Minute {
+		t.Errorf("/64 not locked out: %v, %v", wait, ok)
+	}
+}
+
+func TestLoginLimiterGlobalLimitOnlyDelays(t *testing.T) {
+	l := NewLoginLimiter(LoginLimits{Global: 60})
+	now := time.Now()
+	for i := 0; i < 60; i++ {
+		if delay, ok := l.allow(now, fmt.Sprintf("192.0.2.%d", i), "admin"); !ok || delay != 0 {
+			t.Fatalf("attempt %d: %v, %v", i, delay, ok)
+		}
+	}
+	// With the minute's attempts used up, each further one waits a second
+	// longer, up to maxGlobalDelay, but none is refused.
+	for i := 1; i < 10; i++ {
+		delay, ok := l.allow(now, "198.51.100.1", "admin")
+		want := min(time.Duration(i)*time.Second, maxGlobalDelay)
+		if !ok || delay.Round(time.Millisecond) != want {
+			t.Errorf("attempt %d over the limit: %v, %v; want %v", i, delay, ok, want)
+		}
+	}
+	// Once the flood stops, the bucket refills as if it had been capped.
+	if delay, _ := l.allow(now.Add(6*time.Second), "198.51.100.1", "admin"); delay != 0 {
+		t.Errorf("delay after the flood = %v", delay)
+	}
+}
+
+func TestLoginLimiterAllowGivesUpWithContext(t *testing.T) {
+	l := NewLoginLimiter(LoginLimits{Global: 1})
+	if _, ok := l.Allow(context.Background(), "192.0.2.1", "admin"); !ok {
+		t.Fatal("first attempt refused")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, ok := l.Allow(ctx, "192.0.2.2", "admin"); ok {
+		t.Error("held-back attempt allowed after its request ended")
+	}
+}
+
+func TestLoginLimiterBacksOffAndLocksOut(t *testing.T) {
+	l := NewLoginLimiter(LoginLimits{LockoutFailures: 5, Lockout: time.Hour})
+	ip := "203.0.113.9"
+	for i := 0; i < 3; i++ {
+		l.Failure(ip, "admin")
+	}
+	if wait, ok := l.allow(time.Now(), ip, "admin"); ok || wait <= 0 || wait > time.Second {
+		t.Errorf("after 3 failures: %v, %v; want a 1s backoff", wait, ok)
+	}
+	if _, ok := l.allow(time.Now(), "198.51.100.1", "admin"); !ok {
+		t.Error("another address is slowed down by the failures")
+	}
+	l.Failure(ip, "admin")
+	if !l.Failure(ip, "admin") {
+		t.Error("fifth failure didn't lock the address out")
+	}
+	l.Success(ip, "admin")
+	if wait, ok := l.allow(time.Now(), ip, "admin"); ok || wait < 50*time.Minute {
+		t.Errorf("lockout lifted by a success: %v, %v", wait, ok)
+	}
+}
@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrLoginNotFound = errors.New("login session not found")
+
+// LoginSession is a token issued when a user signs in.
+type LoginSession struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	Method     string    `json:"method,omitempty"` // "password" or "oidc"
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	Enrolling  bool      `json:"enrolling,omitempty"` // may only enroll in two-factor authentication
+	TokenHash  string    `json:"tokenHash,omitempty"` // empty outside the store
+}
+
+// public returns a copy of ls without its token hash.
+func (ls *LoginSession) public() *LoginSession {
+	c := *ls
+	c.TokenHash = ""
+	return &c
+}
+
+// SessionStore holds the tokens issued at login until they expire. Tokens
+// are indexed by hash; with a path, the store is kept in a JSON file so
+// logins survive restarts.
+type SessionStore struct {
+	mu       sync.RWMutex
+	path     string
+	sessions map[string]*LoginSession // token hash -> session
+}
+
+// NewSessionStore returns a store that only lives in memory.
+func NewSessionStore() *SessionStore {
+	s := &SessionStore{
+		sessions: make(map[string]*LoginSession),
+	}
+	go s.cleanup()
+	return s
+}
+
+// OpenSessionStore returns a store persisted to the file at path, loading
+// the unexpired sessions already in it.
+func OpenSessionStore(path string) (*SessionStore, error) {
+	s := &SessionStore{path: path, sessions: make(map[string]*LoginSession)}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	go s.cleanup()
+	return s, nil
+}
+
+// Reload reads the store's file again, for a server taking over from one
+// that may have changed it. Stores that only live in memory are left as
+// they are.
+func (s *SessionStore) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*LoginSession
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	sessions := make(map[string]*LoginSession, len(list))
+	now := time.Now()
+	for _, ls := range list {
+		if now.Before(ls.ExpiresAt) {
+			sessions[ls.TokenHash] = ls
+		}
+	}
+	s.mu.Lock()
+	s.sessions = sessions
+	s.mu.Unlock()
+	return nil
+}
+
+// Add records login, valid for duration, under token. The ID, times and
+// hash are filled in.
+func (s *SessionStore) Add(token string, login LoginSession, duration time.Duration) error {
+	id, err := GenerateSessionToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	ls := &login
+	ls.ID = id[:12]
+	ls.CreatedAt = now
+	ls.ExpiresAt = now.Add(duration)
+	ls.TokenHash = hashToken(token)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[ls.TokenHash] = ls
+	if err := s.save(); err != nil {
+		delete(s.sessions, ls.TokenHash)
+		return err
+	}
+	return nil
+}
+
+// Validate returns the login token belongs to, if it is still valid.
+func (s *SessionStore) Validate(token string) (*LoginSession, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ls, ok := s.sessions[hashToken(token)]
+	if !ok || !time.Now().Before(ls.ExpiresAt) {
+		return nil, false
+	}
+	return ls.public(), true
+}
+
+// List returns the unexpired sessions, newest first.
+func (s *SessionStore) List() []*LoginSession {
+	now := time.Now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]*LoginSession, 0, len(s.sessions))
+	for _, ls := range s.sessions {
+		if now.Before(ls.ExpiresAt) {
+			list = append(list, ls.public())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Remove revokes token.
+func (s *SessionStore) Remove(token string) {
+	h := hashToken(token)
+	s.removeIf(func(hash string, _ *LoginSession) bool { return hash == h })
+}
+
+// RemoveID revokes the session with the given ID.
+func (s *SessionStore) RemoveID(id string) error {
+	if !s.removeIf(func(_ string, ls *LoginSession) bool { return ls.ID == id }) {
+		return ErrLoginNotFound
+	}
+	return nil
+}
+
+// RemoveUser revokes every token issued to username.
+func (s *SessionStore) RemoveUser(username string) {
+	s.removeIf(func(_ string, ls *LoginSession) bool { return ls.Username == username })
+}
+
+// RemoveUserExcept revokes every token issued to username but keep.
+func (s *SessionStore) RemoveUserExcept(username, keep string) {
+	h := hashToken(keep)
+	s.removeIf(func(hash string, ls *LoginSession) bool { return ls.Username == username && hash != h })
+}
+
+// removeIf deletes the sessions matching fn and reports whether there were
+// any.
+func (s *SessionStore) removeIf(fn func(hash string, ls *LoginSession) bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := false
+	for h, ls := range s.sessions {
+		if fn(h, ls) {
+			delete(s.sessions, h)
+			removed = true
+		}
+	}
+	if removed {
+		s.save()
+	}
+	return removed
+}
+
+func (s *SessionStore) cleanup() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		s.removeIf(func(_ string, ls *LoginSession) bool { return now.After(ls.ExpiresAt) })
+	}
+}
+
+// save writes the session file atomically, if the store has one. Called
+// with s.mu held.
+func (s *SessionStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	list := make([]*LoginSession, 0, len(s.sessions))
+	for _, ls := range s.sessions {
+		list = append(list, ls)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return writeFile(s.path, list)
+}
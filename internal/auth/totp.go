@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters (RFC 6238 defaults, which every authenticator app
+// supports).
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1 // steps accepted either side of the current one
+
+	recoveryCodeCount = 10
+)
+
+// TOTPIssuer names the server in authenticator apps.
+const TOTPIssuer = "AI Dev Conductor"
+
+var (
+	ErrTOTPEnabled    = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotEnabled = errors.New("two-factor authentication is not enabled")
+	ErrTOTPNotStarted = errors.New("two-factor enrollment has not been started")
+	ErrInvalidCode    = errors.New("invalid code")
+)
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPURI returns the otpauth:// URI that authenticator apps import, usually
+// from a QR code.
+func TOTPURI(account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", TOTPIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(TOTPIssuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// totpCode returns the code for secret at time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[off:]) & 0x7fffffff
+	mod := uint32(1)
+	for range totpDigits {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, n%mod)
+}
+
+// matchTOTP returns the time step code is valid for, if any step within the
+// allowed skew of now and after last matches.
+func matchTOTP(secret, code string, now time.Time, last int64) (int64, bool) {
+	key, err := base32NoPad.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	cur := now.Unix() / totpPeriod
+	for step := cur - totpSkew; step <= cur+totpSkew; step++ {
+		if step > last && hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// normalizeCode strips the spaces and dashes people type in codes.
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// newRecoveryCodes returns fresh recovery codes and their hashes.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		c := strings.ToLower(base32NoPad.EncodeToString(b))
+		codes[i] = c[:4] + "-" + c[4:]
+		hashes[i] = hashToken(normalizeCode(c))
+	}
+	return codes, hashes, nil
+}
+
+// BeginTOTP starts enrolling username in two-factor authentication and
+// returns the new secret. It takes effect once confirmed with ConfirmTOTP.
+func (s *UserStore) BeginTOTP(username string) (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := base32NoPad.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return "", ErrUserNotFound
+	}
+	if u.TOTPSecret != "" {
+		return "", ErrTOTPEnabled
+	}
+	old := *u
+	u.TOTPPending = secret
+	if err := s.save(); err != nil {
+		*u = old
+		return "", err
+	}
+	return secret, nil
+}
+
+// ConfirmTOTP enables the secret from BeginTOTP if code matches it, and
+// returns the user's recovery codes.
+func (s *UserStore) ConfirmTOTP(username, code string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	if u.TOTPSecret != "" {
+		return nil, ErrTOTPEnabled
+	}
+	if u.TOTPPending == "" {
+		return nil, ErrTOTPNotStarted
+	}
+	step, ok := matchTOTP(u.TOTPPending, normalizeCode(code), time.Now(), 0)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+	old := *u
+	u.TOTPSecret = u.TOTPPending
+	u.TOTPPending = ""
+	u.TOTPLastStep = step
+	u.RecoveryCodes = hashes
+	if err := s.save(); err != nil {
+		*u = old
+		return nil, err
+	}
+	return codes, nil
+}
+
+// VerifyTOTP checks code against username's authenticator or, failing
+// that, their unused recovery codes. Each code works only once.
+func (s *UserStore) VerifyTOTP(username, code string) error {
+	code = normalizeCode(code)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if u.TOTPSecret == "" {
+		return ErrTOTPNotEnabled
+	}
+	old := *u
+	if step, ok := matchTOTP(u.TOTPSecret, code, time.Now(), u.TOTPLastStep); ok {
+		u.TOTPLastStep = step
+	} else {
+		h := hashToken(code)
+		i := 0
+		for i < len(u.RecoveryCodes) && !hmac.Equal([]byte(u.RecoveryCodes[i]), []byte(h)) {
+			i++
+		}
+		if i == len(u.RecoveryCodes) {
+			return ErrInvalidCode
+		}
+		u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+	}
+	if err := s.save(); err != nil {
+		*u = old
+		return err
+	}
+	return nil
+}
+
+// NewRecoveryCodes replaces username's recovery codes.
+func (s *UserStore) NewRecoveryCodes(username string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	if u.TOTPSecret == "" {
+		return nil, ErrTOTPNotEnabled
+	}
+	old := *u
+	u.RecoveryCodes = hashes
+	if err := s.save(); err != nil {
+		*u = old
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns off two-factor authentication for username.
+func (s *UserStore) DisableTOTP(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	old := *u
+	u.TOTPSecret, u.TOTPPending, u.TOTPLastStep, u.RecoveryCodes = "", "", 0, nil
+	if err := s.save(); err != nil {
+		*u = old
+		return err
+	}
+	return nil
+}
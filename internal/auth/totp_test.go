@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors of RFC 6238 appendix B. They are 8 digits long;
+// a 6-digit code is the same value modulo 10^6.
+func TestTOTPCodeRFC6238(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		want := tt.code[len(tt.code)-totpDigits:]
+		if got := totpCode(secret, tt.unix/totpPeriod); got != want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	key := []byte("12345678901234567890")
+	secret := base32NoPad.EncodeToString(key)
+	now := time.Unix(1111111111, 0)
+	cur := now.Unix() / totpPeriod
+
+	for _, d := range []int64{-totpSkew, 0, totpSkew} {
+		step, ok := matchTOTP(secret, totpCode(key, cur+d), now, 0)
+		if !ok || step != cur+d {
+			t.Errorf("code for step %+d: got step %d, %v", d, step, ok)
+		}
+	}
+	if _, ok := matchTOTP(secret, totpCode(key, cur+totpSkew+1), now, 0); ok {
+		t.Error("code outside the allowed skew accepted")
+	}
+	if _, ok := matchTOTP(secret, totpCode(key, cur), now, cur); ok {
+		t.Error("code for an already used step accepted")
+	}
+	if _, ok := matchTOTP(secret, "12345", now, 0); ok {
+		t.Error("short code accepted")
+	}
+}
+
+// enrolledUser returns a store with a user enrolled in two-factor
+// authentication, and the secret and recovery codes.
+func enrolledUser(t *testing.T) (*UserStore, []byte, []string) {
+	t.Helper()
+	s, err := OpenUserStore(filepath.Join(t.TempDir(), "users.json"), "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := s.BeginTOTP(BootstrapUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := base32NoPad.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enroll with the previous step's code, leaving the current one unused.
+	codes, err := s.ConfirmTOTP(BootstrapUser, totpCode(key, time.Now().Unix()/totpPeriod-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, key, codes
+}
+
+func TestVerifyTOTPReplay(t *testing.T) {
+	s, key, _ := enrolledUser(t)
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+	if err := s.VerifyTOTP(BootstrapUser, code); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := s.VerifyTOTP(BootstrapUser, code); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("replayed code: got %v, want ErrInvalidCode", err)
+	}
+	// Neither is an earlier code still in the skew window.
+	prev := totpCode(key, time.Now().Unix()/totpPeriod-1)
+	if err := s.VerifyTOTP(BootstrapUser, prev); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("earlier code: got %v, want ErrInvalidCode", err)
+	}
+}
+
+func TestVerifyTOTPRecoveryCodes(t *testing.T) {
+	s, _, codes := enrolledUser(t)
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+	if err := s.VerifyTOTP(BootstrapUser, codes[3]); err != nil {
+		t.Fatalf("recovery code: %v", err)
+	}
+	if err := s.VerifyTOTP(BootstrapUser, codes[3]); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("reused recovery code: got %v, want ErrInvalidCode", err)
+	}
+	// Codes are accepted however they are typed.
+	if err := s.VerifyTOTP(BootstrapUser, " "+strings.ToUpper(codes[4])+" "); err != nil {
+		t.Errorf("recovery code typed differently: %v", err)
+	}
+
+	// The remaining codes survive a reload of the store.
+	s2, err := OpenUserStore(s.path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.VerifyTOTP(BootstrapUser, codes[4]); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("used code after reload: got %v, want ErrInvalidCode", err)
+	}
+	if err := s2.VerifyTOTP(BootstrapUser, codes[5]); err != nil {
+		t.Errorf("unused code after reload: %v", err)
+	}
+}
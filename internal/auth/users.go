@@ -0,0 +1,424 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/runas"
+)
+
+// Role determines what a user may do with sessions.
+type Role string
+
+const (
+	// RoleAdmin can see, control and delete every session and manage users.
+	RoleAdmin Role = "admin"
+	// RoleOperator can create sessions and see, control and delete their own.
+	RoleOperator Role = "operator"
+	// RoleViewer can watch every session but not type into or change any.
+	RoleViewer Role = "viewer"
+)
+
+func (r Role) Valid() bool {
+	return r == RoleAdmin || r == RoleOperator || r == RoleViewer
+}
+
+// RoleMapping assigns roles to users signed in by an external identity
+// provider, from the groups it reports.
+type RoleMapping struct {
+	// Roles lists the groups granting each role; the highest one a user is
+	// in wins. Users in none of them get DefaultRole, or, if it's empty,
+	// may not sign in. With neither set, roles are left to admins, and
+	// only accounts that already exist may sign in.
+	Roles       map[Role][]string `json:"roles"`
+	DefaultRole Role              `json:"defaultRole"`
+}
+
+func (m *RoleMapping) Validate() error {
+	for role := range m.Roles {
+		if !role.Valid() {
+			return fmt.Errorf("invalid role %q", role)
+		}
+	}
+	if m.DefaultRole != "" && !m.DefaultRole.Valid() {
+		return fmt.Errorf("invalid defaultRole %q", m.DefaultRole)
+	}
+	return nil
+}
+
+// Role returns the role groups grant, or DefaultRole.
+func (m *RoleMapping) Role(groups []string) Role {
+	for _, role := range []Role{RoleAdmin, RoleOperator, RoleViewer} {
+		for _, g := range m.Roles[role] {
+			if slices.Contains(groups, g) {
+				return role
+			}
+		}
+	}
+	return m.DefaultRole
+}
+
+// assigns reports whether m decides users' roles, rather than admins.
+func (m *RoleMapping) assigns() bool {
+	return len(m.Roles) > 0 || m.DefaultRole != ""
+}
+
+// BootstrapUser is the admin account created when the user store is empty.
+const BootstrapUser = "admin"
+
+var (
+	ErrUserNotFound  = errors.New("user not found")
+	ErrUserExists    = errors.New("user already exists")
+	ErrLastAdmin     = errors.New("cannot remove the last admin")
+	ErrNotLinked     = errors.New("account is not linked to this sign-in method")
+	ErrOtherIdentity = errors.New("account is linked to a different identity")
+	ErrNoRole        = errors.New("groups grant no role")
+)
+
+// Sources of accounts signed in by an external identity provider.
+const (
+	SourceOIDC  = "oidc"
+	SourceProxy = "proxy"
+)
+
+// ExternalID is a user as identified by a single sign-on provider.
+type ExternalID struct {
+	Source  string // SourceOIDC or SourceProxy
+	Issuer  string // for OIDC, the provider
+	Subject string // for OIDC, the provider's ID for the user
+}
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._@+-]{0,127}$`)
+
+// User is an account stored in the user file.
+type User struct {
+	Username     string         `json:"username"`
+	PasswordHash string         `json:"passwordHash"`
+	Role         Role           `json:"role"`
+	RunAs        *runas.Account `json:"runAs,omitempty"`  // account this user's sessions run as
+	Source       string         `json:"source,omitempty"` // sign-in method that may sign in as the user without a password
+	Issuer       string         `json:"issuer,omitempty"` // OIDC issuer and subject the account belongs to
+	Subject      string         `json:"subject,omitempty"`
+	CreatedAt    time.Time      `json:"createdAt"`
+
+	// Two-factor authentication. TOTPPending holds a secret being enrolled;
+	// RecoveryCodes holds hashes of the unused recovery codes.
+	TOTPSecret    string   `json:"totpSecret,omitempty"`
+	TOTPPending   string   `json:"totpPending,omitempty"`
+	TOTPLastStep  int64    `json:"totpLastStep,omitempty"`
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+}
+
+// UserInfo is a User without its password hash, as returned by the API.
+type UserInfo struct {
+	Username  string         `json:"username"`
+	Role      Role           `json:"role"`
+	RunAs     *runas.Account `json:"runAs,omitempty"`
+	TOTP      bool           `json:"totp"`
+	Source    string         `json:"source,omitempty"`
+	CreatedAt time.Time      `json:"createdAt"`
+}
+
+func (u *User) Info() UserInfo {
+	return UserInfo{Username: u.Username, Role: u.Role, RunAs: u.RunAs, TOTP: u.TOTPSecret != "", Source: u.Source, CreatedAt: u.CreatedAt}
+}
+
+// UserUpdate holds the fields of a user to change; nil fields are kept.
+type UserUpdate struct {
+	Password *string
+	Role     *Role
+	RunAs    **runas.Account
+	Source   *string // links the account to a sign-in method, or unlinks it with ""
+}
+
+// UserStore keeps user accounts in a JSON file, rewritten on every change.
+type UserStore struct {
+	mu    sync.RWMutex
+	path  string
+	users map[string]*User
+	dummy []byte // compared against for unknown users to keep timing uniform
+}
+
+// OpenUserStore loads the user file at path. If it doesn't exist, it is
+// created with a single admin account with bootstrapPassword.
+func OpenUserStore(path, bootstrapPassword string) (*UserStore, error) {
+	s := &UserStore{path: path, users: make(map[string]*User)}
+	dummy, err := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	s.dummy = dummy
+
+	err = s.load()
+	if os.IsNotExist(err) {
+		if _, err := s.Create(BootstrapUser, bootstrapPassword, RoleAdmin, nil); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the user file again, for a server taking over from one
+// that may have changed it.
+func (s *UserStore) Reload() error {
+	return s.load()
+}
+
+func (s *UserStore) load() error {
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var list []*User
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	users := make(map[string]*User, len(list))
+	for _, u := range list {
+		if !u.Role.Valid() {
+			return fmt.Errorf("%s: user %q has invalid role %q", s.path, u.Username, u.Role)
+		}
+		users[u.Username] = u
+	}
+	s.mu.Lock()
+	s.users = users
+	s.mu.Unlock()
+	return nil
+}
+
+// Authenticate returns a copy of the user if password matches.
+func (s *UserStore) Authenticate(username, password string) (*User, bool) {
+	s.mu.RLock()
+	u, ok := s.users[username]
+	s.mu.RUnlock()
+	if !ok {
+		bcrypt.CompareHashAndPassword(s.dummy, []byte(password))
+		return nil, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return nil, false
+	}
+	return s.Get(username)
+}
+
+// Get returns a copy of the named user.
+func (s *UserStore) Get(username string) (*User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[username]
+	if !ok {
+		return nil, false
+	}
+	c := *u
+	return &c, true
+}
+
+// List returns all users sorted by name.
+func (s *UserStore) List() []UserInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]UserInfo, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u.Info())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list
+}
+
+func (s *UserStore) Create(username, password string, role Role, runAs *runas.Account) (*User, error) {
+	if !usernamePattern.MatchString(username) {
+		return nil, fmt.Errorf("invalid username %q", username)
+	}
+	if password == "" {
+		return nil, fmt.Errorf("password must not be empty")
+	}
+	if !role.Valid() {
+		return nil, fmt.Errorf("invalid role %q", role)
+	}
+	if runAs != nil && runAs.User == "" {
+		return nil, fmt.Errorf("runAs needs a user")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[username]; ok {
+		return nil, ErrUserExists
+	}
+	u := &User{
+		Username:     username,
+		PasswordHash: string(hash),
+		Role:         role,
+		RunAs:        runAs,
+		CreatedAt:    time.Now(),
+	}
+	s.users[username] = u
+	if err := s.save(); err != nil {
+		delete(s.users, username)
+		return nil, err
+	}
+	return u, nil
+}
+
+// Provision returns the user a single sign-on login as username maps to,
+// with the role m gives groups. A missing user is created with no
+// password. An existing one must be linked to id's source, and, once an
+// OIDC login has bound it to an issuer and subject, to those; its role is
+// updated, except that the last admin is never demoted, and if m no longer
+// grants it a role, it may not sign in.
+func (s *UserStore) Provision(username string, id ExternalID, m *RoleMapping, groups []string) (*User, error) {
+	if !usernamePattern.MatchString(username) {
+		return nil, fmt.Errorf("invalid username %q", username)
+	}
+	role := m.Role(groups)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		if role == "" {
+			return nil, ErrUserNotFound
+		}
+		u = &User{Username: username, Role: role, Source: id.Source, Issuer: id.Issuer, Subject: id.Subject, CreatedAt: time.Now()}
+		s.users[username] = u
+		if err := s.save(); err != nil {
+			delete(s.users, username)
+			return nil, err
+		}
+		c := *u
+		return &c, nil
+	}
+	if u.Source != id.Source {
+		return nil, ErrNotLinked
+	}
+	if u.Subject != "" && (u.Issuer != id.Issuer || u.Subject != id.Subject) {
+		return nil, ErrOtherIdentity
+	}
+	if role == "" && m.assigns() {
+		return nil, ErrNoRole
+	}
+	old := *u
+	changed := false
+	if u.Subject == "" && id.Subject != "" {
+		u.Issuer, u.Subject = id.Issuer, id.Subject
+		changed = true
+	}
+	if role != "" && role != u.Role && !(u.Role == RoleAdmin && s.admins() == 1) {
+		u.Role = role
+		changed = true
+	}
+	if changed {
+		if err := s.save(); err != nil {
+			*u = old
+			return nil, err
+		}
+	}
+	c := *u
+	return &c, nil
+}
+
+func (s *UserStore) Update(username string, upd UserUpdate) (*User, error) {
+	var hash []byte
+	if upd.Password != nil {
+		if *upd.Password == "" {
+			return nil, fmt.Errorf("password must not be empty")
+		}
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword([]byte(*upd.Password), bcrypt.DefaultCost); err != nil {
+			return nil, err
+		}
+	}
+	if upd.Role != nil && !upd.Role.Valid() {
+		return nil, fmt.Errorf("invalid role %q", *upd.Role)
+	}
+	if upd.RunAs != nil && *upd.RunAs != nil && (*upd.RunAs).User == "" {
+		return nil, fmt.Errorf("runAs needs a user")
+	}
+	if upd.Source != nil && *upd.Source != "" && *upd.Source != SourceOIDC && *upd.Source != SourceProxy {
+		return nil, fmt.Errorf("invalid source %q", *upd.Source)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	if upd.Role != nil && *upd.Role != RoleAdmin && u.Role == RoleAdmin && s.admins() == 1 {
+		return nil, ErrLastAdmin
+	}
+	old := *u
+	if hash != nil {
+		u.PasswordHash = string(hash)
+	}
+	if upd.Role != nil {
+		u.Role = *upd.Role
+	}
+	if upd.RunAs != nil {
+		u.RunAs = *upd.RunAs
+	}
+	if upd.Source != nil && *upd.Source != u.Source {
+		// The next sign-in binds the account to an identity afresh.
+		u.Source, u.Issuer, u.Subject = *upd.Source, "", ""
+	}
+	if err := s.save(); err != nil {
+		*u = old
+		return nil, err
+	}
+	c := *u
+	return &c, nil
+}
+
+func (s *UserStore) Delete(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if u.Role == RoleAdmin && s.admins() == 1 {
+		return ErrLastAdmin
+	}
+	delete(s.users, username)
+	if err := s.save(); err != nil {
+		s.users[username] = u
+		return err
+	}
+	return nil
+}
+
+// admins counts admin accounts. Called with s.mu held.
+func (s *UserStore) admins() int {
+	n := 0
+	for _, u := range s.users {
+		if u.Role == RoleAdmin {
+			n++
+		}
+	}
+	return n
+}
+
+// save writes the user file atomically. Called with s.mu held.
+func (s *UserStore) save() error {
+	list := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return writeFile(s.path, list)
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func newUserStore(t *testing.T) *UserStore {
+	t.Helper()
+	s, err := OpenUserStore(filepath.Join(t.TempDir(), "users.json"), "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestProvisionCreatesAndBinds(t *testing.T) {
+	s := newUserStore(t)
+	m := &RoleMapping{Roles: map[Role][]string{RoleOperator: {"devs"}}}
+	alice := ExternalID{Source: SourceOIDC, Issuer: "https://idp", Subject: "1"}
+
+	u, err := s.Provision("alice", alice, m, []string{"devs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Role != RoleOperator || u.Source != SourceOIDC || u.Subject != "1" {
+		t.Errorf("created user = %+v", u)
+	}
+	if _, err := s.Provision("alice", alice, m, []string{"devs"}); err != nil {
+		t.Errorf("second login: %v", err)
+	}
+	other := ExternalID{Source: SourceOIDC, Issuer: "https://idp", Subject: "2"}
+	if _, err := s.Provision("alice", other, m, []string{"devs"}); !errors.Is(err, ErrOtherIdentity) {
+		t.Errorf("other subject: got %v, want ErrOtherIdentity", err)
+	}
+	if _, err := s.Provision("alice", alice, m, []string{"sales"}); !errors.Is(err, ErrNoRole) {
+		t.Errorf("groups without a role: got %v, want ErrNoRole", err)
+	}
+	if _, err := s.Provision("bob", alice, m, nil); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("new user without a role: got %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestProvisionExistingAccount(t *testing.T) {
+	s := newUserStore(t)
+	if _, err := s.Create("carol", "secret", RoleViewer, nil); err != nil {
+		t.Fatal(err)
+	}
+	id := ExternalID{Source: SourceOIDC, Issuer: "https://idp", Subject: "3"}
+	none := &RoleMapping{}
+
+	// Local accounts are not taken over until an admin links them.
+	if _, err := s.Provision("carol", id, none, nil); !errors.Is(err, ErrNotLinked) {
+		t.Fatalf("unlinked account: got %v, want ErrNotLinked", err)
+	}
+	if _, err := s.Provision(BootstrapUser, id, none, nil); !errors.Is(err, ErrNotLinked) {
+		t.Fatalf("unlinked admin: got %v, want ErrNotLinked", err)
+	}
+	source := SourceOIDC
+	if _, err := s.Update("carol", UserUpdate{Source: &source}); err != nil {
+		t.Fatal(err)
+	}
+	// With no mapping, the role an admin gave is kept.
+	u, err := s.Provision("carol", id, none, []string{"admins"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Role != RoleViewer || u.Subject != "3" {
+		t.Errorf("linked user = %+v", u)
+	}
+	if _, err := s.Provision("carol", ExternalID{Source: SourceProxy}, none, nil); !errors.Is(err, ErrNotLinked) {
+		t.Errorf("other source: got %v, want ErrNotLinked", err)
+	}
+}
+
+func TestProvisionKeepsLastAdmin(t *testing.T) {
+	s := newUserStore(t)
+	source := SourceProxy
+	if _, err := s.Update(BootstrapUser, UserUpdate{Source: &source}); err != nil {
+		t.Fatal(err)
+	}
+	m := &RoleMapping{DefaultRole: RoleViewer}
+	u, err := s.Provision(BootstrapUser, ExternalID{Source: SourceProxy}, m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Role != RoleAdmin {
+		t.Errorf("last admin demoted to %s", u.Role)
+	}
+}
@@ -0,0 +1,167 @@
+// Package cgroup places session processes in their own cgroup v2 with CPU,
+// memory and pids limits, and reads back their usage.
+package cgroup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits for a session's cgroup. Zero values mean unlimited.
+type Limits struct {
+	CPU    float64 `json:"cpu,omitempty"`    // number of CPUs, e.g. 1.5
+	Memory int64   `json:"memory,omitempty"` // bytes
+	Pids   int64   `json:"pids,omitempty"`   // max processes and threads
+}
+
+// IsZero reports whether l imposes no limit.
+func (l Limits) IsZero() bool {
+	return l == Limits{}
+}
+
+// Merge returns l with every zero field taken from defaults.
+func (l Limits) Merge(defaults Limits) Limits {
+	if l.CPU == 0 {
+		l.CPU = defaults.CPU
+	}
+	if l.Memory == 0 {
+		l.Memory = defaults.Memory
+	}
+	if l.Pids == 0 {
+		l.Pids = defaults.Pids
+	}
+	return l
+}
+
+// Usage is a point-in-time reading of a cgroup's resource consumption.
+type Usage struct {
+	CPUSeconds  float64 `json:"cpuSeconds"`
+	MemoryBytes int64   `json:"memoryBytes"`
+	Pids        int64   `json:"pids"`
+}
+
+const cpuPeriod = 100000 // microseconds
+
+// Setup prepares root as the parent of session cgroups by enabling the cpu,
+// memory and pids controllers for its children. root must be on a cgroup v2
+// hierarchy delegated to this process.
+func Setup(root string) error {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		return fmt.Errorf("%s is not a cgroup v2 directory", root)
+	}
+	for _, c := range []string{"cpu", "memory", "pids"} {
+		if err := write(root, "cgroup.subtree_control", "+"+c); err != nil {
+			return fmt.Errorf("enable %s controller in %s: %w", c, root, err)
+		}
+	}
+	return nil
+}
+
+// Create makes the cgroup at path and applies l.
+func Create(path string, l Limits) error {
+	if err := os.Mkdir(path, 0o755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if l.CPU > 0 {
+		quota := int64(l.CPU * cpuPeriod)
+		if err := write(path, "cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod)); err != nil {
+			return err
+		}
+	}
+	if l.Memory > 0 {
+		if err := write(path, "memory.max", strconv.FormatInt(l.Memory, 10)); err != nil {
+			return err
+		}
+		// Keep runaway sessions from pushing into swap instead of being
+		// contained.
+		write(path, "memory.swap.max", "0")
+	}
+	if l.Pids > 0 {
+		if err := write(path, "pids.max", strconv.FormatInt(l.Pids, 10)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddProcess moves pid into the cgroup at path.
+func AddProcess(path string, pid int) error {
+	return write(path, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// Remove kills any processes left in the cgroup at path and deletes it.
+func Remove(path string) error {
+	if err := write(path, "cgroup.kill", "1"); errors.Is(err, os.ErrNotExist) {
+		// cgroup.kill needs Linux 5.14; fall back to signalling each member.
+		killProcs(path)
+	}
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = os.Remove(path); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return err
+}
+
+func killProcs(path string) {
+	b, err := os.ReadFile(filepath.Join(path, "cgroup.procs"))
+	if err != nil {
+		return
+	}
+	for _, f := range strings.Fields(string(b)) {
+		if pid, err := strconv.Atoi(f); err == nil {
+			if p, err := os.FindProcess(pid); err == nil {
+				p.Kill()
+			}
+		}
+	}
+}
+
+// ReadUsage returns the current usage of the cgroup at path.
+func ReadUsage(path string) (Usage, error) {
+	var u Usage
+	if _, err := os.Stat(path); err != nil {
+		return u, err
+	}
+	if v, err := readInt(path, "memory.current"); err == nil {
+		u.MemoryBytes = v
+	}
+	if v, err := readInt(path, "pids.current"); err == nil {
+		u.Pids = v
+	}
+	if f, err := os.Open(filepath.Join(path, "cpu.stat")); err == nil {
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			key, val, _ := strings.Cut(sc.Text(), " ")
+			if key == "usage_usec" {
+				usec, _ := strconv.ParseInt(val, 10, 64)
+				u.CPUSeconds = float64(usec) / 1e6
+			}
+		}
+		f.Close()
+	}
+	return u, nil
+}
+
+func readInt(path, file string) (int64, error) {
+	b, err := os.ReadFile(filepath.Join(path, file))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+func write(path, file, value string) error {
+	return os.WriteFile(filepath.Join(path, file), []byte(value), 0o644)
+}
@@ -0,0 +1,216 @@
+// Package health runs the checks behind the liveness and readiness
+// endpoints.
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+const (
+	// Timeout bounds each check; one that takes longer fails.
+	Timeout = 2 * time.Second
+	// CacheTTL is how long a report is reused, so probes can't run the
+	// checks more often than that.
+	CacheTTL = 5 * time.Second
+)
+
+// Check is a named check. Run returns nil when all is well.
+type Check struct {
+	Name string
+	Run  func() error
+}
+
+// Result is the outcome of one check.
+type Result struct {
+	Status   string `json:"status"` // "ok" or "fail"
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is the outcome of a set of checks.
+type Report struct {
+	Status string            `json:"status"` // "ok" if every check passed, else "fail"
+	Checks map[string]Result `json:"checks"`
+}
+
+// Checker runs a set of checks for callers that may not be trusted: one
+// run at a time, reused for CacheTTL, with file paths left out of the
+// errors reported. Failures are logged in full.
+type Checker struct {
+	checks []Check
+
+	mu      sync.Mutex
+	running chan struct{} // closed when the run in progress finishes
+	report  Report
+	at      time.Time            // when report was made
+	busy    map[string]time.Time // checks that timed out and haven't returned -> start
+	failing map[string]bool
+}
+
+func NewChecker(checks []Check) *Checker {
+	return &Checker{checks: checks, busy: make(map[string]time.Time), failing: make(map[string]bool)}
+}
+
+// Run returns the report of the last run, if it is recent, or of a new
+// one, started unless one is in progress.
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.Lock()
+	if !c.at.IsZero() && time.Since(c.at) < CacheTTL {
+		defer c.mu.Unlock()
+		return c.report
+	}
+	if c.running == nil {
+		c.running = make(chan struct{})
+		go c.run(c.running)
+	}
+	done := c.running
+	c.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return Report{Status: "fail"}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.report
+}
+
+// run runs the checks concurrently. A check still running after Timeout
+// fails and is left to finish in the background; until it does, it fails
+// again without being started anew.
+func (c *Checker) run(done chan struct{}) {
+	rep := Report{Status: "ok", Checks: make(map[string]Result, len(c.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	timeout := time.After(Timeout)
+	for _, ch := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			var err error
+			c.mu.Lock()
+			since, busy := c.busy[ch.Name]
+			c.mu.Unlock()
+			if busy {
+				err = fmt.Errorf("still running after %s", time.Since(since).Round(time.Second))
+			} else {
+				result := make(chan error, 1)
+				go func() {
+					result <- ch.Run()
+					c.mu.Lock()
+					delete(c.busy, ch.Name)
+					c.mu.Unlock()
+				}()
+				select {
+				case err = <-result:
+				case <-timeout:
+					c.mu.Lock()
+					select {
+					case err = <-result:
+					default:
+						err = fmt.Errorf("timed out after %s", Timeout)
+						c.busy[ch.Name] = start
+					}
+					c.mu.Unlock()
+				}
+			}
+			res := Result{Status: "ok", Duration: time.Since(start).Round(time.Microsecond).String()}
+			if err != nil {
+				res.Status, res.Error = "fail", withoutPaths(err).Error()
+			}
+			c.logChange(ch.Name, err)
+			mu.Lock()
+			rep.Checks[ch.Name] = res
+			if err != nil {
+				rep.Status = "fail"
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	c.report, c.at, c.running = rep, time.Now(), nil
+	c.mu.Unlock()
+	close(done)
+}
+
+// logChange logs a check that starts or stops failing.
+func (c *Checker) logChange(name string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case err != nil && !c.failing[name]:
+		log.Printf("health: %s check failed: %v", name, err)
+	case err == nil && c.failing[name]:
+		log.Printf("health: %s check passes again", name)
+	}
+	c.failing[name] = err != nil
+}
+
+// withoutPaths strips the file name from err if it is about one.
+func withoutPaths(err error) error {
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		return fmt.Errorf("%s: %w", pe.Op, pe.Err)
+	}
+	return err
+}
+
+// Writable checks that files can be created in dir, creating dir with
+// mode first if it doesn't exist yet, as the server would.
+func Writable(dir string, mode os.FileMode) func() error {
+	return func() error {
+		if err := os.MkdirAll(dir, mode); err != nil {
+			return err
+		}
+		f, err := os.CreateTemp(dir, ".health-*")
+		if err != nil {
+			return err
+		}
+		name := f.Name()
+		_, err = f.Write([]byte("ok"))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		os.Remove(name)
+		return err
+	}
+}
+
+// FreeSpace checks that the filesystem holding dir has at least min bytes
+// available.
+func FreeSpace(dir string, min int64) func() error {
+	return func() error {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(dir, &st); err != nil {
+			return err
+		}
+		free := int64(st.Bavail) * int64(st.Bsize)
+		if free < min {
+			return &os.PathError{Op: "statfs", Path: dir, Err: fmt.Errorf("%d bytes free, need %d", free, min)}
+		}
+		return nil
+	}
+}
+
+// PTY checks that a pseudo-terminal can be allocated.
+func PTY() error {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return err
+	}
+	tty.Close()
+	return ptmx.Close()
+}
@@ -0,0 +1,174 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckerCachesReport(t *testing.T) {
+	var runs atomic.Int32
+	release := make(chan struct{})
+	c := NewChecker([]Check{{Name: "slow", Run: func() error {
+		runs.Add(1)
+		<-release
+		return nil
+	}}})
+
+	// Callers arriving while a run is in progress share it.
+	var wg sync.WaitGroup
+	reports := make([]Report, 5)
+	for i := range reports {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reports[i] = c.Run(context.Background())
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	for _, rep := range reports {
+		if rep.Status != "ok" || rep.Checks["slow"].Status != "ok" {
+			t.Errorf("report = %+v", rep)
+		}
+	}
+	if n := runs.Load(); n != 1 {
+		t.Errorf("check ran %d times for concurrent callers, want 1", n)
+	}
+
+	// Later callers get the cached report until it is CacheTTL old.
+	c.Run(context.Background())
+	if n := runs.Load(); n != 1 {
+		t.Errorf("check ran %d times within CacheTTL, want 1", n)
+	}
+	c.mu.Lock()
+	c.at = time.Now().Add(-CacheTTL)
+	c.mu.Unlock()
+	c.Run(context.Background())
+	if n := runs.Load(); n != 2 {
+		t.Errorf("check ran %d times after CacheTTL, want 2", n)
+	}
+}
+
+func TestCheckerGivesUpWithContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	c := NewChecker([]Check{{Name: "stuck", Run: func() error {
+		<-release
+		return nil
+	}}})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if rep := c.Run(ctx); rep.Status != "fail" {
+		t.Errorf("report = %+v", rep)
+	}
+}
+
+func TestCheckerReportsFailuresWithoutPaths(t *testing.T) {
+	c := NewChecker([]Check{
+		{Name: "good", Run: func() error { return nil }},
+		{Name: "file", Run: func() error {
+			_, err := os.Open("/secret/place/missing")
+			return err
+		}},
+		{Name: "plain", Run: func() error { return errors.New("broken") }},
+	})
+	rep := c.Run(context.Background())
+	if rep.Status != "fail" || rep.Checks["good"].Status != "ok" {
+		t.Fatalf("report = %+v", rep)
+	}
+	if got := rep.Checks["file"]; got.Status != "fail" || got.Error != "open: no such file or directory" {
+		t.Errorf("file check = %+v", got)
+	}
+	if got := rep.Checks["plain"]; got.Status != "fail" || got.Error != "broken" {
+		t.Errorf("plain check = %+v", got)
+	}
+}
+
+func TestCheckerTimesOutStuckCheck(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for Timeout")
+	}
+	release := make(chan struct{})
+	var runs atomic.Int32
+	c := NewChecker([]Check{
+		{Name: "stuck", Run: func() error {
+			runs.Add(1)
+			<-release
+			return nil
+		}},
+		{Name: "good", Run: func() error { return nil }},
+	})
+	rep := c.Run(context.Background())
+	if got := rep.Checks["stuck"]; got.Status != "fail" || !strings.HasPrefix(got.Error, "timed out") {
+		t.Errorf("stuck check = %+v", got)
+	}
+	if rep.Checks["good"].Status != "ok" {
+		t.Errorf("good check = %+v", rep.Checks["good"])
+	}
+
+	// Until it returns, the stuck check isn't started again.
+	c.mu.Lock()
+	c.at = time.Time{}
+	c.mu.Unlock()
+	rep = c.Run(context.Background())
+	if got := rep.Checks["stuck"]; got.Status != "fail" || !strings.HasPrefix(got.Error, "still running") {
+		t.Errorf("stuck check on the next run = %+v", got)
+	}
+	if n := runs.Load(); n != 1 {
+		t.Errorf("stuck check started %d times", n)
+	}
+
+	close(release)
+	time.Sleep(20 * time.Millisecond)
+	c.mu.Lock()
+	c.at = time.Time{}
+	c.mu.Unlock()
+	if rep := c.Run(context.Background()); rep.Status != "ok" {
+		t.Errorf("report after the check returned = %+v", rep)
+	}
+}
+
+func TestWritable(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := Writable(dir, 0o700)(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o700 {
+		t.Errorf("created with mode %o, want 700", perm)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("left %d files behind", len(entries))
+	}
+
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0o600)
+	if err := Writable(file, 0o700)(); err == nil {
+		t.Error("a file passed as a writable directory")
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	if err := FreeSpace(dir, 1)(); err != nil {
+		t.Error(err)
+	}
+	err := FreeSpace(dir, 1<<62)()
+	if err == nil || !strings.Contains(err.Error(), "bytes free") {
+		t.Errorf("FreeSpace with an impossible minimum = %v", err)
+	}
+	if strings.Contains(withoutPaths(err).Error(), dir) {
+		t.Errorf("reported error names the directory: %v", withoutPaths(err))
+	}
+}
@@ -0,0 +1,191 @@
+// Package listen opens the server's listeners: sockets passed in by
+// systemd socket activation, or TCP addresses and Unix domain sockets from
+// the configuration.
+package listen
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// firstActivationFD is the first file descriptor systemd passes
+// (SD_LISTEN_FDS_START).
+const firstActivationFD = 3
+
+// InheritEnv holds the number of listening sockets a server hands to its
+// replacement during an upgrade, at the descriptors systemd would use.
+const InheritEnv = "AI_CONDUCTOR_LISTEN_FDS"
+
+// UnixPrefix marks an address as a Unix domain socket path.
+const UnixPrefix = "unix:"
+
+// Options say what to listen on when systemd passes no sockets.
+type Options struct {
+	Addrs       []string    // host:port, or unix:/path/to.sock
+	SocketMode  os.FileMode // permissions of Unix sockets
+	SocketGroup string      // group owning Unix sockets, if set
+}
+
+// Listen returns the sockets handed over by the server this one replaces or
+// passed in by systemd, if any, else listeners on opts.Addrs.
+func Listen(opts Options) ([]net.Listener, error) {
+	lns, err := Activated()
+	if err != nil || len(lns) > 0 {
+		return lns, err
+	}
+	for _, addr := range opts.Addrs {
+		var ln net.Listener
+		if path, ok := strings.CutPrefix(addr, UnixPrefix); ok {
+			ln, err = listenUnix(path, opts.SocketMode, opts.SocketGroup)
+		} else {
+			ln, err = net.Listen("tcp", addr)
+		}
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// Activated returns the listening sockets handed over by the server this
+// one replaces (InheritEnv) or passed in by systemd (LISTEN_FDS), and clears
+// the variables so child processes don't take them for their own.
+func Activated() ([]net.Listener, error) {
+	if v := os.Getenv(InheritEnv); v != "" {
+		os.Unsetenv(InheritEnv)
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("%s: invalid count %q", InheritEnv, v)
+		}
+		lns, err := fileListeners(n, nil)
+		if err != nil {
+			return nil, err
+		}
+		// Unix sockets the old server created are this one's to remove now.
+		for _, ln := range lns {
+			if ul, ok := ln.(*net.UnixListener); ok {
+				ul.SetUnlinkOnClose(true)
+			}
+		}
+		return lns, nil
+	}
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	lns, err := fileListeners(n, names)
+	if err != nil {
+		return nil, fmt.Errorf("socket activation: %w", err)
+	}
+	return lns, nil
+}
+
+// fileListeners turns the n descriptors from firstActivationFD on into
+// listeners.
+func fileListeners(n int, names []string) ([]net.Listener, error) {
+	lns := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		fd := firstActivationFD + i
+		syscall.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		f.Close() // FileListener holds its own duplicate
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// Files returns duplicates of the listeners' descriptors, in order, to
+// hand to the server replacing this one. Unix socket files are left in
+// place when the listeners are closed from then on.
+func Files(lns []net.Listener) ([]*os.File, error) {
+	files := make([]*os.File, 0, len(lns))
+	for _, ln := range lns {
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("cannot pass on listener %s", ln.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	for _, ln := range lns {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return files, nil
+}
+
+// listenUnix listens on a Unix domain socket at path with mode and, if set,
+// group. A stale socket left by a previous run is replaced.
+func listenUnix(path string, mode os.FileMode, group string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("listen %s: exists and is not a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("listen %s: already in use", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketPermissions(path, mode, group); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("listen %s: %w", path, err)
+	}
+	return ln, nil
+}
+
+func setSocketPermissions(path string, mode os.FileMode, group string) error {
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(path, mode)
+}
@@ -0,0 +1,195 @@
+package listen
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// helperEnv makes the test binary call Activated and print what it got,
+// as a server started with sockets would. If it is "self", LISTEN_PID is
+// set to the helper's own pid first, as systemd does.
+const helperEnv = "ADC_LISTEN_TEST_HELPER"
+
+func TestMain(m *testing.M) {
+	if mode, ok := os.LookupEnv(helperEnv); ok {
+		if mode == "self" {
+			os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		}
+		lns, err := Activated()
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		for _, ln := range lns {
+			fmt.Println(ln.Addr().Network(), ln.Addr())
+			ln.Close()
+		}
+		for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", InheritEnv} {
+			if os.Getenv(v) != "" {
+				fmt.Println("left", v)
+			}
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runHelper runs the test binary with lns passed at descriptors 3 on and
+// the given environment, and returns its output.
+func runHelper(t *testing.T, lns []net.Listener, env ...string) (string, error) {
+	t.Helper()
+	files, err := Files(lns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	return runHelperFiles(files, env...)
+}
+
+// runHelperFiles is runHelper for descriptors that may not be sockets.
+func runHelperFiles(files []*os.File, env ...string) (string, error) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), env...)
+	cmd.ExtraFiles = files
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	return out.String(), err
+}
+
+func testListeners(t *testing.T) ([]net.Listener, string) {
+	t.Helper()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcp.Close() })
+	path := filepath.Join(t.TempDir(), "adc.sock")
+	unix, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close() })
+	return []net.Listener{tcp, unix}, fmt.Sprintf("tcp %s\nunix %s\n", tcp.Addr(), path)
+}
+
+func TestActivatedFromSystemd(t *testing.T) {
+	lns, want := testListeners(t)
+	out, err := runHelper(t, lns, helperEnv+"=self", "LISTEN_FDS=2", "LISTEN_FDNAMES=http:admin")
+	if err != nil || out != want {
+		t.Errorf("helper: %v\n%s\nwant\n%s", err, out, want)
+	}
+	// The socket file stays for systemd, which owns it.
+	if _, err := os.Stat(lns[1].Addr().String()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestActivatedIgnoresOtherProcessesSockets(t *testing.T) {
+	lns, _ := testListeners(t)
+	for _, env := range [][]string{
+		{"LISTEN_PID=1", "LISTEN_FDS=2"},
+		{"LISTEN_PID=", "LISTEN_FDS=2"},
+	} {
+		out, err := runHelper(t, lns, append(env, helperEnv+"=")...)
+		if err != nil || strings.Contains(out, "tcp") {
+			t.Errorf("with %v: %v\n%s", env, err, out)
+		}
+	}
+	out, err := runHelper(t, lns, helperEnv+"=self", "LISTEN_FDS=0")
+	if err != nil || strings.Contains(out, "tcp") {
+		t.Errorf("with no sockets: %v\n%s", err, out)
+	}
+}
+
+func TestActivatedFromUpgrade(t *testing.T) {
+	lns, want := testListeners(t)
+	out, err := runHelper(t, lns, helperEnv+"=", InheritEnv+"=2")
+	if err != nil || out != want {
+		t.Errorf("helper: %v\n%s\nwant\n%s", err, out, want)
+	}
+	// The new server owns the socket file now, and removed it on closing.
+	if _, err := os.Stat(lns[1].Addr().String()); !os.IsNotExist(err) {
+		t.Errorf("socket file after the new server closed it: %v", err)
+	}
+
+	out, err = runHelper(t, lns, helperEnv+"=", InheritEnv+"=two")
+	if err == nil || !strings.Contains(out, "invalid count") {
+		t.Errorf("bad count: %v\n%s", err, out)
+	}
+	f, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	out, err = runHelperFiles([]*os.File{f}, helperEnv+"=", InheritEnv+"=1")
+	if err == nil || !strings.Contains(out, "LISTEN_FD_3") {
+		t.Errorf("descriptor that isn't a socket: %v\n%s", err, out)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "adc.sock")
+	ln, err := listenUnix(path, 0o660, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o660 {
+		t.Errorf("socket mode = %o, want 660", perm)
+	}
+	if _, err := listenUnix(path, 0o660, ""); err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Errorf("second listener: %v", err)
+	}
+
+	// A socket left behind by a crash is replaced.
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = listenUnix(path, 0o600, "")
+	if err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+	ln.Close()
+
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0o600)
+	if _, err := listenUnix(file, 0o600, ""); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("over a regular file: %v", err)
+	}
+}
+
+func TestListenFallsBackToAddrs(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv(InheritEnv, "")
+	path := filepath.Join(t.TempDir(), "adc.sock")
+	lns, err := Listen(Options{Addrs: []string{"127.0.0.1:0", UnixPrefix + path}, SocketMode: 0o600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, ln := range lns {
+			ln.Close()
+		}
+	}()
+	if len(lns) != 2 || lns[0].Addr().Network() != "tcp" || lns[1].Addr().String() != path {
+		t.Errorf("listeners = %v", lns)
+	}
+	if _, err := Listen(Options{Addrs: []string{"127.0.0.1:0", "256.0.0.1:0"}}); err == nil {
+		t.Error("bad address accepted")
+	}
+}
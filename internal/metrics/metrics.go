@@ -0,0 +1,252 @@
+// Package metrics exposes counters, gauges and histograms in the Prometheus
+// text format. Values kept elsewhere, such as per-session byte counts, are
+// read when scraped through collector functions.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are latency buckets in seconds suited to HTTP requests.
+var DefBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Registry holds metric families and writes them out in registration order.
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+}
+
+type family interface {
+	write(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(f family) {
+	r.mu.Lock()
+	r.families = append(r.families, f)
+	r.mu.Unlock()
+}
+
+// Handler serves the registry's metrics.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		r.mu.Lock()
+		families := append([]family(nil), r.families...)
+		r.mu.Unlock()
+		for _, f := range families {
+			f.write(bw)
+		}
+		bw.Flush()
+	})
+}
+
+// header describes a metric family.
+type header struct {
+	name, help, typ string
+	labels          []string
+}
+
+func (h *header) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", h.name, escapeHelp(h.help), h.name, h.typ)
+}
+
+// series formats name{labels} for label values, with extra appended.
+func (h *header) series(name string, values []string, extra ...string) string {
+	if len(h.labels) == 0 && len(extra) == 0 {
+		return name
+	}
+	var b strings.Builder
+	b.WriteString(name + "{")
+	for i, l := range h.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l + `="` + escapeLabel(values[i]) + `"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if b.Len() > len(name)+1 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra[i] + `="` + extra[i+1] + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func (h *header) check(values []string) {
+	if len(values) != len(h.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", h.name, len(h.labels), len(values)))
+	}
+}
+
+// Counter is a counter with optional labels.
+type Counter struct {
+	header
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	v      float64
+}
+
+// NewCounter registers a counter whose series are told apart by labels.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{header: header{name, help, "counter", labels}, values: make(map[string]*counterValue)}
+	r.add(c)
+	return c
+}
+
+// Add adds v, which must not be negative, to the series for labelValues.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.check(labelValues)
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	cv, ok := c.values[key]
+	if !ok {
+		cv = &counterValue{labels: labelValues}
+		c.values[key] = cv
+	}
+	cv.v += v
+	c.mu.Unlock()
+}
+
+// Inc adds one to the series for labelValues.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		cv := c.values[key]
+		fmt.Fprintf(w, "%s %s\n", c.series(c.name, cv.labels), formatFloat(cv.v))
+	}
+}
+
+// Histogram counts observations, such as request durations, in buckets.
+type Histogram struct {
+	header
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram with the given upper bucket bounds,
+// in increasing order.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{header: header{name, help, "histogram", labels}, buckets: buckets, values: make(map[string]*histogramValue)}
+	r.add(h)
+	return h
+}
+
+// Observe records v in the series for labelValues.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.check(labelValues)
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{labels: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		hv.counts[i]++
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.values) {
+		hv := h.values[key]
+		var cum uint64
+		for i, le := range h.buckets {
+			cum += hv.counts[i]
+			fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_bucket", hv.labels, "le", formatFloat(le)), cum)
+		}
+		fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_bucket", hv.labels, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s %s\n", h.series(h.name+"_sum", hv.labels), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_count", hv.labels), hv.count)
+	}
+}
+
+// Emit reports one series of a collected metric.
+type Emit func(v float64, labelValues ...string)
+
+type collected struct {
+	header
+	collect func(Emit)
+}
+
+// NewGaugeFunc registers a gauge whose series collect reports at every
+// scrape.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func(Emit)) {
+	r.add(&collected{header{name, help, "gauge", labels}, collect})
+}
+
+// NewCounterFunc is NewGaugeFunc for values that only go up.
+func (r *Registry) NewCounterFunc(name, help string, labels []string, collect func(Emit)) {
+	r.add(&collected{header{name, help, "counter", labels}, collect})
+}
+
+func (c *collected) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.collect(func(v float64, labelValues ...string) {
+		c.check(labelValues)
+		fmt.Fprintf(w, "%s %s\n", c.series(c.name, labelValues), formatFloat(v))
+	})
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	b, _ := io.ReadAll(rec.Body)
+	return string(b)
+}
+
+func TestRegistryWritesTextFormat(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("adc_requests_total", "Requests served.", "method", "code")
+	requests.Inc("GET", "200")
+	requests.Inc("GET", "200")
+	requests.Add(0.5, "POST", "403")
+	latency := r.NewHistogram("adc_request_seconds", "Request latency.", []float64{0.1, 1})
+	latency.Observe(0.05)
+	latency.Observe(0.1)
+	latency.Observe(3)
+	r.NewGaugeFunc("adc_sessions", "Sessions by owner.", []string{"owner"}, func(emit Emit) {
+		emit(2, `ol"iv\ia`)
+		emit(1, "adam\n")
+	})
+	r.NewCounterFunc("adc_up", "Help with a \\ and a\nnewline.", nil, func(emit Emit) {
+		emit(1)
+	})
+
+	want := `# HELP adc_requests_total Requests served.
+# TYPE adc_requests_total counter
+adc_requests_total{method="GET",code="200"} 2
+adc_requests_total{method="POST",code="403"} 0.5
+# HELP adc_request_seconds Request latency.
+# TYPE adc_request_seconds histogram
+adc_request_seconds_bucket{le="0.1"} 2
+adc_request_seconds_bucket{le="1"} 2
+adc_request_seconds_bucket{le="+Inf"} 3
+adc_request_seconds_sum 3.15
+adc_request_seconds_count 3
+# HELP adc_sessions Sessions by owner.
+# TYPE adc_sessions gauge
+adc_sessions{owner="ol\"iv\\ia"} 2
+adc_sessions{owner="adam\n"} 1
+# HELP adc_up Help with a \\ and a\nnewline.
+# TYPE adc_up counter
+adc_up 1
+`
+	if got := scrape(t, r); got != want {
+		t.Errorf("scrape =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogramWithLabels(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("adc_seconds", "Seconds.", []float64{1}, "route")
+	h.Observe(2, "/api")
+	want := `# HELP adc_seconds Seconds.
+# TYPE adc_seconds histogram
+adc_seconds_bucket{route="/api",le="1"} 0
+adc_seconds_bucket{route="/api",le="+Inf"} 1
+adc_seconds_sum{route="/api"} 2
+adc_seconds_count{route="/api"} 1
+`
+	if got := scrape(t, r); got != want {
+		t.Errorf("scrape =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWrongLabelCountPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic")
+		}
+	}()
+	NewRegistry().NewCounter("adc_total", "Total.", "method").Inc()
+}
@@ -0,0 +1,13 @@
+// Package runas describes the Unix account a session runs as. It is shared
+// by the session package, which switches to the account, and the auth
+// package, which stores one per user.
+package runas
+
+// Account selects the Unix account a session's process runs as. Switching
+// accounts requires the server to run as root.
+type Account struct {
+	User   string   `json:"user"`             // user name or numeric uid
+	Group  string   `json:"group,omitempty"`  // group name or gid; defaults to the user's primary group
+	Groups []string `json:"groups,omitempty"` // supplementary groups; defaults to all of the user's groups
+	Login  bool     `json:"login,omitempty"`  // login-style environment, home directory and shell
+}
@@ -0,0 +1,66 @@
+// Package sdnotify implements systemd's service notification protocol
+// (sd_notify(3)) in pure Go: readiness, status text, watchdog pings and
+// shutdown, sent as datagrams to the socket in $NOTIFY_SOCKET.
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// States understood by systemd.
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// Status returns the state that sets the status text systemctl shows.
+func Status(text string) string {
+	return "STATUS=" + text
+}
+
+// MainPID returns the state that tells systemd pid is now the service's
+// main process, as when a new binary takes over.
+func MainPID(pid int) string {
+	return "MAINPID=" + strconv.Itoa(pid)
+}
+
+// Notify sends state, one or more newline-separated assignments, to
+// systemd. It returns false without error when the process isn't run by
+// systemd with Type=notify.
+func Notify(state string) (bool, error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return false, nil
+	}
+	// A leading @ names a socket in the abstract namespace.
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns how often to send Watchdog: half the timeout
+// systemd set with WatchdogSec=, as sd_watchdog_enabled(3) recommends. It
+// returns false if the watchdog isn't enabled for this process.
+func WatchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond / 2, true
+}
@@ -0,0 +1,90 @@
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listen listens for datagrams on name, as $NOTIFY_SOCKET spells it.
+func listen(t *testing.T, name string) *net.UnixConn {
+	t.Helper()
+	addr := name
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func receive(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	for name, socket := range map[string]string{
+		"path":     filepath.Join(t.TempDir(), "notify.sock"),
+		"abstract": "@adc-sdnotify-test-" + strconv.Itoa(os.Getpid()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn := listen(t, socket)
+			t.Setenv("NOTIFY_SOCKET", socket)
+			state := Ready + "\n" + Status("Serving 2 sessions") + "\n" + MainPID(42)
+			sent, err := Notify(state)
+			if !sent || err != nil {
+				t.Fatalf("Notify() = %v, %v", sent, err)
+			}
+			if got := receive(t, conn); got != "READY=1\nSTATUS=Serving 2 sessions\nMAINPID=42" {
+				t.Errorf("received %q", got)
+			}
+		})
+	}
+}
+
+func TestNotifyWithoutSystemd(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := Notify(Ready); sent || err != nil {
+		t.Errorf("Notify() = %v, %v; want false, nil", sent, err)
+	}
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing.sock"))
+	if sent, err := Notify(Ready); sent || err == nil {
+		t.Errorf("Notify() to a missing socket = %v, %v", sent, err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+		ok        bool
+	}{
+		{"30000000", "", 15 * time.Second, true},
+		{"30000000", self, 15 * time.Second, true},
+		{"30000000", "1", 0, false},
+		{"", "", 0, false},
+		{"0", "", 0, false},
+		{"soon", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Setenv("WATCHDOG_USEC", tt.usec)
+		t.Setenv("WATCHDOG_PID", tt.pid)
+		if got, ok := WatchdogInterval(); got != tt.want || ok != tt.ok {
+			t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: %v, %v; want %v, %v", tt.usec, tt.pid, got, ok, tt.want, tt.ok)
+		}
+	}
+}
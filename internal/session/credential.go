@@ -0,0 +1,174 @@
+package session
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/runas"
+)
+
+// credential is a resolved runas.Account, passed to the supervisor.
+type credential struct {
+	UID      uint32   `json:"uid"`
+	GID      uint32   `json:"gid"`
+	Groups   []uint32 `json:"groups,omitempty"`
+	Username string   `json:"username"`
+	Home     string   `json:"home"`
+	Shell    string   `json:"shell,omitempty"`
+	Login    bool     `json:"login,omitempty"`
+}
+
+// CheckRunAs checks that sessions can run as r: unless the server runs as
+// root, r must name the server's own account.
+func CheckRunAs(r *runas.Account) error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	cred, err := resolveRunAs(r)
+	if err != nil {
+		return err
+	}
+	return cred.permitted()
+}
+
+// permitted checks that the server may start processes as c.
+func (c *credential) permitted() error {
+	if euid := os.Geteuid(); euid != 0 && uint32(euid) != c.UID {
+		return fmt.Errorf("running sessions as %s requires the server to run as root", c.Username)
+	}
+	return nil
+}
+
+func resolveRunAs(r *runas.Account) (*credential, error) {
+	u, err := lookupUser(r.User)
+	if err != nil {
+		return nil, err
+	}
+	uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+	if r.Group != "" {
+		if gid, err = lookupGroup(r.Group); err != nil {
+			return nil, err
+		}
+	}
+
+	var groups []uint32
+	if r.Groups != nil {
+		for _, g := range r.Groups {
+			id, err := lookupGroup(g)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, uint32(id))
+		}
+	} else if ids, err := u.GroupIds(); err == nil {
+		for _, g := range ids {
+			if id, err := strconv.ParseUint(g, 10, 32); err == nil {
+				groups = append(groups, uint32(id))
+			}
+		}
+	}
+
+	return &credential{
+		UID:      uint32(uid),
+		GID:      uint32(gid),
+		Groups:   groups,
+		Username: u.Username,
+		Home:     u.HomeDir,
+		Shell:    loginShell(u.Username),
+		Login:    r.Login,
+	}, nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if name == "" {
+		return nil, fmt.Errorf("runAs: user is required")
+	}
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("runAs: %w", err)
+	}
+	return u, nil
+}
+
+func lookupGroup(name string) (uint64, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("runAs: %w", err)
+	}
+	return strconv.ParseUint(g.Gid, 10, 32)
+}
+
+// loginShell returns the shell field of username's passwd entry, which
+// os/user does not expose.
+func loginShell(username string) string {
+	f, err := os.Open("/etc/passwd")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Split(sc.Text(), ":")
+		if len(fields) == 7 && fields[0] == username {
+			return fields[6]
+		}
+	}
+	return ""
+}
+
+func (c *credential) sysCredential() *syscall.Credential {
+	return &syscall.Credential{Uid: c.UID, Gid: c.GID, Groups: c.Groups}
+}
+
+// environ returns the base environment for the account: a fresh
+// login-style one, or server with the identity variables replaced as su(1)
+// does.
+func (c *credential) environ(server []string) []string {
+	if !c.Login {
+		identity := map[string]string{"HOME": c.Home, "USER": c.Username, "LOGNAME": c.Username}
+		if c.Shell != "" {
+			identity["SHELL"] = c.Shell
+		}
+		return environ(server, identity)
+	}
+
+	path := "/usr/local/bin:/usr/bin:/bin"
+	if c.UID == 0 {
+		path = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	}
+	env := []string{
+		"HOME=" + c.Home,
+		"USER=" + c.Username,
+		"LOGNAME=" + c.Username,
+		"PATH=" + path,
+	}
+	if c.Shell != "" {
+		env = append(env, "SHELL="+c.Shell)
+	}
+	for _, key := range []string{"LANG", "LC_ALL", "TZ"} {
+		if v, ok := os.LookupEnv(key); ok {
+			env = append(env, key+"="+v)
+		}
+	}
+	return env
+}
+
+// loginArgv0 returns the argv[0] that makes a shell act as a login shell.
+func loginArgv0(command string) string {
+	return "-" + filepath.Base(command)
+}
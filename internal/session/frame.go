@@ -0,0 +1,66 @@
+package session
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// frameType identifies a message exchanged between the server and a
+// session supervisor over the supervisor's Unix socket.
+type frameType byte
+
+const (
+	frameHello  frameType = 'h' // supervisor -> server: supervisorInfo JSON
+	frameOutput frameType = 'o' // supervisor -> server: raw PTY output
+	frameExit   frameType = 'x' // supervisor -> server: exitInfo JSON
+	frameInput  frameType = 'i' // server -> supervisor: raw PTY input
+	frameResize frameType = 'r' // server -> supervisor: rows, cols (uint16 each)
+	frameKill   frameType = 'k' // server -> supervisor: terminate the shell
+)
+
+// maxFramePayload bounds a single frame so a corrupt header can't make us
+// allocate unbounded memory.
+const maxFramePayload = 4 << 20
+
+// Frames are a one-byte type, a four-byte big-endian payload length and the
+// payload itself.
+func writeFrame(w io.Writer, t frameType, payload []byte) error {
+	buf := make([]byte, 5+len(payload))
+	buf[0] = byte(t)
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(payload)))
+	copy(buf[5:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r *bufio.Reader) (frameType, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[1:5])
+	if n > maxFramePayload {
+		return 0, nil, fmt.Errorf("frame too large: %d bytes", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return frameType(hdr[0]), payload, nil
+}
+
+func resizePayload(rows, cols uint16) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b[0:2], rows)
+	binary.BigEndian.PutUint16(b[2:4], cols)
+	return b
+}
+
+func parseResizePayload(b []byte) (rows, cols uint16, ok bool) {
+	if len(b) != 4 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint16(b[0:2]), binary.BigEndian.Uint16(b[2:4]), true
+}
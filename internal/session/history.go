@@ -1,24 +1,474 @@
 package session
 
 import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-func OpenHistoryFile(dataDir, sessionID string) (*os.File, error) {
-	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+// HistoryOptions bounds the on-disk output history of a session.
+type HistoryOptions struct {
+	SegmentSize int64         // rotate the active segment once it reaches this size
+	MaxSize     int64         // drop the oldest segments beyond this total size (0 = unlimited)
+	MaxAge      time.Duration // drop segments that ended longer ago than this (0 = unlimited)
+	Compress    bool          // gzip segments once they are rotated out
+}
+
+var DefaultHistoryOptions = HistoryOptions{
+	SegmentSize: 4 << 20,
+	MaxSize:     64 << 20,
+	Compress:    true,
+}
+
+// History is a segmented, bounded output log stored in <id>.history/ as
+// numbered segments. Only the newest segment is written to; older ones are
+// optionally compressed and pruned by size and age.
+type History struct {
+	dir  string
+	opts HistoryOptions
+
+	mu     sync.Mutex
+	active *os.File
+	size   int64
+	seq    int
+	closed bool
+
+	// Rotated segments waiting to be compressed, handled one at a time by
+	// a single worker that prunes after each.
+	rotated []string
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+type segment struct {
+	seq  int
+	path string
+	size int64
+	mod  time.Time
+}
+
+// ended returns when the segment was last written to. Compression rewrites
+// the file, so compressed segments carry the time in their gzip header.
+func (s segment) ended() time.Time {
+	if !strings.HasSuffix(s.path, ".gz") {
+		return s.mod
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return s.mod
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil || zr.ModTime.IsZero() {
+		return s.mod
+	}
+	return zr.ModTime
+}
+
+func historyDir(dataDir, sessionID string) string {
+	return filepath.Join(dataDir, sessionID+".history")
+}
+
+func segmentName(seq int, compressed bool) string {
+	name := fmt.Sprintf("%08d.log", seq)
+	if compressed {
+		name += ".gz"
+	}
+	return name
+}
+
+// OpenHistory opens the history of sessionID for appending, migrating a
+// legacy single-file <id>.log into the first segment.
+func OpenHistory(dataDir, sessionID string, opts HistoryOptions) (*History, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultHistoryOptions.SegmentSize
+	}
+	dir := historyDir(dataDir, sessionID)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	h := &History{dir: dir, opts: opts, wake: make(chan struct{}, 1), done: make(chan struct{})}
+
+	segs := h.segments()
+	legacy := filepath.Join(dataDir, sessionID+".log")
+	if _, err := os.Stat(legacy); err == nil && len(segs) == 0 {
+		if err := os.Rename(legacy, filepath.Join(dir, segmentName(0, false))); err != nil {
+			return nil, err
+		}
+		segs = h.segments()
+	}
+
+	if n := len(segs); n > 0 && !strings.HasSuffix(segs[n-1].path, ".gz") {
+		h.seq = segs[n-1].seq
+		h.size = segs[n-1].size
+	} else if n > 0 {
+		h.seq = segs[n-1].seq + 1
+	}
+	f, err := h.openSegment(h.seq)
+	if err != nil {
+		return nil, err
+	}
+	h.active = f
+	h.prune()
+	go h.work()
+	return h, nil
+}
+
+func (h *History) openSegment(seq int) (*os.File, error) {
+	return os.OpenFile(filepath.Join(h.dir, segmentName(seq, false)),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+}
+
+func (h *History) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return 0, os.ErrClosed
+	}
+	n, err := h.active.Write(p)
+	h.size += int64(n)
+	if err == nil && h.size >= h.opts.SegmentSize {
+		err = h.rotate()
+	}
+	return n, err
+}
+
+// rotate starts the next segment and hands the full one to the worker.
+// If the next segment can't be created, writes carry on into the full one
+// and the next Write tries again. Called with h.mu held.
+func (h *History) rotate() error {
+	f, err := h.openSegment(h.seq + 1)
+	if err != nil {
+		return err
+	}
+	h.active.Close()
+	h.rotated = append(h.rotated, filepath.Join(h.dir, segmentName(h.seq, false)))
+	h.active = f
+	h.seq++
+	h.size = 0
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// work compresses rotated segments and prunes after each, until Close.
+func (h *History) work() {
+	defer close(h.done)
+	for range h.wake {
+		for {
+			h.mu.Lock()
+			if len(h.rotated) == 0 {
+				h.mu.Unlock()
+				break
+			}
+			path := h.rotated[0]
+			h.rotated = h.rotated[1:]
+			h.mu.Unlock()
+
+			if h.opts.Compress {
+				if err := compressSegment(path); err != nil {
+					log.Printf("history: compress %s: %v", path, err)
+				}
+			}
+			h.prune()
+		}
+	}
+}
+
+// Position returns where the next byte written will go: the active
+// segment and the offset into it.
+func (h *History) Position() (seq int, offset int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.seq, h.size
+}
+
+// Close closes the active segment and waits for rotated segments to be
+// compressed and pruned.
+func (h *History) Close() error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	h.closed = true
+	err := h.active.Close()
+	close(h.wake)
+	h.mu.Unlock()
+	<-h.done
+	return err
+}
+
+// segments lists the segments in h.dir, oldest first.
+func (h *History) segments() []segment {
+	return listSegments(h.dir)
+}
+
+func listSegments(dir string) []segment {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var segs []segment
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".gz")
+		if !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(name, ".log"))
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		segs = append(segs, segment{
+			seq:  seq,
+			path: filepath.Join(dir, e.Name()),
+			size: info.Size(),
+			mod:  info.ModTime(),
+		})
+	}
+	sort.Slice(segs, func(i, j int) bool {
+		if segs[i].seq != segs[j].seq {
+			return segs[i].seq < segs[j].seq
+		}
+		// A segment caught mid-compression appears twice; prefer the plain one.
+		return !strings.HasSuffix(segs[i].path, ".gz")
+	})
+	return segs
+}
+
+// prune removes the oldest closed segments that exceed the size or age caps.
+// The active segment is never removed.
+func (h *History) prune() {
+	h.mu.Lock()
+	active := h.seq
+	h.mu.Unlock()
+
+	// A segment caught mid-compression is listed twice, plain first; count
+	// it once and remove both copies.
+	var segs []segment
+	paths := map[int][]string{}
+	var total int64
+	for _, s := range h.segments() {
+		if paths[s.seq] == nil {
+			segs = append(segs, s)
+			total += s.size
+		}
+		paths[s.seq] = append(paths[s.seq], s.path)
+	}
+	for _, s := range segs {
+		if s.seq >= active {
+			break
+		}
+		tooBig := h.opts.MaxSize > 0 && total > h.opts.MaxSize
+		tooOld := h.opts.MaxAge > 0 && time.Since(s.ended()) > h.opts.MaxAge
+		if !tooBig && !tooOld {
+			break
+		}
+		for _, path := range paths[s.seq] {
+			os.Remove(path)
+		}
+		total -= s.size
+	}
+}
+
+func compressSegment(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	zw.ModTime = info.ModTime() // when the segment ended, for pruning by age
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// OpenHistoryReader streams the full retained history of sessionID, oldest
+// segment first, decompressing cold segments on the fly.
+func OpenHistoryReader(dataDir, sessionID string) (io.ReadCloser, error) {
+	paths := []string{}
+	legacy := filepath.Join(dataDir, sessionID+".log")
+	if _, err := os.Stat(legacy); err == nil {
+		paths = append(paths, legacy)
+	}
+	seen := map[int]bool{}
+	for _, s := range listSegments(historyDir(dataDir, sessionID)) {
+		if seen[s.seq] {
+			continue
+		}
+		seen[s.seq] = true
+		paths = append(paths, s.path)
+	}
+	if len(paths) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return &historyReader{paths: paths}, nil
+}
+
+// openHistoryAt streams the history of sessionID from offset in segment seq
+// on, as returned by Position. It fails with os.ErrNotExist if that segment
+// is no longer retained.
+func openHistoryAt(dataDir, sessionID string, seq int, offset int64) (io.ReadCloser, error) {
+	var paths []string
+	seen := map[int]bool{}
+	for _, s := range listSegments(historyDir(dataDir, sessionID)) {
+		if s.seq < seq || seen[s.seq] {
+			continue
+		}
+		seen[s.seq] = true
+		paths = append(paths, s.path)
+	}
+	if !seen[seq] {
+		return nil, os.ErrNotExist
+	}
+	r := &historyReader{paths: paths}
+	if _, err := io.CopyN(io.Discard, r, offset); err != nil {
+		r.Close()
 		return nil, err
 	}
-	path := filepath.Join(dataDir, sessionID+".log")
-	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	return r, nil
 }
 
-func ReadHistory(dataDir, sessionID string) ([]byte, error) {
-	path := filepath.Join(dataDir, sessionID+".log")
-	return os.ReadFile(path)
+// historyTail returns the first segment of the shortest tail of the history
+// of sessionID that holds at least size bytes, or all of it if shorter.
+func historyTail(dataDir, sessionID string, size int64) int {
+	segs := listSegments(historyDir(dataDir, sessionID))
+	first := 0
+	var total int64
+	for i := len(segs) - 1; i >= 0 && total < size; i-- {
+		first = segs[i].seq
+		total += segs[i].size
+	}
+	return first
+}
+
+type historyReader struct {
+	paths []string
+	file  *os.File
+	cur   io.Reader
+}
+
+func (r *historyReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.paths) == 0 {
+				return 0, io.EOF
+			}
+			if err := r.next(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.closeCurrent()
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *historyReader) next() error {
+	path := r.paths[0]
+	r.paths = r.paths[1:]
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && !strings.HasSuffix(path, ".gz") {
+		// Compressed between listing and opening.
+		path += ".gz"
+		f, err = os.Open(path)
+	}
+	if os.IsNotExist(err) {
+		// Pruned between listing and opening.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.file = f
+	r.cur = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			r.file, r.cur = nil, nil
+			return err
+		}
+		r.cur = zr
+	}
+	return nil
+}
+
+func (r *historyReader) closeCurrent() {
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.file, r.cur = nil, nil
+}
+
+func (r *historyReader) Close() error {
+	r.closeCurrent()
+	r.paths = nil
+	return nil
+}
+
+// HistorySize returns the on-disk size of the retained history of sessionID.
+func HistorySize(dataDir, sessionID string) int64 {
+	var total int64
+	for _, s := range listSegments(historyDir(dataDir, sessionID)) {
+		total += s.size
+	}
+	if info, err := os.Stat(filepath.Join(dataDir, sessionID+".log")); err == nil {
+		total += info.Size()
+	}
+	return total
 }
 
 func RemoveHistory(dataDir, sessionID string) {
-	path := filepath.Join(dataDir, sessionID+".log")
-	os.Remove(path)
+	os.Remove(filepath.Join(dataDir, sessionID+".log"))
+	os.RemoveAll(historyDir(dataDir, sessionID))
 }
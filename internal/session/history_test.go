@@ -0,0 +1,258 @@
+package session
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readHistory(t *testing.T, dir, id string) string {
+	t.Helper()
+	r, err := OpenHistoryReader(dir, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func segmentNames(t *testing.T, dir, id string) []string {
+	t.Helper()
+	var names []string
+	for _, s := range listSegments(historyDir(dir, id)) {
+		names = append(names, filepath.Base(s.path))
+	}
+	return names
+}
+
+func TestSegmentName(t *testing.T) {
+	if got := segmentName(7, false); got != "00000007.log" {
+		t.Errorf("segmentName(7, false) = %q", got)
+	}
+	if got := segmentName(12, true); got != "00000012.log.gz" {
+		t.Errorf("segmentName(12, true) = %q", got)
+	}
+}
+
+func TestHistoryRotatesAndCompresses(t *testing.T) {
+	dir := t.TempDir()
+	h, err := OpenHistory(dir, "s1", HistoryOptions{SegmentSize: 10, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want strings.Builder
+	for _, chunk := range []string{"0123456789", "abcdefghij", "klmno"} {
+		h.Write([]byte(chunk))
+		want.WriteString(chunk)
+	}
+	if seq, off := h.Position(); seq != 2 || off != 5 {
+		t.Errorf("Position() = %d, %d; want 2, 5", seq, off)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names := segmentNames(t, dir, "s1")
+	if strings.Join(names, " ") != "00000000.log.gz 00000001.log.gz 00000002.log" {
+		t.Errorf("segments = %v", names)
+	}
+	if got := readHistory(t, dir, "s1"); got != want.String() {
+		t.Errorf("history = %q, want %q", got, want.String())
+	}
+	info, err := os.Stat(filepath.Join(historyDir(dir, "s1"), "00000000.log.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("segment mode = %o, want 600", perm)
+	}
+	if _, err := h.Write([]byte("x")); err != os.ErrClosed {
+		t.Errorf("Write after Close = %v, want os.ErrClosed", err)
+	}
+}
+
+func TestHistoryReopenAppends(t *testing.T) {
+	dir := t.TempDir()
+	opts := HistoryOptions{SegmentSize: 1 << 10}
+	h, err := OpenHistory(dir, "s1", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write([]byte("before "))
+	h.Close()
+
+	if h, err = OpenHistory(dir, "s1", opts); err != nil {
+		t.Fatal(err)
+	}
+	if seq, off := h.Position(); seq != 0 || off != 7 {
+		t.Errorf("Position() = %d, %d; want 0, 7", seq, off)
+	}
+	h.Write([]byte("after"))
+	h.Close()
+	if got := readHistory(t, dir, "s1"); got != "before after" {
+		t.Errorf("history = %q", got)
+	}
+}
+
+func TestHistoryMigratesLegacyLog(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "s1.log"), []byte("legacy"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	h, err := OpenHistory(dir, "s1", HistoryOptions{SegmentSize: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write([]byte(" output"))
+	h.Close()
+	if got := readHistory(t, dir, "s1"); got != "legacy output" {
+		t.Errorf("history = %q", got)
+	}
+}
+
+func TestHistoryPrunesBySize(t *testing.T) {
+	dir := t.TempDir()
+	h, err := OpenHistory(dir, "s1", HistoryOptions{SegmentSize: 10, MaxSize: 25})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		h.Write(bytes.Repeat([]byte{'a' + byte(i)}, 10))
+	}
+	h.Close()
+
+	// Segments 0-4 are full and 5 is empty and active; only the newest that
+	// fit in 25 bytes are kept.
+	names := segmentNames(t, dir, "s1")
+	if strings.Join(names, " ") != "00000003.log 00000004.log 00000005.log" {
+		t.Errorf("segments = %v", names)
+	}
+	if got := readHistory(t, dir, "s1"); got != "ddddddddddeeeeeeeeee" {
+		t.Errorf("history = %q", got)
+	}
+}
+
+func TestHistoryPrunesByAge(t *testing.T) {
+	dir := t.TempDir()
+	sdir := historyDir(dir, "s1")
+	if err := os.MkdirAll(sdir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	for seq, data := range []string{"old", "new"} {
+		path := filepath.Join(sdir, segmentName(seq, false))
+		os.WriteFile(path, []byte(data), 0o600)
+		if seq == 0 {
+			os.Chtimes(path, old, old)
+		}
+	}
+	h, err := OpenHistory(dir, "s1", HistoryOptions{SegmentSize: 1 << 10, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+	if got := readHistory(t, dir, "s1"); got != "new" {
+		t.Errorf("history = %q", got)
+	}
+}
+
+func TestHistoryPruneCountsSegmentMidCompressionOnce(t *testing.T) {
+	dir := t.TempDir()
+	sdir := historyDir(dir, "s1")
+	if err := os.MkdirAll(sdir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for seq := 0; seq < 3; seq++ {
+		os.WriteFile(filepath.Join(sdir, segmentName(seq, false)), bytes.Repeat([]byte("x"), 10), 0o600)
+	}
+	// Segment 1 has been compressed but its plain copy not yet removed.
+	if err := compressSegment(filepath.Join(sdir, segmentName(1, false))); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(sdir, segmentName(1, false)), bytes.Repeat([]byte("x"), 10), 0o600)
+
+	h, err := OpenHistory(dir, "s1", HistoryOptions{SegmentSize: 1 << 10, MaxSize: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+	names := segmentNames(t, dir, "s1")
+	if strings.Join(names, " ") != "00000001.log 00000001.log.gz 00000002.log" {
+		t.Errorf("segments = %v", names)
+	}
+	if got := readHistory(t, dir, "s1"); got != strings.Repeat("x", 20) {
+		t.Errorf("history = %q", got)
+	}
+}
+
+func TestHistoryKeepsWritingWhenRotationFails(t *testing.T) {
+	dir := t.TempDir()
+	h, err := OpenHistory(dir, "s1", HistoryOptions{SegmentSize: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	// A directory in the way of the next segment makes creating it fail.
+	next := filepath.Join(historyDir(dir, "s1"), segmentName(1, false))
+	if err := os.Mkdir(next, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Write([]byte("12345")); err == nil {
+		t.Error("rotation succeeded")
+	}
+	if _, err := h.Write([]byte("678")); err == nil {
+		t.Error("rotation succeeded")
+	}
+	os.Remove(next)
+	if _, err := h.Write([]byte("9")); err != nil {
+		t.Fatal(err)
+	}
+	h.Write([]byte("abc"))
+	if seq, off := h.Position(); seq != 1 || off != 3 {
+		t.Errorf("Position() = %d, %d; want 1, 3", seq, off)
+	}
+	if got := readHistory(t, dir, "s1"); got != "123456789abc" {
+		t.Errorf("history = %q", got)
+	}
+}
+
+func TestOpenHistoryAt(t *testing.T) {
+	dir := t.TempDir()
+	h, err := OpenHistory(dir, "s1", HistoryOptions{SegmentSize: 4, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write([]byte("abcd"))
+	h.Write([]byte("ef"))
+	seq, off := h.Position()
+	h.Write([]byte("gh"))
+	h.Write([]byte("ij"))
+	h.Close()
+
+	r, err := openHistoryAt(dir, "s1", seq, off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.Close()
+	if string(b) != "ghij" {
+		t.Errorf("read %q from %d/%d, want %q", b, seq, off, "ghij")
+	}
+	if _, err := openHistoryAt(dir, "s1", 9, 0); !os.IsNotExist(err) {
+		t.Errorf("missing segment: got %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestOpenHistoryReaderMissing(t *testing.T) {
+	if _, err := OpenHistoryReader(t.TempDir(), "none"); !os.IsNotExist(err) {
+		t.Errorf("got %v, want os.ErrNotExist", err)
+	}
+}
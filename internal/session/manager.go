@@ -1,37 +1,176 @@
 package session
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/google/uuid"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/cgroup"
+	"github.com/shafqat-a/ai-dev-conductor/internal/runas"
 )
 
 type Manager struct {
-	mu       sync.RWMutex
-	sessions map[string]*Session
-	shell    string
-	dataDir  string
+	mu        sync.RWMutex
+	sessions  map[string]*Session
+	opts      Options
+	templates map[string]Template
+	detached  bool // DetachAll was called; don't re-attach any more
+}
+
+// Options configures how sessions are started and recorded.
+type Options struct {
+	Shell      string
+	DataDir    string
+	History    HistoryOptions
+	Scrollback int        // lines kept by the screen model and sent on attach
+	Record     bool       // write an asciicast recording of each session
+	RecordMax  int64      // stop recording a session at this size (0 = unlimited)
+	Templates  []Template // named specs selectable on create
+
+	// CgroupRoot, if set, is a delegated cgroup v2 directory under which
+	// each session gets its own cgroup with Limits applied.
+	CgroupRoot string
+	Limits     cgroup.Limits
+
+	// RunAs is the default account for sessions whose spec doesn't name one.
+	RunAs *runas.Account
 }
 
-func NewManager(shell, dataDir string) *Manager {
+func NewManager(opts Options) *Manager {
+	templates := make(map[string]Template, len(opts.Templates))
+	for _, t := range opts.Templates {
+		templates[t.Name] = t
+	}
 	return &Manager{
-		sessions: make(map[string]*Session),
-		shell:    shell,
-		dataDir:  dataDir,
+		sessions:  make(map[string]*Session),
+		opts:      opts,
+		templates: templates,
 	}
 }
 
-func (m *Manager) Create(name string) (*Session, error) {
+// Create starts a new session owned by owner running the named template, or
+// the default shell if template is empty. A non-nil runAs takes precedence
+// over the template's and the default account.
+func (m *Manager) Create(name, template, owner string, runAs *runas.Account) (*Session, error) {
+	var spec Spec
+	if template != "" {
+		t, ok := m.templates[template]
+		if !ok {
+			return nil, ErrUnknownTemplate(template)
+		}
+		spec = t.Spec
+		if name == "" {
+			name = t.Name
+		}
+	}
+
+	if runAs != nil {
+		spec.RunAs = runAs
+	}
+
 	id := uuid.New().String()[:8]
 
-	s, err := NewSession(id, name, m.shell, m.dataDir)
+	s, err := NewSession(id, name, template, owner, spec, m.opts)
 	if err != nil {
 		return nil, fmt.Errorf("create session: %w", err)
 	}
 
+	m.track(s)
+	return s, nil
+}
+
+// Recover re-attaches to the supervisors of sessions that outlived a
+// previous server process. Stale sockets left by dead supervisors are
+// removed; sessions whose supervisor is there but can't be attached to
+// right now are retried in the background.
+func (m *Manager) Recover() int {
+	paths, _ := filepath.Glob(filepath.Join(m.opts.DataDir, "*.sock"))
+	recovered := 0
+	for _, path := range paths {
+		id := strings.TrimSuffix(filepath.Base(path), ".sock")
+		if m.reattach(id) {
+			recovered++
+		} else if _, err := os.Stat(path); err == nil {
+			go m.retryAttach(id)
+		}
+	}
+	return recovered
+}
+
+// Delays between attempts to re-attach to a supervisor that is running but
+// couldn't be attached to.
+const (
+	reattachDelay    = time.Second
+	reattachMaxDelay = 30 * time.Second
+)
+
+// reattach attaches to the supervisor of session id and tracks the session.
+// It cleans up after the session only if no supervisor is listening; other
+// errors, such as running out of file descriptors, leave it to be retried.
+func (m *Manager) reattach(id string) bool {
+	s, err := AttachSession(id, m.opts)
+	if err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOENT) {
+			log.Printf("session %s: supervisor gone: %v", id, err)
+			m.cleanupDead(id)
+		} else {
+			log.Printf("session %s: cannot re-attach, will retry: %v", id, err)
+		}
+		return false
+	}
+	m.mu.Lock()
+	detached := m.detached
+	m.mu.Unlock()
+	if detached {
+		s.Detach()
+		return true
+	}
+	m.track(s)
+	log.Printf("session %s: re-attached", id)
+	return true
+}
+
+// retryAttach keeps trying to re-attach to session id, backing off, until
+// it succeeds, the supervisor is gone or the server is shutting down.
+func (m *Manager) retryAttach(id string) {
+	delay := reattachDelay
+	for {
+		time.Sleep(delay)
+		m.mu.RLock()
+		detached := m.detached
+		m.mu.RUnlock()
+		if detached {
+			return
+		}
+		if _, err := os.Stat(socketPath(m.opts.DataDir, id)); err != nil {
+			return
+		}
+		if m.reattach(id) {
+			return
+		}
+		delay = min(2*delay, reattachMaxDelay)
+	}
+}
+
+// cleanupDead removes what a session whose supervisor is gone left behind.
+func (m *Manager) cleanupDead(id string) {
+	os.Remove(socketPath(m.opts.DataDir, id))
+	markEnded(m.opts.DataDir, id, nil)
+	if meta, err := LoadMetadata(m.opts.DataDir, id); err == nil && meta.Cgroup != "" {
+		cgroup.Remove(meta.Cgroup)
+	}
+}
+
+func (m *Manager) track(s *Session) {
 	s.OnProcessExit = func(sessionID string) {
 		m.mu.Lock()
 		_, exists := m.sessions[sessionID]
@@ -45,10 +184,19 @@ func (m *Manager) Create(name string) (*Session, error) {
 	}
 
 	m.mu.Lock()
-	m.sessions[id] = s
+	m.sessions[s.ID] = s
 	m.mu.Unlock()
+}
 
-	return s, nil
+// Templates returns the configured session templates sorted by name.
+func (m *Manager) Templates() []Template {
+	return sortedTemplates(m.templates)
+}
+
+// Template returns the template called name.
+func (m *Manager) Template(name string) (Template, bool) {
+	t, ok := m.templates[name]
+	return t, ok
 }
 
 func (m *Manager) Get(id string) (*Session, bool) {
@@ -59,9 +207,13 @@ func (m *Manager) Get(id string) (*Session, bool) {
 }
 
 type SessionInfo struct {
-	ID        string `json:"id"`
-	Name      string `json:"name"`
-	CreatedAt string `json:"createdAt"`
+	ID           string         `json:"id"`
+	Name         string         `json:"name"`
+	Owner        string         `json:"owner,omitempty"`
+	CreatedAt    string         `json:"createdAt"`
+	LastActiveAt string         `json:"lastActiveAt"`
+	Usage        *cgroup.Usage  `json:"usage,omitempty"`
+	Limits       *cgroup.Limits `json:"limits,omitempty"`
 }
 
 func (m *Manager) List() []SessionInfo {
@@ -71,9 +223,13 @@ func (m *Manager) List() []SessionInfo {
 	list := make([]SessionInfo, 0, len(m.sessions))
 	for _, s := range m.sessions {
 		list = append(list, SessionInfo{
-			ID:        s.ID,
-			Name:      s.GetName(),
-			CreatedAt: s.CreatedAt.Format("2006-01-02 15:04:05"),
+			ID:           s.ID,
+			Name:         s.GetName(),
+			Owner:        s.Owner,
+			CreatedAt:    s.CreatedAt.Format("2006-01-02 15:04:05"),
+			LastActiveAt: s.LastActive().Format("2006-01-02 15:04:05"),
+			Usage:        s.Usage(),
+			Limits:       s.limits,
 		})
 	}
 	sort.Slice(list, func(i, j int) bool {
@@ -82,6 +238,17 @@ func (m *Manager) List() []SessionInfo {
 	return list
 }
 
+// Stats returns the stats of every live session.
+func (m *Manager) Stats() []Stats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stats := make([]Stats, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		stats = append(stats, s.Stats())
+	}
+	return stats
+}
+
 func (m *Manager) Rename(id, name string) error {
 	m.mu.RLock()
 	s, ok := m.sessions[id]
@@ -89,16 +256,41 @@ func (m *Manager) Rename(id, name string) error {
 	if !ok {
 		return fmt.Errorf("session %s not found", id)
 	}
-	s.SetName(name)
-	return nil
+	return s.SetName(name)
+}
+
+// Ended returns the records of sessions whose shell has exited, most
+// recently ended first.
+func (m *Manager) Ended() []*Metadata {
+	var list []*Metadata
+	for _, meta := range ListMetadata(m.opts.DataDir) {
+		if meta.EndedAt != nil {
+			list = append(list, meta)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].EndedAt.After(*list[j].EndedAt)
+	})
+	return list
+}
+
+// Metadata returns the stored record of a live or ended session.
+func (m *Manager) Metadata(id string) (*Metadata, error) {
+	meta, err := LoadMetadata(m.opts.DataDir, id)
+	if err != nil {
+		return nil, fmt.Errorf("session %s not found", id)
+	}
+	return meta, nil
 }
 
+// Delete terminates a live session, keeping its record and history so it
+// can be replayed. Deleting an ended session removes its files.
 func (m *Manager) Delete(id string) error {
 	m.mu.Lock()
 	s, ok := m.sessions[id]
 	if !ok {
 		m.mu.Unlock()
-		return fmt.Errorf("session %s not found", id)
+		return m.purge(id)
 	}
 	delete(m.sessions, id)
 	m.mu.Unlock()
@@ -116,6 +308,31 @@ func (m *Manager) CloseAll() {
 	}
 }
 
+func (m *Manager) purge(id string) error {
+	meta, err := LoadMetadata(m.opts.DataDir, id)
+	if err != nil || meta.EndedAt == nil {
+		return fmt.Errorf("session %s not found", id)
+	}
+	RemoveHistory(m.opts.DataDir, id)
+	RemoveRecording(m.opts.DataDir, id)
+	RemoveMetadata(m.opts.DataDir, id)
+	os.Remove(filepath.Join(m.opts.DataDir, id+".supervisor.log"))
+	os.Remove(screenPath(m.opts.DataDir, id))
+	return nil
+}
+
+// DetachAll disconnects from every session without terminating the shells;
+// they keep running under their supervisors until a server re-attaches.
+func (m *Manager) DetachAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.detached = true
+	for id, s := range m.sessions {
+		s.Detach()
+		delete(m.sessions, id)
+	}
+}
+
 func (m *Manager) DataDir() string {
-	return m.dataDir
+	return m.opts.DataDir
 }
@@ -0,0 +1,150 @@
+package session
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/cgroup"
+)
+
+// Metadata is the on-disk record of a session, stored as <id>.json next to
+// its history. It outlives the shell so ended sessions can be browsed and
+// replayed.
+type Metadata struct {
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	Template     string            `json:"template,omitempty"`
+	Owner        string            `json:"owner,omitempty"`
+	Shell        string            `json:"shell"`
+	Args         []string          `json:"args,omitempty"`
+	Dir          string            `json:"dir,omitempty"`
+	Env          map[string]string `json:"env,omitempty"`
+	RunAs        string            `json:"runAs,omitempty"` // account the process runs as, if not the server's
+	Cgroup       string            `json:"cgroup,omitempty"`
+	Limits       *cgroup.Limits    `json:"limits,omitempty"`
+	CreatedAt    time.Time         `json:"createdAt"`
+	LastActiveAt time.Time         `json:"lastActiveAt"`
+	EndedAt      *time.Time        `json:"endedAt,omitempty"`
+	ExitCode     *int              `json:"exitCode,omitempty"`
+}
+
+func metadataPath(dataDir, sessionID string) string {
+	return filepath.Join(dataDir, sessionID+".json")
+}
+
+func LoadMetadata(dataDir, sessionID string) (*Metadata, error) {
+	b, err := os.ReadFile(metadataPath(dataDir, sessionID))
+	if err != nil {
+		return nil, err
+	}
+	var m Metadata
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// SaveMetadata writes m atomically so a concurrent reader never sees a
+// partial record.
+func SaveMetadata(dataDir string, m *Metadata) error {
+	if err := os.MkdirAll(dataDir, 0o700); err != nil {
+		return err
+	}
+	unlock, err := lockMetadata(dataDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeMetadata(dataDir, m)
+}
+
+func writeMetadata(dataDir string, m *Metadata) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dataDir, m.ID+".json.tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), metadataPath(dataDir, m.ID))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// lockMetadata takes an exclusive lock on the records in dataDir, which
+// the server and the supervisors update from different processes.
+func lockMetadata(dataDir string) (unlock func(), err error) {
+	d, err := os.Open(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(d.Fd()), syscall.LOCK_EX); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return func() { d.Close() }, nil
+}
+
+// updateMetadata applies fn to the stored record of sessionID. Both the
+// server and the session's supervisor update the same file, so the read,
+// change and write happen under lockMetadata.
+func updateMetadata(dataDir, sessionID string, fn func(m *Metadata)) error {
+	unlock, err := lockMetadata(dataDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	m, err := LoadMetadata(dataDir, sessionID)
+	if err != nil {
+		return err
+	}
+	fn(m)
+	return writeMetadata(dataDir, m)
+}
+
+// markEnded records the end of a session unless it is already recorded.
+// A nil code means the exit status is unknown.
+func markEnded(dataDir, sessionID string, code *int) error {
+	return updateMetadata(dataDir, sessionID, func(m *Metadata) {
+		if m.EndedAt != nil {
+			return
+		}
+		now := time.Now()
+		m.EndedAt = &now
+		m.ExitCode = code
+	})
+}
+
+// ListMetadata returns the records of all sessions in dataDir, oldest first.
+func ListMetadata(dataDir string) []*Metadata {
+	paths, _ := filepath.Glob(filepath.Join(dataDir, "*.json"))
+	list := make([]*Metadata, 0, len(paths))
+	for _, path := range paths {
+		id := strings.TrimSuffix(filepath.Base(path), ".json")
+		if m, err := LoadMetadata(dataDir, id); err == nil {
+			list = append(list, m)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+func RemoveMetadata(dataDir, sessionID string) {
+	os.Remove(metadataPath(dataDir, sessionID))
+}
@@ -0,0 +1,153 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Recorder writes a session's output and resize events to <id>.cast in
+// asciicast v2 format. Event times are relative to the session's creation,
+// so a recording resumed after a server restart stays on one timeline.
+// Events that would take the file past its size cap are dropped.
+type Recorder struct {
+	mu      sync.Mutex
+	id      string
+	f       *os.File
+	start   time.Time
+	size    int64
+	maxSize int64  // 0 = unlimited
+	pending []byte // incomplete trailing UTF-8 sequence of the last output
+}
+
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+func RecordingPath(dataDir, sessionID string) string {
+	return filepath.Join(dataDir, sessionID+".cast")
+}
+
+// OpenRecording opens the recording of a session for appending, writing the
+// asciicast header if the recording is new. It records until the file
+// reaches maxSize bytes (0 = unlimited).
+func OpenRecording(dataDir string, meta *Metadata, rows, cols int, maxSize int64) (*Recorder, error) {
+	path := RecordingPath(dataDir, meta.ID)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{id: meta.ID, f: f, start: meta.CreatedAt, maxSize: maxSize}
+	if info, err := f.Stat(); err == nil {
+		r.size = info.Size()
+	}
+
+	if r.size == 0 {
+		hdr, _ := json.Marshal(castHeader{
+			Version:   2,
+			Width:     cols,
+			Height:    rows,
+			Timestamp: meta.CreatedAt.Unix(),
+			Title:     meta.Name,
+			Env:       map[string]string{"SHELL": meta.Shell, "TERM": "xterm-256color"},
+		})
+		if _, err := f.Write(append(hdr, '\n')); err != nil {
+			f.Close()
+			return nil, err
+		}
+		r.size = int64(len(hdr) + 1)
+	}
+	if r.full() {
+		r.stop()
+	}
+	return r, nil
+}
+
+// Output records a chunk of terminal output. Multi-byte characters split
+// across chunks are held back until complete, as asciicast events must be
+// valid UTF-8.
+func (r *Recorder) Output(data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.pending) > 0 {
+		data = append(r.pending, data...)
+		r.pending = nil
+	}
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	if cut < len(data) {
+		r.pending = append([]byte(nil), data[cut:]...)
+	}
+	if cut > 0 {
+		r.event("o", string(data[:cut]))
+	}
+}
+
+func (r *Recorder) Resize(rows, cols uint16) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// event appends one event line. Called with r.mu held.
+func (r *Recorder) event(kind, data string) {
+	if r.f == nil {
+		return
+	}
+	t := time.Since(r.start).Seconds()
+	line, err := json.Marshal([]any{json.Number(fmt.Sprintf("%.6f", t)), kind, data})
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	if r.maxSize > 0 && r.size+int64(len(line)) > r.maxSize {
+		r.stop()
+		return
+	}
+	n, _ := r.f.Write(line)
+	r.size += int64(n)
+}
+
+func (r *Recorder) full() bool {
+	return r.maxSize > 0 && r.size >= r.maxSize
+}
+
+// stop closes the recording once it has reached its size cap. Called with
+// r.mu held.
+func (r *Recorder) stop() {
+	log.Printf("session %s: recording reached %d bytes, no longer recording", r.id, r.maxSize)
+	r.f.Close()
+	r.f = nil
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+func RemoveRecording(dataDir, sessionID string) {
+	os.Remove(RecordingPath(dataDir, sessionID))
+}
@@ -0,0 +1,107 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/vt"
+)
+
+// replayLimit bounds how much output is replayed from history to rebuild a
+// session's screen model when the server attaches to it.
+const replayLimit = 1 << 20
+
+// screenState heads <id>.screen, which holds the screen model of a session
+// as the server last saw it: its size, how far into the history it went,
+// and a snapshot of the screen.
+type screenState struct {
+	Rows   int   `json:"rows"`
+	Cols   int   `json:"cols"`
+	Seq    int   `json:"seq"`
+	Offset int64 `json:"offset"`
+}
+
+func screenPath(dataDir, id string) string {
+	return filepath.Join(dataDir, id+".screen")
+}
+
+// saveScreen persists the screen model of s. Called from readPTY, which
+// alone writes to the history and screen, so the two agree.
+func (s *Session) saveScreen() {
+	if s.history == nil {
+		return
+	}
+	var st screenState
+	st.Seq, st.Offset = s.history.Position()
+	s.mu.Lock()
+	st.Rows, st.Cols = s.screen.Size()
+	snapshot := s.screen.Snapshot(s.scrollback)
+	s.mu.Unlock()
+
+	hdr, _ := json.Marshal(st)
+	f, err := os.CreateTemp(s.dataDir, s.ID+".screen.tmp-*")
+	if err == nil {
+		_, err = f.Write(append(append(hdr, '\n'), snapshot...))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), screenPath(s.dataDir, s.ID))
+		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		log.Printf("session %s: save screen: %v", s.ID, err)
+	}
+}
+
+func loadScreen(dataDir, id string) (screenState, []byte, error) {
+	var st screenState
+	data, err := os.ReadFile(screenPath(dataDir, id))
+	if err != nil {
+		return st, nil, err
+	}
+	hdr, snapshot, ok := bytes.Cut(data, []byte{'\n'})
+	if !ok || json.Unmarshal(hdr, &st) != nil || st.Rows <= 0 || st.Cols <= 0 {
+		return st, nil, errors.New("invalid screen state")
+	}
+	return st, snapshot, nil
+}
+
+// restoreScreen rebuilds the screen model of session id at rows x cols: the
+// saved screen plus the output since, replayed at the size it was saved
+// at, or failing that the last replayLimit bytes of history.
+func restoreScreen(dataDir, id string, rows, cols, scrollback int) *vt.Screen {
+	tail := historyTail(dataDir, id, replayLimit)
+	if st, snapshot, err := loadScreen(dataDir, id); err == nil && st.Seq >= tail {
+		if r, err := openHistoryAt(dataDir, id, st.Seq, st.Offset); err == nil {
+			data, err := io.ReadAll(io.LimitReader(r, replayLimit+1))
+			r.Close()
+			if err == nil && len(data) <= replayLimit {
+				screen := vt.NewScreen(st.Rows, st.Cols, scrollback)
+				screen.Write(snapshot)
+				screen.Write(data)
+				screen.Resize(rows, cols)
+				return screen
+			}
+		}
+	}
+
+	screen := vt.NewScreen(rows, cols, scrollback)
+	if r, err := openHistoryAt(dataDir, id, tail, 0); err == nil {
+		data, _ := io.ReadAll(r)
+		r.Close()
+		if len(data) > replayLimit {
+			data = data[len(data)-replayLimit:]
+		}
+		screen.Write(data)
+	}
+	return screen
+}
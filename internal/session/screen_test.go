@@ -0,0 +1,62 @@
+package session
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/vt"
+)
+
+func newTestSession(t *testing.T, rows, cols int) *Session {
+	t.Helper()
+	dir := t.TempDir()
+	h, err := OpenHistory(dir, "s1", HistoryOptions{SegmentSize: 64 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return &Session{ID: "s1", dataDir: dir, history: h, screen: vt.NewScreen(rows, cols, 100), scrollback: 100}
+}
+
+func (s *Session) output(data string) {
+	s.history.Write([]byte(data))
+	s.screen.Write([]byte(data))
+}
+
+func TestRestoreScreenFromSavedState(t *testing.T) {
+	s := newTestSession(t, 5, 20)
+	s.output("\x1b[?1049h\x1b[31mfull screen app")
+	s.saveScreen()
+	s.output("\r\nmore output")
+
+	got := restoreScreen(s.dataDir, s.ID, 5, 20, 100)
+	if !bytes.Equal(got.Snapshot(100), s.screen.Snapshot(100)) {
+		t.Errorf("restored screen differs:\n got %q\nwant %q", got.Snapshot(100), s.screen.Snapshot(100))
+	}
+
+	// Output is replayed at the size it was produced at, then resized.
+	got = restoreScreen(s.dataDir, s.ID, 10, 40, 100)
+	s.screen.Resize(10, 40)
+	if !bytes.Equal(got.Snapshot(100), s.screen.Snapshot(100)) {
+		t.Errorf("resized screen differs:\n got %q\nwant %q", got.Snapshot(100), s.screen.Snapshot(100))
+	}
+}
+
+func TestRestoreScreenReplaysBoundedTail(t *testing.T) {
+	s := newTestSession(t, 5, 20)
+	// A state followed by more output than replayLimit is not used.
+	s.output("stale")
+	s.saveScreen()
+	line := strings.Repeat("x", 1000)
+	for i := 0; i < 3*replayLimit/len(line); i++ {
+		s.output(fmt.Sprintf("\r\n%06d %s", i, line))
+	}
+	s.output("\x1b[2J\x1b[Hlast")
+
+	got := restoreScreen(s.dataDir, s.ID, 5, 20, 100)
+	if !bytes.Equal(got.Snapshot(0), s.screen.Snapshot(0)) {
+		t.Errorf("restored screen differs:\n got %q\nwant %q", got.Snapshot(0), s.screen.Snapshot(0))
+	}
+}
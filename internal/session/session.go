@@ -1,108 +1,372 @@
 package session
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
 	"log"
+	"net"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/creack/pty"
+	"github.com/shafqat-a/ai-dev-conductor/internal/cgroup"
+	"github.com/shafqat-a/ai-dev-conductor/internal/vt"
 )
 
 // Client represents a connected output consumer.
 type Client struct {
 	ch   chan []byte
 	done chan struct{}
+
+	// Until the client has caught up with its attach snapshot, output is
+	// collected in pending instead of ch. Guarded by the session's mu.
+	catchingUp bool
+	pending    []byte
 }
 
+// clientCatchUpSize bounds the output kept for a client while its attach
+// snapshot is being sent.
+const clientCatchUpSize = 4 << 20
+
 type Session struct {
 	ID        string    `json:"id"`
 	Name      string    `json:"name"`
 	CreatedAt time.Time `json:"createdAt"`
+	Owner     string    `json:"owner,omitempty"` // user who created the session
 
 	mu            sync.Mutex
-	ptmx          *os.File
-	cmd           *exec.Cmd
+	dataDir       string
+	lastActive    time.Time
+	lastSaved     time.Time
+	conn          net.Conn   // connection to the session's supervisor
+	wmu           sync.Mutex // serializes frames written to conn
 	clients       map[*Client]struct{}
-	historyFile   *os.File
+	history       *History
+	recorder      *Recorder
+	screen        *vt.Screen // guarded by mu
+	cgroup        string
+	limits        *cgroup.Limits
+	scrollback    int
 	done          chan struct{}
+	released      bool // set by Close/Detach
 	OnProcessExit func(id string)
+
+	// Counted since the server attached to the session.
+	bytesIn, bytesOut, dropped atomic.Uint64
+}
+
+// Stats describe a session's traffic since the server attached to it.
+type Stats struct {
+	ID            string
+	Clients       int
+	BytesIn       uint64 // typed into the PTY
+	BytesOut      uint64 // read from the PTY
+	DroppedChunks uint64 // output chunks skipped for clients that fell behind
 }
 
-func NewSession(id, name, shell, dataDir string) (*Session, error) {
+// activitySaveInterval throttles how often last-activity time is persisted.
+const activitySaveInterval = 30 * time.Second
+
+// NewSession records the session's metadata, starts a supervisor running
+// spec and attaches to it. An empty spec command runs the configured shell.
+func NewSession(id, name, template, owner string, spec Spec, opts Options) (*Session, error) {
+	dataDir := opts.DataDir
 	if name == "" {
 		name = id
 	}
 
-	cmd := exec.Command(shell)
-	cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+	runAs := spec.RunAs
+	if runAs == nil {
+		runAs = opts.RunAs
+	}
+	var cred *credential
+	var home string
+	if runAs != nil {
+		var err error
+		if cred, err = resolveRunAs(runAs); err != nil {
+			return nil, err
+		}
+		if err := cred.permitted(); err != nil {
+			return nil, err
+		}
+		home = cred.Home
+	}
+
+	loginShell := false
+	if spec.Command == "" {
+		spec.Command = opts.Shell
+		if cred != nil && cred.Login {
+			if cred.Shell != "" {
+				spec.Command = cred.Shell
+			}
+			loginShell = len(spec.Args) == 0
+		}
+	}
+	spec.Dir = expandHome(spec.Dir, home)
+	if spec.Dir == "" {
+		if home != "" {
+			// Like login(1), start in / if the home directory is missing.
+			spec.Dir = home
+			if _, err := os.Stat(home); err != nil {
+				spec.Dir = "/"
+			}
+		} else {
+			spec.Dir, _ = os.Getwd()
+		}
+	}
+
+	var cgroupPath string
+	var limits *cgroup.Limits
+	if opts.CgroupRoot != "" {
+		l := opts.Limits
+		if spec.Limits != nil {
+			l = spec.Limits.Merge(opts.Limits)
+		}
+		cgroupPath = filepath.Join(opts.CgroupRoot, "session-"+id)
+		if err := cgroup.Create(cgroupPath, l); err != nil {
+			return nil, fmt.Errorf("create cgroup: %w", err)
+		}
+		limits = &l
+	}
 
-	ptmx, err := pty.Start(cmd)
+	now := time.Now()
+	meta := &Metadata{
+		ID:           id,
+		Name:         name,
+		Template:     template,
+		Owner:        owner,
+		Shell:        spec.Command,
+		Args:         spec.Args,
+		Dir:          spec.Dir,
+		Env:          spec.Env,
+		Cgroup:       cgroupPath,
+		Limits:       limits,
+		CreatedAt:    now,
+		LastActiveAt: now,
+	}
+	if cred != nil {
+		meta.RunAs = cred.Username
+	}
+	if err := SaveMetadata(dataDir, meta); err != nil {
+		return nil, err
+	}
+
+	conn, err := startSupervisor(supervisorSpec{
+		ID:         id,
+		Name:       name,
+		DataDir:    dataDir,
+		CreatedAt:  now,
+		Cgroup:     cgroupPath,
+		Credential: cred,
+		LoginShell: loginShell,
+		Spec:       spec,
+	})
 	if err != nil {
+		RemoveMetadata(dataDir, id)
+		if cgroupPath != "" {
+			cgroup.Remove(cgroupPath)
+		}
 		return nil, err
 	}
+	return attach(conn, opts)
+}
 
-	hf, err := OpenHistoryFile(dataDir, id)
+// AttachSession re-attaches to the running supervisor of session id, e.g.
+// after a server restart.
+func AttachSession(id string, opts Options) (*Session, error) {
+	conn, err := net.Dial("unix", socketPath(opts.DataDir, id))
 	if err != nil {
-		ptmx.Close()
-		cmd.Process.Kill()
+		return nil, err
+	}
+	return attach(conn, opts)
+}
+
+func attach(conn net.Conn, opts Options) (*Session, error) {
+	if err := checkPeer(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("supervisor: %w", err)
+	}
+	dataDir := opts.DataDir
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(supervisorStartTimeout))
+	t, payload, err := readFrame(r)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("read supervisor hello: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	var info supervisorInfo
+	if t != frameHello || json.Unmarshal(payload, &info) != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected supervisor hello")
+	}
+
+	// Take the supervisor's output from now on, so it isn't held up while
+	// the screen model is rebuilt.
+	frames := make(chan frame, frameQueue)
+	go readFrames(r, frames)
+
+	h, err := OpenHistory(dataDir, info.ID, opts.History)
+	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
 	s := &Session{
-		ID:          id,
-		Name:        name,
-		CreatedAt:   time.Now(),
-		ptmx:        ptmx,
-		cmd:         cmd,
-		clients:     make(map[*Client]struct{}),
-		historyFile: hf,
-		done:        make(chan struct{}),
+		ID:         info.ID,
+		Name:       info.Name,
+		CreatedAt:  info.CreatedAt,
+		dataDir:    dataDir,
+		lastActive: time.Now(),
+		conn:       conn,
+		clients:    make(map[*Client]struct{}),
+		history:    h,
+		screen:     restoreScreen(dataDir, info.ID, int(info.Rows), int(info.Cols), opts.Scrollback),
+		scrollback: opts.Scrollback,
+		done:       make(chan struct{}),
+	}
+
+	// The metadata file is authoritative for anything changed after start,
+	// such as the name.
+	meta, err := LoadMetadata(dataDir, info.ID)
+	if err == nil {
+		s.Name = meta.Name
+		s.Owner = meta.Owner
+		s.lastActive = meta.LastActiveAt
+		s.cgroup = meta.Cgroup
+		s.limits = meta.Limits
+	} else {
+		meta = &Metadata{
+			ID:           info.ID,
+			Name:         info.Name,
+			CreatedAt:    info.CreatedAt,
+			LastActiveAt: s.lastActive,
+		}
+		SaveMetadata(dataDir, meta)
+	}
+
+	if opts.Record {
+		rows, cols := s.screen.Size()
+		if rec, err := OpenRecording(dataDir, meta, rows, cols, opts.RecordMax); err == nil {
+			s.recorder = rec
+		} else {
+			log.Printf("session %s: recording disabled: %v", s.ID, err)
+		}
 	}
 
-	go s.readPTY()
-	go s.waitProcess()
+	go s.readPTY(frames)
 
 	return s, nil
 }
 
-func (s *Session) readPTY() {
-	buf := make([]byte, 4096)
+// frameQueue is how many frames from the supervisor may wait for readPTY.
+const frameQueue = 256
+
+type frame struct {
+	t       frameType
+	payload []byte
+}
+
+// readFrames passes the frames read from r to frames until the connection
+// is closed.
+func readFrames(r *bufio.Reader, frames chan<- frame) {
+	defer close(frames)
 	for {
-		n, err := s.ptmx.Read(buf)
+		t, payload, err := readFrame(r)
 		if err != nil {
-			close(s.done)
 			return
 		}
-		data := make([]byte, n)
-		copy(data, buf[:n])
+		frames <- frame{t, payload}
+	}
+}
+
+// readPTY consumes the PTY output relayed by the supervisor until the shell
+// exits or the supervisor connection is lost.
+func (s *Session) readPTY(frames <-chan frame) {
+	exited := false
+	lastSave := time.Now()
+	for f := range frames {
+		t, payload := f.t, f.payload
+		if t == frameExit {
+			var info exitInfo
+			json.Unmarshal(payload, &info)
+			log.Printf("session %s: shell process exited (code %d)", s.ID, info.Code)
+			exited = true
+			break
+		}
+		if t != frameOutput {
+			continue
+		}
+		data := payload
+		s.touch()
+		s.bytesOut.Add(uint64(len(data)))
 
 		// Write to history
-		if s.historyFile != nil {
-			s.historyFile.Write(data)
+		if s.history != nil {
+			s.history.Write(data)
+		}
+		if s.recorder != nil {
+			s.recorder.Output(data)
 		}
 
-		// Broadcast to all clients
+		// Update the screen model and broadcast to all clients
 		s.mu.Lock()
+		s.screen.Write(data)
 		for c := range s.clients {
+			if c.catchingUp {
+				if len(c.pending)+len(data) <= clientCatchUpSize {
+					c.pending = append(c.pending, data...)
+				} else {
+					s.dropped.Add(1)
+				}
+				continue
+			}
 			select {
 			case c.ch <- data:
 			default:
 				// Client too slow, skip
+				s.dropped.Add(1)
 			}
 		}
 		s.mu.Unlock()
+
+		if time.Since(lastSave) >= activitySaveInterval {
+			s.saveScreen()
+			lastSave = time.Now()
+		}
 	}
-}
 
-func (s *Session) waitProcess() {
-	s.cmd.Wait()
-	log.Printf("session %s: shell process exited", s.ID)
+	// Let readFrames finish once the connection is closed.
+	go func() {
+		for range frames {
+		}
+	}()
 
-	// Close the PTY so readPTY exits and clients get notified
-	if s.ptmx != nil {
-		s.ptmx.Close()
+	s.mu.Lock()
+	released := s.released
+	s.mu.Unlock()
+	if released {
+		s.saveScreen()
+	}
+	if s.history != nil {
+		s.history.Close()
+	}
+	if s.recorder != nil {
+		s.recorder.Close()
+	}
+	close(s.done)
+	if released {
+		return
+	}
+	if !exited {
+		log.Printf("session %s: lost connection to supervisor", s.ID)
+		markEnded(s.dataDir, s.ID, nil)
+		if s.conn != nil {
+			s.conn.Close()
+		}
 	}
 
 	// Notify the manager to remove this dead session
@@ -111,24 +375,67 @@ func (s *Session) waitProcess() {
 	}
 }
 
-// AddClient registers a new output consumer and returns it.
-func (s *Session) AddClient() *Client {
+func (s *Session) writeFrame(t frameType, payload []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return writeFrame(s.conn, t, payload)
+}
+
+// AddClient registers a new output consumer. It returns the client along
+// with a snapshot of the screen taken at the moment of registration, so the
+// snapshot followed by the client's output reproduces the terminal exactly.
+// Output is held for the client until CatchUp has returned all of it, so
+// none is dropped while a large snapshot is sent.
+func (s *Session) AddClient() (*Client, []byte) {
 	c := &Client{
-		ch:   make(chan []byte, 256),
-		done: make(chan struct{}),
+		ch:         make(chan []byte, 256),
+		done:       make(chan struct{}),
+		catchingUp: true,
 	}
 	s.mu.Lock()
+	snapshot := s.screen.Snapshot(s.scrollback)
 	s.clients[c] = struct{}{}
 	s.mu.Unlock()
-	return c
+	return c, snapshot
+}
+
+// CatchUp returns the output held for c since it was added, or nothing once
+// c has caught up, after which its output goes to Output.
+func (s *Session) CatchUp(c *Client) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data := c.pending
+	c.pending = nil
+	if len(data) == 0 {
+		c.catchingUp = false
+	}
+	return data
 }
 
 // RemoveClient unregisters an output consumer.
 func (s *Session) RemoveClient(c *Client) {
 	s.mu.Lock()
+	_, ok := s.clients[c]
 	delete(s.clients, c)
 	s.mu.Unlock()
-	close(c.done)
+	// Close/Detach may already have released this client.
+	if ok {
+		close(c.done)
+	}
+}
+
+// Stats returns the session's client count and traffic counters.
+func (s *Session) Stats() Stats {
+	s.mu.Lock()
+	clients := len(s.clients)
+	s.mu.Unlock()
+	return Stats{
+		ID:            s.ID,
+		Clients:       clients,
+		BytesIn:       s.bytesIn.Load(),
+		BytesOut:      s.bytesOut.Load(),
+		DroppedChunks: s.dropped.Load(),
+	}
 }
 
 // Output returns the channel that receives PTY output for this client.
@@ -142,22 +449,78 @@ func (c *Client) Done() <-chan struct{} {
 }
 
 func (s *Session) WriteInput(data []byte) error {
-	_, err := s.ptmx.Write(data)
-	return err
+	s.touch()
+	s.bytesIn.Add(uint64(len(data)))
+	return s.writeFrame(frameInput, data)
+}
+
+// touch records activity, persisting it at most every activitySaveInterval.
+func (s *Session) touch() {
+	now := time.Now()
+	s.mu.Lock()
+	s.lastActive = now
+	save := now.Sub(s.lastSaved) >= activitySaveInterval
+	if save {
+		s.lastSaved = now
+	}
+	s.mu.Unlock()
+	if save {
+		s.saveActivity()
+	}
+}
+
+func (s *Session) saveActivity() {
+	s.mu.Lock()
+	lastActive := s.lastActive
+	s.mu.Unlock()
+	updateMetadata(s.dataDir, s.ID, func(m *Metadata) {
+		if m.EndedAt == nil {
+			m.LastActiveAt = lastActive
+		}
+	})
+}
+
+// Usage returns the session's current cgroup resource usage, or nil if it
+// has no cgroup.
+func (s *Session) Usage() *cgroup.Usage {
+	if s.cgroup == "" {
+		return nil
+	}
+	u, err := cgroup.ReadUsage(s.cgroup)
+	if err != nil {
+		return nil
+	}
+	return &u
+}
+
+// LastActive returns the time of the most recent input or output.
+func (s *Session) LastActive() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastActive
 }
 
 func (s *Session) Resize(rows, cols uint16) error {
-	return pty.Setsize(s.ptmx, &pty.Winsize{Rows: rows, Cols: cols})
+	s.mu.Lock()
+	s.screen.Resize(int(rows), int(cols))
+	s.mu.Unlock()
+	if s.recorder != nil {
+		s.recorder.Resize(rows, cols)
+	}
+	return s.writeFrame(frameResize, resizePayload(rows, cols))
 }
 
 func (s *Session) SessionDone() <-chan struct{} {
 	return s.done
 }
 
-func (s *Session) SetName(name string) {
+func (s *Session) SetName(name string) error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	s.Name = name
+	s.mu.Unlock()
+	return updateMetadata(s.dataDir, s.ID, func(m *Metadata) {
+		m.Name = name
+	})
 }
 
 func (s *Session) GetName() string {
@@ -166,16 +529,28 @@ func (s *Session) GetName() string {
 	return s.Name
 }
 
+// Close terminates the shell and releases the session.
 func (s *Session) Close() {
-	if s.ptmx != nil {
-		s.ptmx.Close()
-	}
-	if s.cmd != nil && s.cmd.Process != nil {
-		s.cmd.Process.Kill()
-	}
-	if s.historyFile != nil {
-		s.historyFile.Close()
-	}
+	s.writeFrame(frameKill, nil)
+	s.release()
+	log.Printf("session %s closed", s.ID)
+}
+
+// Detach drops the connection to the supervisor without terminating the
+// shell, so a later server process can re-attach to it.
+func (s *Session) Detach() {
+	s.saveActivity()
+	s.release()
+	log.Printf("session %s detached", s.ID)
+}
+
+func (s *Session) release() {
+	s.mu.Lock()
+	s.released = true
+	s.mu.Unlock()
+
+	s.conn.Close()
+	<-s.done // readPTY saves the screen model and closes the history
 
 	s.mu.Lock()
 	for c := range s.clients {
@@ -183,6 +558,4 @@ func (s *Session) Close() {
 	}
 	s.clients = make(map[*Client]struct{})
 	s.mu.Unlock()
-
-	log.Printf("session %s closed", s.ID)
 }
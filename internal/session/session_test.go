@@ -0,0 +1,44 @@
+package session
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestClientCatchesUpWithoutDrops(t *testing.T) {
+	s := newTestSession(t, 5, 20)
+	s.clients = make(map[*Client]struct{})
+	s.done = make(chan struct{})
+	frames := make(chan frame)
+	go s.readPTY(frames)
+	defer func() {
+		close(frames)
+		<-s.done
+	}()
+
+	c, _ := s.AddClient()
+	// More output than the client's channel holds arrives while the
+	// snapshot is being sent.
+	var want bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		line := fmt.Sprintf("line %d\r\n", i)
+		want.WriteString(line)
+		frames <- frame{frameOutput, []byte(line)}
+	}
+	frames <- frame{frameResize, nil} // processed only after the output before it
+
+	if got := s.CatchUp(c); !bytes.Equal(got, want.Bytes()) {
+		t.Fatalf("caught up with %d bytes, want %d", len(got), want.Len())
+	}
+	if got := s.CatchUp(c); len(got) != 0 {
+		t.Fatalf("second catch-up returned %q", got)
+	}
+	frames <- frame{frameOutput, []byte("live")}
+	if got := <-c.Output(); string(got) != "live" {
+		t.Errorf("live output = %q", got)
+	}
+	if n := s.Stats().DroppedChunks; n != 0 {
+		t.Errorf("%d chunks dropped", n)
+	}
+}
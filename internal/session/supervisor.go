@@ -0,0 +1,464 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/cgroup"
+)
+
+// SupervisorCommand is the argv[1] that makes the conductor binary run as a
+// session supervisor instead of the HTTP server.
+//
+// Each session's shell is owned by its own supervisor process, detached from
+// the server with setsid. The supervisor holds the PTY and serves it over a
+// Unix socket in the data directory, so the server can restart (or crash)
+// and re-attach to running shells on startup.
+const SupervisorCommand = "supervise"
+
+const (
+	supervisorStartTimeout = 5 * time.Second
+	supervisorWriteTimeout = 10 * time.Second
+	// Output produced while no server is attached is kept up to this size and
+	// flushed on the next attach.
+	supervisorBacklogSize = 1 << 20
+)
+
+// supervisorSpec is passed to a new supervisor on stdin.
+type supervisorSpec struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	DataDir   string    `json:"dataDir"`
+	CreatedAt time.Time `json:"createdAt"`
+	Cgroup    string    `json:"cgroup,omitempty"`
+	// Credential is the account to run the command as; nil keeps the
+	// server's. LoginShell starts the command as a login shell.
+	Credential *credential `json:"credential,omitempty"`
+	LoginShell bool        `json:"loginShell,omitempty"`
+	Spec
+}
+
+// supervisorInfo is sent in the hello frame on every attach.
+type supervisorInfo struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	PID       int       `json:"pid"`
+	CreatedAt time.Time `json:"createdAt"`
+	Rows      uint16    `json:"rows"`
+	Cols      uint16    `json:"cols"`
+}
+
+type exitInfo struct {
+	Code int `json:"code"`
+}
+
+func socketPath(dataDir, sessionID string) string {
+	return filepath.Join(dataDir, sessionID+".sock")
+}
+
+// startSupervisor spawns a detached supervisor for spec and returns the
+// first connection to its socket.
+func startSupervisor(spec supervisorSpec) (net.Conn, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("locate executable: %w", err)
+	}
+	if err := os.MkdirAll(spec.DataDir, 0o700); err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	logFile, err := os.OpenFile(filepath.Join(spec.DataDir, spec.ID+".supervisor.log"),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(exe, SupervisorCommand)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start supervisor: %w", err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		// Reap the supervisor if it exits while we're still running.
+		cmd.Wait()
+		close(exited)
+	}()
+
+	path := socketPath(spec.DataDir, spec.ID)
+	deadline := time.Now().Add(supervisorStartTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-exited:
+			return nil, fmt.Errorf("supervisor exited during startup")
+		default:
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			return conn, nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	cmd.Process.Kill()
+	return nil, fmt.Errorf("supervisor did not start within %s", supervisorStartTimeout)
+}
+
+type supervisor struct {
+	spec supervisorSpec
+	ptmx *os.File
+	cmd  *exec.Cmd
+
+	mu      sync.Mutex
+	conn    net.Conn
+	backlog []byte
+}
+
+// RunSupervisor is the entry point of a supervisor process. It reads its
+// spec from stdin, starts the shell on a new PTY and serves it until the
+// shell exits.
+func RunSupervisor() error {
+	var spec supervisorSpec
+	if err := json.NewDecoder(os.Stdin).Decode(&spec); err != nil {
+		return fmt.Errorf("read spec: %w", err)
+	}
+	log.SetPrefix(fmt.Sprintf("supervisor %s: ", spec.ID))
+
+	path := socketPath(spec.DataDir, spec.ID)
+	os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	os.Chmod(path, 0o600)
+
+	cmd := exec.Command(spec.Command, spec.Args...)
+	cmd.Dir = spec.Dir
+	env := os.Environ()
+	if spec.Credential != nil {
+		env = spec.Credential.environ(env)
+	}
+	cmd.Env = environ(env, spec.Env)
+	if spec.LoginShell {
+		cmd.Args[0] = loginArgv0(spec.Command)
+	}
+	var size *pty.Winsize
+	if spec.Rows > 0 && spec.Cols > 0 {
+		size = &pty.Winsize{Rows: spec.Rows, Cols: spec.Cols}
+	}
+	ptmx, err := startShell(cmd, size, spec.Cgroup, spec.Credential)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	if spec.StartupInput != "" {
+		ptmx.Write([]byte(spec.StartupInput))
+	}
+
+	sv := &supervisor{spec: spec, ptmx: ptmx, cmd: cmd}
+	go sv.acceptLoop(ln)
+
+	readDone := make(chan struct{})
+	go func() {
+		sv.readPTY()
+		close(readDone)
+	}()
+
+	code := 0
+	if err := cmd.Wait(); err != nil {
+		code = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			code = exitErr.ExitCode()
+		}
+	}
+	log.Printf("shell exited with code %d", code)
+	if spec.Cgroup != "" {
+		// Take down anything the shell left running, then the cgroup itself.
+		if err := cgroup.Remove(spec.Cgroup); err != nil {
+			log.Printf("remove cgroup: %v", err)
+		}
+	}
+	if err := markEnded(spec.DataDir, spec.ID, &code); err != nil {
+		log.Printf("record exit status: %v", err)
+	}
+
+	// Give the reader a moment to drain what the shell wrote before exiting,
+	// then close the PTY in case a background job still holds the tty open.
+	select {
+	case <-readDone:
+	case <-time.After(500 * time.Millisecond):
+	}
+	ptmx.Close()
+	<-readDone
+	ln.Close()
+
+	payload, _ := json.Marshal(exitInfo{Code: code})
+	sv.mu.Lock()
+	if sv.conn != nil {
+		sv.conn.SetWriteDeadline(time.Now().Add(supervisorWriteTimeout))
+		writeFrame(sv.conn, frameExit, payload)
+		sv.conn.Close()
+		sv.conn = nil
+	}
+	sv.mu.Unlock()
+	return nil
+}
+
+// startShell starts cmd on a new PTY, as cred's account if set. With a
+// cgroup, the shell is cloned directly into it so not even its first fork
+// escapes the limits; kernels without clone-into-cgroup fall back to moving
+// it right after start.
+func startShell(cmd *exec.Cmd, size *pty.Winsize, cgroupPath string, cred *credential) (*os.File, error) {
+	attr := &syscall.SysProcAttr{}
+	if cred != nil {
+		attr.Credential = cred.sysCredential()
+	}
+	if cgroupPath == "" {
+		return startPTY(cmd, attr, size, cred)
+	}
+	dir, err := os.Open(cgroupPath)
+	if err != nil {
+		return nil, fmt.Errorf("open cgroup: %w", err)
+	}
+	defer dir.Close()
+
+	cloneAttr := *attr
+	cloneAttr.UseCgroupFD, cloneAttr.CgroupFD = true, int(dir.Fd())
+	ptmx, err := startPTY(cmd, &cloneAttr, size, cred)
+	if err == nil {
+		return ptmx, nil
+	}
+	log.Printf("clone into cgroup failed (%v), moving shell after start", err)
+
+	retry := exec.Command(cmd.Path)
+	retry.Args, retry.Dir, retry.Env = cmd.Args, cmd.Dir, cmd.Env
+	*cmd = *retry
+	ptmx, err = startPTY(cmd, attr, size, cred)
+	if err != nil {
+		return nil, err
+	}
+	if err := cgroup.AddProcess(cgroupPath, cmd.Process.Pid); err != nil {
+		cmd.Process.Kill()
+		ptmx.Close()
+		return nil, fmt.Errorf("join cgroup: %w", err)
+	}
+	return ptmx, nil
+}
+
+// startPTY starts cmd as the session leader of a new PTY, like
+// pty.StartWithAttrs, but first hands the terminal device to cred's account
+// so the shell can reopen /dev/tty after dropping privileges.
+func startPTY(cmd *exec.Cmd, attr *syscall.SysProcAttr, size *pty.Winsize, cred *credential) (*os.File, error) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+	if size != nil {
+		if err := pty.Setsize(ptmx, size); err != nil {
+			ptmx.Close()
+			return nil, err
+		}
+	}
+	if cred != nil {
+		if err := os.Chown(tty.Name(), int(cred.UID), -1); err != nil {
+			ptmx.Close()
+			return nil, fmt.Errorf("chown tty: %w", err)
+		}
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	attr.Setsid, attr.Setctty = true, true
+	cmd.SysProcAttr = attr
+	if err := cmd.Start(); err != nil {
+		ptmx.Close()
+		return nil, err
+	}
+	return ptmx, nil
+}
+
+// acceptLoop attaches servers connecting to the socket. Only processes of
+// the account the supervisor runs as, which is the server's, may attach.
+func (sv *supervisor) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		if err := checkPeer(conn); err != nil {
+			log.Printf("refused connection: %v", err)
+			conn.Close()
+			continue
+		}
+		sv.attach(conn)
+	}
+}
+
+// checkPeer checks that the process at the other end of conn runs as the
+// same account as this one.
+func checkPeer(conn net.Conn) error {
+	uid, err := peerUID(conn)
+	if err != nil {
+		return fmt.Errorf("peer credentials: %w", err)
+	}
+	if uid != uint32(os.Geteuid()) {
+		return fmt.Errorf("peer runs as uid %d", uid)
+	}
+	return nil
+}
+
+// peerUID returns the uid of the process that connected the Unix socket
+// conn, as recorded by the kernel.
+func peerUID(conn net.Conn) (uint32, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, fmt.Errorf("not a Unix socket")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *syscall.Ucred
+	cerr := raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return cred.Uid, nil
+}
+
+// attach makes conn the active server connection, replacing any previous
+// one, and replays output buffered while detached.
+func (sv *supervisor) attach(conn net.Conn) {
+	info := supervisorInfo{
+		ID:        sv.spec.ID,
+		Name:      sv.spec.Name,
+		PID:       sv.cmd.Process.Pid,
+		CreatedAt: sv.spec.CreatedAt,
+	}
+	if ws, err := pty.GetsizeFull(sv.ptmx); err == nil {
+		info.Rows, info.Cols = ws.Rows, ws.Cols
+	}
+	hello, _ := json.Marshal(info)
+
+	sv.mu.Lock()
+	if sv.conn != nil {
+		log.Printf("server attachment replaced")
+		sv.conn.Close()
+		sv.conn = nil
+	}
+	conn.SetWriteDeadline(time.Now().Add(supervisorWriteTimeout))
+	err := writeFrame(conn, frameHello, hello)
+	if err == nil && len(sv.backlog) > 0 {
+		if err = writeFrame(conn, frameOutput, sv.backlog); err == nil {
+			sv.backlog = nil
+		}
+	}
+	if err == nil {
+		sv.conn = conn
+	}
+	sv.mu.Unlock()
+
+	if err == nil {
+		log.Printf("server attached")
+	}
+	// Even a server that has hung up may have sent frames first, such as
+	// a kill right after creating the session.
+	go sv.serve(conn)
+}
+
+func (sv *supervisor) detach(conn net.Conn) {
+	sv.mu.Lock()
+	if sv.conn == conn {
+		sv.conn = nil
+		log.Printf("server detached")
+	}
+	sv.mu.Unlock()
+	conn.Close()
+}
+
+// serve handles frames sent by the server.
+func (sv *supervisor) serve(conn net.Conn) {
+	defer sv.detach(conn)
+	r := bufio.NewReader(conn)
+	for {
+		t, payload, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		switch t {
+		case frameInput:
+			sv.ptmx.Write(payload)
+		case frameResize:
+			if rows, cols, ok := parseResizePayload(payload); ok {
+				pty.Setsize(sv.ptmx, &pty.Winsize{Rows: rows, Cols: cols})
+			}
+		case frameKill:
+			sv.cmd.Process.Kill()
+		}
+	}
+}
+
+// hangUp stops sending to conn but leaves it to serve to close, so frames
+// the server sent before it went away, such as a kill, are still read.
+func hangUp(conn net.Conn) {
+	if uc, ok := conn.(*net.UnixConn); ok && uc.CloseWrite() == nil {
+		return
+	}
+	conn.Close()
+}
+
+// readPTY forwards shell output to the attached server, or buffers it while
+// none is attached.
+func (sv *supervisor) readPTY() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := sv.ptmx.Read(buf)
+		if n > 0 {
+			sv.forward(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (sv *supervisor) forward(data []byte) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if sv.conn != nil {
+		sv.conn.SetWriteDeadline(time.Now().Add(supervisorWriteTimeout))
+		if err := writeFrame(sv.conn, frameOutput, data); err == nil {
+			return
+		}
+		hangUp(sv.conn)
+		sv.conn = nil
+	}
+	sv.backlog = append(sv.backlog, data...)
+	if over := len(sv.backlog) - supervisorBacklogSize; over > 0 {
+		sv.backlog = sv.backlog[over:]
+	}
+}
@@ -0,0 +1,245 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain lets the test binary stand in for the conductor binary when a
+// test starts a session supervisor.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == SupervisorCommand {
+		if err := RunSupervisor(); err != nil {
+			log.Fatalf("supervisor: %v", err)
+		}
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []struct {
+		t       frameType
+		payload []byte
+	}{
+		{frameHello, []byte(`{"id":"s1"}`)},
+		{frameOutput, bytes.Repeat([]byte("x"), 70000)},
+		{frameInput, nil},
+		{frameResize, resizePayload(24, 80)},
+		{frameKill, []byte{}},
+	}
+	var buf bytes.Buffer
+	for _, f := range frames {
+		if err := writeFrame(&buf, f.t, f.payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := bufio.NewReader(&buf)
+	for _, want := range frames {
+		typ, payload, err := readFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != want.t || !bytes.Equal(payload, want.payload) {
+			t.Errorf("read frame %c with %d bytes, want %c with %d", typ, len(payload), want.t, len(want.payload))
+		}
+	}
+	if _, _, err := readFrame(r); err == nil {
+		t.Error("read past the last frame")
+	}
+	if rows, cols, ok := parseResizePayload(resizePayload(24, 80)); !ok || rows != 24 || cols != 80 {
+		t.Errorf("resize payload = %d, %d, %v", rows, cols, ok)
+	}
+}
+
+func TestReadFrameRejectsOversizedPayload(t *testing.T) {
+	hdr := []byte{byte(frameOutput), 0xff, 0xff, 0xff, 0xff}
+	if _, _, err := readFrame(bufio.NewReader(bytes.NewReader(hdr))); err == nil {
+		t.Error("oversized frame accepted")
+	}
+}
+
+func TestPeerUID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peer.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	for _, conn := range []net.Conn{client, server} {
+		if uid, err := peerUID(conn); err != nil || uid != uint32(os.Geteuid()) {
+			t.Errorf("peerUID = %d, %v; want %d", uid, err, os.Geteuid())
+		}
+		if err := checkPeer(conn); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := peerUID(&net.TCPConn{}); err == nil {
+		t.Error("peerUID of a TCP connection succeeded")
+	}
+}
+
+// closeOnCleanup closes the sessions of m when the test ends and waits for
+// their supervisors to exit, so they are done with the data directory.
+func closeOnCleanup(t *testing.T, m *Manager) {
+	t.Cleanup(func() {
+		m.CloseAll()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if socks, _ := filepath.Glob(filepath.Join(m.DataDir(), "*.sock")); len(socks) == 0 {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Error("supervisors still running")
+	})
+}
+
+// addClient adds a client to s and returns it with the snapshot and the
+// output it caught up with.
+func addClient(s *Session) (*Client, []byte) {
+	c, seen := s.AddClient()
+	for pending := s.CatchUp(c); len(pending) > 0; pending = s.CatchUp(c) {
+		seen = append(seen, pending...)
+	}
+	return c, seen
+}
+
+// waitOutput reads c's output until it contains want.
+func waitOutput(t *testing.T, c *Client, seen []byte, want string) []byte {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for !bytes.Contains(seen, []byte(want)) {
+		select {
+		case b := <-c.Output():
+			seen = append(seen, b...)
+		case <-timeout:
+			t.Fatalf("no %q in output %q", want, seen)
+		}
+	}
+	return seen
+}
+
+func TestSupervisorReattach(t *testing.T) {
+	opts := Options{Shell: "/bin/sh", DataDir: t.TempDir(), Scrollback: 100}
+	m := NewManager(opts)
+	s, err := m.Create("test", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := addClient(s)
+	s.WriteInput([]byte("echo one-$((1+1))\n"))
+	waitOutput(t, c, nil, "one-2")
+
+	// Output produced while no server is attached is kept for the next one.
+	s.WriteInput([]byte("sleep 0.5; echo two-$((1+2))\n"))
+	m.DetachAll()
+	time.Sleep(time.Second)
+
+	m = NewManager(opts)
+	closeOnCleanup(t, m)
+	if n := m.Recover(); n != 1 {
+		t.Fatalf("recovered %d sessions, want 1", n)
+	}
+	s, ok := m.Get(s.ID)
+	if !ok {
+		t.Fatal("session not recovered")
+	}
+	c, seen := addClient(s)
+	waitOutput(t, c, seen, "two-3")
+	s.WriteInput([]byte("echo three-$((1+3))\n"))
+	waitOutput(t, c, nil, "three-4")
+
+	r, err := OpenHistoryReader(opts.DataDir, s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var history strings.Builder
+	bufio.NewReader(r).WriteTo(&history)
+	for _, want := range []string{"one-2", "two-3", "three-4"} {
+		if !strings.Contains(history.String(), want) {
+			t.Errorf("history is missing %q: %q", want, history.String())
+		}
+	}
+}
+
+func TestSupervisorSocketIsPrivate(t *testing.T) {
+	opts := Options{Shell: "/bin/sh", DataDir: t.TempDir()}
+	m := NewManager(opts)
+	closeOnCleanup(t, m)
+	s, err := m.Create("test", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(socketPath(opts.DataDir, s.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("socket mode = %o, want 600", perm)
+	}
+}
+
+func TestSupervisorReadsKillAfterOutputFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	server, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	sv := &supervisor{cmd: cmd, conn: conn}
+
+	// The server closes the session and hangs up while the shell is still
+	// writing; forwarding that output fails before the kill has been read.
+	writeFrame(server, frameKill, nil)
+	server.Close()
+	sv.forward([]byte("late output"))
+	sv.serve(conn)
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("kill frame lost")
+	}
+	if string(sv.backlog) != "late output" {
+		t.Errorf("backlog = %q", sv.backlog)
+	}
+}
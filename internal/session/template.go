@@ -0,0 +1,113 @@
+package session
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/cgroup"
+	"github.com/shafqat-a/ai-dev-conductor/internal/runas"
+)
+
+// Spec describes the process a session runs and how its terminal starts.
+type Spec struct {
+	Command      string            `json:"command,omitempty"` // defaults to the configured shell
+	Args         []string          `json:"args,omitempty"`
+	Dir          string            `json:"dir,omitempty"` // "~" expands to the home directory
+	Env          map[string]string `json:"env,omitempty"` // overrides on top of the server's environment
+	Rows         uint16            `json:"rows,omitempty"`
+	Cols         uint16            `json:"cols,omitempty"`
+	StartupInput string            `json:"startupInput,omitempty"` // typed into the terminal once started
+	Limits       *cgroup.Limits    `json:"limits,omitempty"`       // overrides the default cgroup limits
+	RunAs        *runas.Account    `json:"runAs,omitempty"`        // overrides the default account
+}
+
+// Template is a named, reusable Spec selectable when creating a session.
+type Template struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Spec
+}
+
+// ErrUnknownTemplate is returned by Manager.Create for an undefined template.
+type ErrUnknownTemplate string
+
+func (e ErrUnknownTemplate) Error() string {
+	return fmt.Sprintf("unknown template %q", string(e))
+}
+
+// ValidateTemplates checks a set of templates for missing or duplicate
+// names and unusable sizes.
+func ValidateTemplates(templates []Template) error {
+	seen := make(map[string]bool, len(templates))
+	for _, t := range templates {
+		if t.Name == "" {
+			return fmt.Errorf("template without a name")
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("duplicate template %q", t.Name)
+		}
+		seen[t.Name] = true
+		if (t.Rows == 0) != (t.Cols == 0) {
+			return fmt.Errorf("template %q: rows and cols must be set together", t.Name)
+		}
+		if t.RunAs != nil && t.RunAs.User == "" {
+			return fmt.Errorf("template %q: runAs needs a user", t.Name)
+		}
+	}
+	return nil
+}
+
+func sortedTemplates(templates map[string]Template) []Template {
+	list := make([]Template, 0, len(templates))
+	for _, t := range templates {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// expandHome resolves a leading "~" in dir against home, or the server's
+// home directory if home is empty.
+func expandHome(dir, home string) string {
+	if dir != "~" && !strings.HasPrefix(dir, "~/") {
+		return dir
+	}
+	if home == "" {
+		var err error
+		if home, err = os.UserHomeDir(); err != nil {
+			return dir
+		}
+	}
+	return filepath.Join(home, strings.TrimPrefix(dir, "~"))
+}
+
+// serviceEnv holds variables systemd sets for the server alone, which
+// shells must not inherit.
+var serviceEnv = map[string]bool{"NOTIFY_SOCKET": true, "WATCHDOG_USEC": true, "WATCHDOG_PID": true}
+
+// environ returns base with TERM set and overrides applied.
+func environ(base []string, overrides map[string]string) []string {
+	env := make([]string, 0, len(base)+len(overrides)+1)
+	for _, kv := range base {
+		key, _, _ := strings.Cut(kv, "=")
+		if _, ok := overrides[key]; ok || key == "TERM" || serviceEnv[key] {
+			continue
+		}
+		env = append(env, kv)
+	}
+	if _, ok := overrides["TERM"]; !ok {
+		env = append(env, "TERM=xterm-256color")
+	}
+	keys := make([]string, 0, len(overrides))
+	for k := range overrides {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, k+"="+overrides[k])
+	}
+	return env
+}
@@ -0,0 +1,138 @@
+// Package tlsconf serves TLS from certificate files, reloading them when
+// they change so renewed certificates are picked up without a restart.
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// pollInterval is how often the files are checked for changes.
+const pollInterval = 10 * time.Second
+
+// Options names the certificate files. With ClientCAFile, clients may
+// present a certificate signed by one of its CAs; RequireClientCert makes
+// that mandatory.
+type Options struct {
+	CertFile          string
+	KeyFile           string
+	ClientCAFile      string
+	RequireClientCert bool
+}
+
+// Reloader holds the current certificate and client CAs.
+type Reloader struct {
+	opts Options
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	stamp     string // modification times and sizes of the files loaded
+}
+
+// New loads the files and starts watching them.
+func New(opts Options) (*Reloader, error) {
+	r := &Reloader{opts: opts}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	go r.watch()
+	return r, nil
+}
+
+// Config returns a server TLS config that uses the latest certificate and
+// client CAs for every handshake.
+func (r *Reloader) Config() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if r.opts.ClientCAFile != "" {
+		base.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.opts.RequireClientCert {
+			base.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			c := base.Clone()
+			c.Certificates = []tls.Certificate{*r.cert}
+			c.ClientCAs = r.clientCAs
+			return c, nil
+		},
+	}
+}
+
+func (r *Reloader) watch() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		stamp, err := r.fileStamp()
+		if err != nil {
+			continue // probably mid-replacement; try again next time
+		}
+		r.mu.RLock()
+		changed := stamp != r.stamp
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := r.load(); err != nil {
+			log.Printf("tls: keeping previous certificate: %v", err)
+			continue
+		}
+		log.Printf("tls: reloaded %s", r.opts.CertFile)
+	}
+}
+
+func (r *Reloader) load() error {
+	stamp, err := r.fileStamp()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.opts.CertFile, r.opts.KeyFile)
+	if err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	var pool *x509.CertPool
+	if r.opts.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.opts.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("tls: no certificates in %s", r.opts.ClientCAFile)
+		}
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = pool
+	r.stamp = stamp
+	r.mu.Unlock()
+	return nil
+}
+
+// fileStamp identifies the current version of the files.
+func (r *Reloader) fileStamp() (string, error) {
+	var stamp string
+	for _, name := range []string{r.opts.CertFile, r.opts.KeyFile, r.opts.ClientCAFile} {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return "", fmt.Errorf("tls: %w", err)
+		}
+		stamp += fmt.Sprintf("%s:%d:%d;", name, fi.ModTime().UnixNano(), fi.Size())
+	}
+	return stamp, nil
+}
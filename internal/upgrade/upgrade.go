@@ -0,0 +1,173 @@
+// Package upgrade replaces a running server with a new binary without
+// refusing connections or killing shells.
+//
+// The old server starts the new one with its listening sockets and a
+// handoff socket. The new server loads its configuration and state and
+// does everything else that could fail, says it is ready, and waits. The
+// old server then stops accepting connections, detaches from its sessions
+// and exits, closing the handoff socket; the new server reads the state
+// again, re-attaches to the sessions' supervisors and starts serving.
+// Connections made in between wait in the listening sockets' backlog, and
+// WebSocket clients reconnect to the new server.
+package upgrade
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/listen"
+)
+
+// handoffEnv holds the descriptor of the handoff socket in the new server.
+const handoffEnv = "AI_CONDUCTOR_UPGRADE_FD"
+
+const readyLine = "ready\n"
+
+// Successor is a new server started to take over from this one.
+type Successor struct {
+	cmd  *exec.Cmd
+	conn net.Conn
+}
+
+// Start starts the server's binary, as it now is on disk, with the same
+// arguments and environment, handing it lns. The new server's output goes
+// where this one's does.
+func Start(lns []net.Listener) (*Successor, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("handoff socket: %w", err)
+	}
+	local := os.NewFile(uintptr(fds[0]), "handoff")
+	remote := os.NewFile(uintptr(fds[1]), "handoff")
+	defer remote.Close()
+	conn, err := net.FileConn(local)
+	local.Close()
+	if err != nil {
+		remote.Close()
+		return nil, fmt.Errorf("handoff socket: %w", err)
+	}
+
+	files, err := listen.Files(lns)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Listeners take descriptors 3 onwards, as with socket activation; the
+	// handoff socket comes after them.
+	cmd.ExtraFiles = append(files, remote)
+	cmd.Env = append(environ(),
+		listen.InheritEnv+"="+strconv.Itoa(len(files)),
+		handoffEnv+"="+strconv.Itoa(3+len(files)),
+	)
+	if err := cmd.Start(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Successor{cmd: cmd, conn: conn}, nil
+}
+
+// environ returns this process's environment for the new server, without
+// the watchdog's PID: the new server takes over the pings, and systemd
+// expects them from whichever process is the service's main one.
+func environ() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "WATCHDOG_PID=") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// Pid returns the new server's process ID.
+func (s *Successor) Pid() int {
+	return s.cmd.Process.Pid
+}
+
+// WaitReady waits up to timeout for the new server to be ready to take
+// over. If it isn't, it is killed and this server carries on.
+func (s *Successor) WaitReady(timeout time.Duration) error {
+	s.conn.SetReadDeadline(time.Now().Add(timeout))
+	line, err := bufio.NewReader(s.conn).ReadString('\n')
+	s.conn.SetReadDeadline(time.Time{})
+	if err == nil && line == readyLine {
+		return nil
+	}
+	s.conn.Close()
+	s.cmd.Process.Kill()
+	werr := s.cmd.Wait()
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return fmt.Errorf("new server not ready after %s", timeout)
+	case werr != nil:
+		return fmt.Errorf("new server failed to start: %v", werr)
+	}
+	return fmt.Errorf("new server failed to start")
+}
+
+// Release lets the new server take over. Call it once this server has
+// stopped accepting connections and detached from its sessions.
+func (s *Successor) Release() {
+	s.conn.Close()
+}
+
+// Predecessor is the server this one is taking over from.
+type Predecessor struct {
+	conn net.Conn
+}
+
+// Inherited returns the server this one was started by Start to replace,
+// or nil if it wasn't.
+func Inherited() (*Predecessor, error) {
+	v := os.Getenv(handoffEnv)
+	if v == "" {
+		return nil, nil
+	}
+	os.Unsetenv(handoffEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid descriptor %q", handoffEnv, v)
+	}
+	syscall.CloseOnExec(fd)
+	f := os.NewFile(uintptr(fd), "handoff")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("handoff socket: %w", err)
+	}
+	return &Predecessor{conn: conn}, nil
+}
+
+// Takeover tells the old server this one is ready, and returns once the
+// old server has let go of the sessions, or has exited. Call it once
+// nothing is left that could stop this server from starting.
+func (p *Predecessor) Takeover() error {
+	defer p.conn.Close()
+	if _, err := io.WriteString(p.conn, readyLine); err != nil {
+		return fmt.Errorf("handoff: %w", err)
+	}
+	io.Copy(io.Discard, p.conn)
+	return nil
+}
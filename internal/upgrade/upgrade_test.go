@@ -0,0 +1,154 @@
+package upgrade
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shafqat-a/ai-dev-conductor/internal/listen"
+)
+
+// modeEnv tells the test binary, started by Start, how to behave as the
+// new server: "ok" takes over and answers one connection with its pid and
+// WATCHDOG_PID, "fail" exits at once, and "hang" never gets ready.
+const modeEnv = "ADC_UPGRADE_TEST_MODE"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(handoffEnv) != "" {
+		if err := successor(os.Getenv(modeEnv)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func successor(mode string) error {
+	switch mode {
+	case "fail":
+		return fmt.Errorf("failing as asked")
+	case "hang":
+		time.Sleep(time.Minute)
+		return nil
+	}
+	lns, err := listen.Activated()
+	if err != nil {
+		return err
+	}
+	if len(lns) != 1 {
+		return fmt.Errorf("got %d listeners", len(lns))
+	}
+	pred, err := Inherited()
+	if err != nil || pred == nil {
+		return fmt.Errorf("no predecessor: %v", err)
+	}
+	if err := pred.Takeover(); err != nil {
+		return err
+	}
+	conn, err := lns[0].Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "%d %q", os.Getpid(), os.Getenv("WATCHDOG_PID"))
+	return err
+}
+
+func TestHandoff(t *testing.T) {
+	t.Setenv(modeEnv, "ok")
+	t.Setenv("WATCHDOG_PID", "1")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s, err := Start([]net.Listener{ln})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cmd.Process.Kill()
+	if err := s.WaitReady(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Until released, the new server doesn't serve; connections wait in
+	// the shared listening socket's backlog.
+	ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("connection refused during the handoff: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || !os.IsTimeout(err) {
+		t.Fatalf("served before release: %d, %v", n, err)
+	}
+
+	s.Release()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%d %q", s.Pid(), ""); string(b) != want {
+		t.Errorf("new server answered %q, want %q", b, want)
+	}
+	if err := s.cmd.Wait(); err != nil {
+		t.Errorf("new server: %v", err)
+	}
+}
+
+func TestHandoffFailures(t *testing.T) {
+	tests := []struct {
+		mode, want string
+		timeout    time.Duration
+	}{
+		{"fail", "new server failed to start: exit status 1", 10 * time.Second},
+		{"hang", "new server not ready after 200ms", 200 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			t.Setenv(modeEnv, tt.mode)
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			s, err := Start([]net.Listener{ln})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.WaitReady(tt.timeout); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("WaitReady() = %v, want %q", err, tt.want)
+			}
+			// This server carries on with its listener.
+			go func() {
+				if c, err := ln.Accept(); err == nil {
+					c.Close()
+				}
+			}()
+			c, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatalf("listener gone after a failed upgrade: %v", err)
+			}
+			c.Close()
+		})
+	}
+}
+
+func TestInheritedWithoutHandoff(t *testing.T) {
+	t.Setenv(handoffEnv, "")
+	if p, err := Inherited(); p != nil || err != nil {
+		t.Errorf("Inherited() = %v, %v", p, err)
+	}
+	t.Setenv(handoffEnv, "three")
+	if _, err := Inherited(); err == nil {
+		t.Error("bad descriptor accepted")
+	}
+}
@@ -0,0 +1,1038 @@
+// Package vt implements a server-side model of an xterm-compatible terminal
+// screen. It is fed the same byte stream as the browser terminal and can
+// render a compact snapshot of its state for reconnecting clients.
+package vt
+
+import (
+	"unicode/utf8"
+)
+
+// Color is a terminal color: DefaultColor, a palette index (0-255), or a
+// 24-bit RGB value tagged with rgbFlag.
+type Color int32
+
+const (
+	DefaultColor Color = -1
+	rgbFlag      Color = 1 << 24
+)
+
+func RGB(r, g, b uint8) Color {
+	return rgbFlag | Color(r)<<16 | Color(g)<<8 | Color(b)
+}
+
+const (
+	attrBold uint16 = 1 << iota
+	attrDim
+	attrItalic
+	attrUnderline
+	attrBlink
+	attrReverse
+	attrHidden
+	attrStrike
+)
+
+// Attr holds the graphic rendition of a cell.
+type Attr struct {
+	FG, BG Color
+	Flags  uint16
+}
+
+var defaultAttr = Attr{FG: DefaultColor, BG: DefaultColor}
+
+// Cell is one character position. A zero Ch marks the right half of a wide
+// character.
+type Cell struct {
+	Ch   rune
+	Attr Attr
+}
+
+func blankCell(a Attr) Cell {
+	return Cell{Ch: ' ', Attr: Attr{FG: DefaultColor, BG: a.BG}}
+}
+
+type line []Cell
+
+type cursor struct {
+	x, y        int
+	attr        Attr
+	originMode  bool
+	wrapPending bool
+}
+
+type buffer struct {
+	lines  []line
+	cursor cursor
+	saved  cursor
+}
+
+// Mouse tracking is stored as the DECSET mode that enabled it (9, 1000,
+// 1002 or 1003).
+const (
+	mouseNone = 0
+	mouseX10  = 9
+)
+
+// Screen is a VT100/xterm screen model: main and alternate grids, a
+// scrollback for the main grid, the cursor and the terminal modes that
+// matter for redrawing. It is not safe for concurrent use.
+type Screen struct {
+	rows, cols    int
+	maxScrollback int
+
+	main, alt  buffer
+	altActive  bool
+	scrollback []line
+
+	top, bottom int // scroll region, inclusive
+	tabs        []bool
+
+	autowrap       bool
+	insertMode     bool
+	cursorHidden   bool
+	appCursorKeys  bool
+	appKeypad      bool
+	bracketedPaste bool
+	mouseMode      int
+	mouseSGR       bool
+	focusEvents    bool
+	title          string
+
+	parser parser
+}
+
+// NewScreen returns a blank screen of the given size that keeps up to
+// scrollback lines scrolled off the top of the main grid.
+func NewScreen(rows, cols, scrollback int) *Screen {
+	if rows < 1 {
+		rows = 24
+	}
+	if cols < 1 {
+		cols = 80
+	}
+	s := &Screen{maxScrollback: scrollback}
+	s.reset(rows, cols)
+	return s
+}
+
+func (s *Screen) reset(rows, cols int) {
+	s.rows, s.cols = rows, cols
+	s.main = buffer{lines: newLines(rows, cols, defaultAttr), cursor: cursor{attr: defaultAttr}}
+	s.alt = buffer{lines: newLines(rows, cols, defaultAttr), cursor: cursor{attr: defaultAttr}}
+	s.main.saved = s.main.cursor
+	s.alt.saved = s.alt.cursor
+	s.altActive = false
+	s.scrollback = nil
+	s.top, s.bottom = 0, rows-1
+	s.resetTabs()
+	s.autowrap = true
+	s.insertMode = false
+	s.cursorHidden = false
+	s.appCursorKeys = false
+	s.appKeypad = false
+	s.bracketedPaste = false
+	s.mouseMode = mouseNone
+	s.mouseSGR = false
+	s.focusEvents = false
+	s.title = ""
+}
+
+func newLine(cols int, a Attr) line {
+	l := make(line, cols)
+	for i := range l {
+		l[i] = blankCell(a)
+	}
+	return l
+}
+
+func newLines(rows, cols int, a Attr) []line {
+	ls := make([]line, rows)
+	for i := range ls {
+		ls[i] = newLine(cols, a)
+	}
+	return ls
+}
+
+func (s *Screen) resetTabs() {
+	s.tabs = make([]bool, s.cols)
+	for i := 8; i < s.cols; i += 8 {
+		s.tabs[i] = true
+	}
+}
+
+func (s *Screen) buf() *buffer {
+	if s.altActive {
+		return &s.alt
+	}
+	return &s.main
+}
+
+func (s *Screen) cur() *cursor {
+	return &s.buf().cursor
+}
+
+// Size returns the screen dimensions.
+func (s *Screen) Size() (rows, cols int) {
+	return s.rows, s.cols
+}
+
+// Write feeds terminal output to the screen. It never fails.
+func (s *Screen) Write(p []byte) (int, error) {
+	s.parser.feed(s, p)
+	return len(p), nil
+}
+
+// Resize changes the screen dimensions. Shrinking the main grid pushes lines
+// above the cursor into the scrollback, as xterm does.
+func (s *Screen) Resize(rows, cols int) {
+	if rows < 1 || cols < 1 || (rows == s.rows && cols == s.cols) {
+		return
+	}
+	for _, b := range []*buffer{&s.main, &s.alt} {
+		isMain := b == &s.main
+		for i, l := range b.lines {
+			b.lines[i] = resizeLine(l, cols)
+		}
+		if rows < len(b.lines) {
+			// Drop lines from the top while the cursor would fall off the
+			// bottom, then from the bottom.
+			excess := len(b.lines) - rows
+			fromTop := b.cursor.y - (rows - 1)
+			if fromTop < 0 {
+				fromTop = 0
+			}
+			if fromTop > excess {
+				fromTop = excess
+			}
+			if isMain {
+				s.pushScrollback(b.lines[:fromTop]...)
+			}
+			b.lines = b.lines[fromTop : fromTop+rows]
+			b.cursor.y -= fromTop
+			b.saved.y -= fromTop
+		} else {
+			for len(b.lines) < rows {
+				b.lines = append(b.lines, newLine(cols, defaultAttr))
+			}
+		}
+		b.cursor.x = clamp(b.cursor.x, 0, cols-1)
+		b.cursor.y = clamp(b.cursor.y, 0, rows-1)
+		b.saved.x = clamp(b.saved.x, 0, cols-1)
+		b.saved.y = clamp(b.saved.y, 0, rows-1)
+		b.cursor.wrapPending = false
+	}
+	s.rows, s.cols = rows, cols
+	s.top, s.bottom = 0, rows-1
+	s.resetTabs()
+}
+
+func resizeLine(l line, cols int) line {
+	if len(l) >= cols {
+		l = l[:cols]
+		if n := len(l); n > 0 && isWide(l[n-1].Ch) {
+			l[n-1] = blankCell(l[n-1].Attr)
+		}
+		return l
+	}
+	for len(l) < cols {
+		l = append(l, blankCell(defaultAttr))
+	}
+	return l
+}
+
+func (s *Screen) pushScrollback(ls ...line) {
+	if s.maxScrollback <= 0 {
+		return
+	}
+	for _, l := range ls {
+		cp := make(line, len(l))
+		copy(cp, l)
+		s.scrollback = append(s.scrollback, cp)
+	}
+	if over := len(s.scrollback) - s.maxScrollback; over > 0 {
+		s.scrollback = append(s.scrollback[:0:0], s.scrollback[over:]...)
+	}
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// --- character output ---
+
+func (s *Screen) put(r rune) {
+	b := s.buf()
+	c := &b.cursor
+	width := 1
+	if isWide(r) {
+		width = 2
+	}
+	if isCombining(r) {
+		return
+	}
+
+	if c.wrapPending {
+		if s.autowrap {
+			c.x = 0
+			s.lineFeed()
+		}
+		c.wrapPending = false
+	}
+	if width == 2 && c.x == s.cols-1 {
+		if s.autowrap {
+			b.lines[c.y][c.x] = blankCell(c.attr)
+			c.x = 0
+			s.lineFeed()
+		} else {
+			width = 1
+		}
+	}
+
+	l := b.lines[c.y]
+	if s.insertMode {
+		copy(l[c.x+width:], l[c.x:])
+	}
+	l[c.x] = Cell{Ch: r, Attr: c.attr}
+	if width == 2 && c.x+1 < s.cols {
+		l[c.x+1] = Cell{Ch: 0, Attr: c.attr}
+	}
+
+	if c.x+width >= s.cols {
+		c.x = s.cols - 1
+		c.wrapPending = true
+	} else {
+		c.x += width
+	}
+}
+
+// isWide reports whether r occupies two columns. It covers the common CJK,
+// Hangul and emoji blocks rather than the full East Asian Width table.
+func isWide(r rune) bool {
+	switch {
+	case r < 0x1100:
+		return false
+	case r <= 0x115F, // Hangul Jamo
+		r >= 0x2E80 && r <= 0x303E, // CJK radicals, punctuation
+		r >= 0x3041 && r <= 0x33FF, // Kana, CJK symbols
+		r >= 0x3400 && r <= 0x4DBF, // CJK Ext A
+		r >= 0x4E00 && r <= 0x9FFF, // CJK Unified
+		r >= 0xA000 && r <= 0xA4CF, // Yi
+		r >= 0xAC00 && r <= 0xD7A3, // Hangul syllables
+		r >= 0xF900 && r <= 0xFAFF, // CJK compatibility
+		r >= 0xFE30 && r <= 0xFE4F, // CJK compatibility forms
+		r >= 0xFF00 && r <= 0xFF60, // Fullwidth forms
+		r >= 0xFFE0 && r <= 0xFFE6,
+		r >= 0x1F300 && r <= 0x1F64F, // Emoji
+		r >= 0x1F900 && r <= 0x1F9FF,
+		r >= 0x20000 && r <= 0x3FFFD: // CJK Ext B+
+		return true
+	}
+	return false
+}
+
+func isCombining(r rune) bool {
+	return (r >= 0x0300 && r <= 0x036F) || (r >= 0x200B && r <= 0x200F) ||
+		(r >= 0xFE00 && r <= 0xFE0F) || (r >= 0x20D0 && r <= 0x20FF)
+}
+
+// --- cursor movement and scrolling ---
+
+func (s *Screen) lineFeed() {
+	c := s.cur()
+	c.wrapPending = false
+	if c.y == s.bottom {
+		s.scrollUp(1)
+	} else if c.y < s.rows-1 {
+		c.y++
+	}
+}
+
+func (s *Screen) reverseIndex() {
+	c := s.cur()
+	c.wrapPending = false
+	if c.y == s.top {
+		s.scrollDown(1)
+	} else if c.y > 0 {
+		c.y--
+	}
+}
+
+// scrollUp scrolls the scroll region up by n lines. Lines leaving the top of
+// a full-height region on the main grid go to the scrollback.
+func (s *Screen) scrollUp(n int) {
+	b := s.buf()
+	height := s.bottom - s.top + 1
+	n = clamp(n, 0, height)
+	if !s.altActive && s.top == 0 {
+		s.pushScrollback(b.lines[s.top : s.top+n]...)
+	}
+	region := b.lines[s.top : s.bottom+1]
+	copy(region, region[n:])
+	for i := height - n; i < height; i++ {
+		region[i] = newLine(s.cols, b.cursor.attr)
+	}
+}
+
+func (s *Screen) scrollDown(n int) {
+	b := s.buf()
+	height := s.bottom - s.top + 1
+	n = clamp(n, 0, height)
+	region := b.lines[s.top : s.bottom+1]
+	copy(region[n:], region[:height-n])
+	for i := 0; i < n; i++ {
+		region[i] = newLine(s.cols, b.cursor.attr)
+	}
+}
+
+func (s *Screen) moveTo(x, y int) {
+	c := s.cur()
+	minY, maxY := 0, s.rows-1
+	if c.originMode {
+		minY, maxY = s.top, s.bottom
+		y += s.top
+	}
+	c.x = clamp(x, 0, s.cols-1)
+	c.y = clamp(y, minY, maxY)
+	c.wrapPending = false
+}
+
+// moveRel moves the cursor vertically, stopping at the scroll region margins
+// when starting inside it.
+func (s *Screen) moveRel(dx, dy int) {
+	c := s.cur()
+	minY, maxY := 0, s.rows-1
+	if c.y >= s.top && c.y <= s.bottom {
+		minY, maxY = s.top, s.bottom
+	}
+	c.x = clamp(c.x+dx, 0, s.cols-1)
+	c.y = clamp(c.y+dy, minY, maxY)
+	c.wrapPending = false
+}
+
+func (s *Screen) tab(n int) {
+	c := s.cur()
+	for ; n > 0 && c.x < s.cols-1; n-- {
+		c.x++
+		for c.x < s.cols-1 && !s.tabs[c.x] {
+			c.x++
+		}
+	}
+}
+
+func (s *Screen) backTab(n int) {
+	c := s.cur()
+	for ; n > 0 && c.x > 0; n-- {
+		c.x--
+		for c.x > 0 && !s.tabs[c.x] {
+			c.x--
+		}
+	}
+}
+
+func (s *Screen) saveCursor() {
+	b := s.buf()
+	b.saved = b.cursor
+}
+
+func (s *Screen) restoreCursor() {
+	b := s.buf()
+	b.cursor = b.saved
+	b.cursor.x = clamp(b.cursor.x, 0, s.cols-1)
+	b.cursor.y = clamp(b.cursor.y, 0, s.rows-1)
+}
+
+// --- erasing and editing ---
+
+func (s *Screen) eraseCells(y, from, to int) {
+	l := s.buf().lines[y]
+	a := s.cur().attr
+	for x := clamp(from, 0, s.cols); x < clamp(to, 0, s.cols); x++ {
+		l[x] = blankCell(a)
+	}
+}
+
+func (s *Screen) eraseDisplay(mode int) {
+	c := s.cur()
+	switch mode {
+	case 0:
+		s.eraseCells(c.y, c.x, s.cols)
+		for y := c.y + 1; y < s.rows; y++ {
+			s.eraseCells(y, 0, s.cols)
+		}
+	case 1:
+		for y := 0; y < c.y; y++ {
+			s.eraseCells(y, 0, s.cols)
+		}
+		s.eraseCells(c.y, 0, c.x+1)
+	case 2:
+		for y := 0; y < s.rows; y++ {
+			s.eraseCells(y, 0, s.cols)
+		}
+	case 3:
+		if !s.altActive {
+			s.scrollback = nil
+		}
+	}
+	c.wrapPending = false
+}
+
+func (s *Screen) eraseLine(mode int) {
+	c := s.cur()
+	switch mode {
+	case 0:
+		s.eraseCells(c.y, c.x, s.cols)
+	case 1:
+		s.eraseCells(c.y, 0, c.x+1)
+	case 2:
+		s.eraseCells(c.y, 0, s.cols)
+	}
+	c.wrapPending = false
+}
+
+func (s *Screen) insertLines(n int) {
+	c := s.cur()
+	if c.y < s.top || c.y > s.bottom {
+		return
+	}
+	top := s.top
+	s.top = c.y
+	s.scrollDown(n)
+	s.top = top
+	c.x = 0
+	c.wrapPending = false
+}
+
+func (s *Screen) deleteLines(n int) {
+	c := s.cur()
+	if c.y < s.top || c.y > s.bottom {
+		return
+	}
+	top := s.top
+	s.top = c.y
+	b := s.buf()
+	height := s.bottom - s.top + 1
+	n = clamp(n, 0, height)
+	region := b.lines[s.top : s.bottom+1]
+	copy(region, region[n:])
+	for i := height - n; i < height; i++ {
+		region[i] = newLine(s.cols, c.attr)
+	}
+	s.top = top
+	c.x = 0
+	c.wrapPending = false
+}
+
+func (s *Screen) insertChars(n int) {
+	c := s.cur()
+	l := s.buf().lines[c.y]
+	n = clamp(n, 0, s.cols-c.x)
+	copy(l[c.x+n:], l[c.x:])
+	for x := c.x; x < c.x+n; x++ {
+		l[x] = blankCell(c.attr)
+	}
+	c.wrapPending = false
+}
+
+func (s *Screen) deleteChars(n int) {
+	c := s.cur()
+	l := s.buf().lines[c.y]
+	n = clamp(n, 0, s.cols-c.x)
+	copy(l[c.x:], l[c.x+n:])
+	for x := s.cols - n; x < s.cols; x++ {
+		l[x] = blankCell(c.attr)
+	}
+	c.wrapPending = false
+}
+
+// --- modes ---
+
+func (s *Screen) setAltScreen(on, saveCursor, clear bool) {
+	if on == s.altActive {
+		return
+	}
+	if on {
+		if saveCursor {
+			s.main.saved = s.main.cursor
+		}
+		s.alt.cursor = s.main.cursor
+		if clear {
+			s.alt.lines = newLines(s.rows, s.cols, defaultAttr)
+		}
+		s.altActive = true
+	} else {
+		s.altActive = false
+		if saveCursor {
+			s.main.cursor = s.main.saved
+		}
+	}
+	s.top, s.bottom = 0, s.rows-1
+}
+
+func (s *Screen) setPrivateMode(mode int, on bool) {
+	switch mode {
+	case 1:
+		s.appCursorKeys = on
+	case 6:
+		s.cur().originMode = on
+		s.moveTo(0, 0)
+	case 7:
+		s.autowrap = on
+	case 9:
+		s.setMouse(mouseX10, on)
+	case 25:
+		s.cursorHidden = !on
+	case 47, 1047:
+		s.setAltScreen(on, false, on && mode == 1047)
+	case 1048:
+		if on {
+			s.saveCursor()
+		} else {
+			s.restoreCursor()
+		}
+	case 1049:
+		s.setAltScreen(on, true, true)
+	case 1000, 1002, 1003:
+		s.setMouse(mode, on)
+	case 1004:
+		s.focusEvents = on
+	case 1006:
+		s.mouseSGR = on
+	case 2004:
+		s.bracketedPaste = on
+	}
+}
+
+func (s *Screen) setMouse(mode int, on bool) {
+	if on {
+		s.mouseMode = mode
+	} else if s.mouseMode == mode {
+		s.mouseMode = mouseNone
+	}
+}
+
+func (s *Screen) setMode(mode int, on bool) {
+	if mode == 4 {
+		s.insertMode = on
+	}
+}
+
+func (s *Screen) setScrollRegion(top, bottom int) {
+	if bottom <= 0 || bottom > s.rows {
+		bottom = s.rows
+	}
+	if top <= 0 {
+		top = 1
+	}
+	if top >= bottom {
+		return
+	}
+	s.top, s.bottom = top-1, bottom-1
+	s.moveTo(0, 0)
+}
+
+// --- parser ---
+
+type parserState int
+
+const (
+	stateGround parserState = iota
+	stateEscape
+	stateEscapeIntermediate
+	stateCSI
+	stateOSC
+	stateString // DCS, SOS, PM, APC: ignored until ST
+	stateStringEsc
+	stateOSCEsc
+)
+
+type parser struct {
+	state   parserState
+	params  []int
+	cur     int
+	hasCur  bool
+	private byte
+	inter   []byte
+	osc     []byte
+	utf8buf []byte
+}
+
+func (p *parser) feed(s *Screen, data []byte) {
+	if len(p.utf8buf) > 0 {
+		data = append(p.utf8buf, data...)
+		p.utf8buf = nil
+	}
+	for i := 0; i < len(data); {
+		b := data[i]
+		if b < 0x80 || p.state != stateGround {
+			p.byte(s, b)
+			i++
+			continue
+		}
+		if !utf8.FullRune(data[i:]) {
+			p.utf8buf = append([]byte(nil), data[i:]...)
+			return
+		}
+		r, size := utf8.DecodeRune(data[i:])
+		s.put(r)
+		i += size
+	}
+}
+
+func (p *parser) clearParams() {
+	p.params = p.params[:0]
+	p.cur = 0
+	p.hasCur = false
+	p.private = 0
+	p.inter = p.inter[:0]
+}
+
+func (p *parser) byte(s *Screen, b byte) {
+	// CAN and SUB abort any sequence; ESC starts a new one except inside
+	// strings, where it may begin the ST terminator.
+	switch {
+	case b == 0x18 || b == 0x1a:
+		p.state = stateGround
+		return
+	case b == 0x1b && p.state != stateOSC && p.state != stateString:
+		p.state = stateEscape
+		p.clearParams()
+		return
+	}
+
+	switch p.state {
+	case stateGround:
+		if b < 0x20 || b == 0x7f {
+			p.control(s, b)
+		} else {
+			s.put(rune(b))
+		}
+
+	case stateEscape:
+		p.escape(s, b)
+
+	case stateEscapeIntermediate:
+		// Charset designations (ESC ( B etc.) and the like: consume the
+		// final byte and ignore it.
+		if b >= 0x30 && b <= 0x7e {
+			p.state = stateGround
+		}
+
+	case stateCSI:
+		switch {
+		case b >= '0' && b <= '9':
+			p.cur = p.cur*10 + int(b-'0')
+			if p.cur > 65535 {
+				p.cur = 65535
+			}
+			p.hasCur = true
+		case b == ';' || b == ':':
+			p.params = append(p.params, p.paramValue())
+			p.cur, p.hasCur = 0, false
+		case b >= 0x3c && b <= 0x3f:
+			p.private = b
+		case b >= 0x20 && b <= 0x2f:
+			p.inter = append(p.inter, b)
+		case b >= 0x40 && b <= 0x7e:
+			if p.hasCur || len(p.params) > 0 {
+				p.params = append(p.params, p.paramValue())
+			}
+			p.state = stateGround
+			p.csi(s, b)
+		case b < 0x20:
+			p.control(s, b)
+		}
+
+	case stateOSC:
+		switch b {
+		case 0x07:
+			p.oscDone(s)
+		case 0x1b:
+			p.state = stateOSCEsc
+		default:
+			if len(p.osc) < 4096 {
+				p.osc = append(p.osc, b)
+			}
+		}
+
+	case stateOSCEsc:
+		if b == '\\' {
+			p.oscDone(s)
+		} else {
+			p.state = stateOSC
+		}
+
+	case stateString:
+		if b == 0x1b {
+			p.state = stateStringEsc
+		} else if b == 0x07 {
+			p.state = stateGround
+		}
+
+	case stateStringEsc:
+		if b == '\\' {
+			p.state = stateGround
+		} else {
+			p.state = stateString
+		}
+	}
+}
+
+// paramValue returns the parameter being parsed; -1 marks an omitted one.
+func (p *parser) paramValue() int {
+	if !p.hasCur {
+		return -1
+	}
+	return p.cur
+}
+
+func (p *parser) control(s *Screen, b byte) {
+	c := s.cur()
+	switch b {
+	case '\b':
+		if c.wrapPending {
+			c.wrapPending = false
+		} else if c.x > 0 {
+			c.x--
+		}
+	case '\t':
+		s.tab(1)
+	case '\n', '\v', '\f':
+		s.lineFeed()
+	case '\r':
+		c.x = 0
+		c.wrapPending = false
+	}
+}
+
+func (p *parser) escape(s *Screen, b byte) {
+	p.state = stateGround
+	switch b {
+	case '[':
+		p.state = stateCSI
+	case ']':
+		p.state = stateOSC
+		p.osc = p.osc[:0]
+	case 'P', 'X', '^', '_':
+		p.state = stateString
+	case '(', ')', '*', '+', '-', '.', '/', '#', '%', ' ':
+		p.state = stateEscapeIntermediate
+	case '7':
+		s.saveCursor()
+	case '8':
+		s.restoreCursor()
+	case 'D':
+		s.lineFeed()
+	case 'E':
+		s.cur().x = 0
+		s.lineFeed()
+	case 'H':
+		s.tabs[s.cur().x] = true
+	case 'M':
+		s.reverseIndex()
+	case 'c':
+		s.reset(s.rows, s.cols)
+	case '=':
+		s.appKeypad = true
+	case '>':
+		s.appKeypad = false
+	}
+}
+
+func (p *parser) param(i, def int) int {
+	if i < len(p.params) && p.params[i] > 0 {
+		return p.params[i]
+	}
+	return def
+}
+
+func (p *parser) csi(s *Screen, final byte) {
+	c := s.cur()
+	if p.private == '?' {
+		switch final {
+		case 'h', 'l':
+			for _, m := range p.params {
+				s.setPrivateMode(m, final == 'h')
+			}
+		}
+		return
+	}
+	if p.private != 0 || len(p.inter) > 0 {
+		return
+	}
+
+	switch final {
+	case '@':
+		s.insertChars(p.param(0, 1))
+	case 'A':
+		s.moveRel(0, -p.param(0, 1))
+	case 'B', 'e':
+		s.moveRel(0, p.param(0, 1))
+	case 'C', 'a':
+		s.moveRel(p.param(0, 1), 0)
+	case 'D':
+		s.moveRel(-p.param(0, 1), 0)
+	case 'E':
+		s.moveRel(0, p.param(0, 1))
+		c.x = 0
+	case 'F':
+		s.moveRel(0, -p.param(0, 1))
+		c.x = 0
+	case 'G', '`':
+		c.x = clamp(p.param(0, 1)-1, 0, s.cols-1)
+		c.wrapPending = false
+	case 'H', 'f':
+		s.moveTo(p.param(1, 1)-1, p.param(0, 1)-1)
+	case 'I':
+		s.tab(p.param(0, 1))
+	case 'J':
+		s.eraseDisplay(p.param(0, 0))
+	case 'K':
+		s.eraseLine(p.param(0, 0))
+	case 'L':
+		s.insertLines(p.param(0, 1))
+	case 'M':
+		s.deleteLines(p.param(0, 1))
+	case 'P':
+		s.deleteChars(p.param(0, 1))
+	case 'S':
+		s.scrollUp(p.param(0, 1))
+	case 'T':
+		s.scrollDown(p.param(0, 1))
+	case 'X':
+		n := p.param(0, 1)
+		s.eraseCells(c.y, c.x, c.x+n)
+		c.wrapPending = false
+	case 'Z':
+		s.backTab(p.param(0, 1))
+	case 'd':
+		y := p.param(0, 1) - 1
+		if c.originMode {
+			y += s.top
+		}
+		c.y = clamp(y, 0, s.rows-1)
+		c.wrapPending = false
+	case 'g':
+		switch p.param(0, 0) {
+		case 0:
+			s.tabs[c.x] = false
+		case 3:
+			s.tabs = make([]bool, s.cols)
+		}
+	case 'h', 'l':
+		for _, m := range p.params {
+			s.setMode(m, final == 'h')
+		}
+	case 'm':
+		p.sgr(c)
+	case 'r':
+		s.setScrollRegion(p.param(0, 1), p.param(1, s.rows))
+	case 's':
+		s.saveCursor()
+	case 'u':
+		s.restoreCursor()
+	}
+}
+
+func (p *parser) sgr(c *cursor) {
+	if len(p.params) == 0 {
+		c.attr = defaultAttr
+		return
+	}
+	a := &c.attr
+	for i := 0; i < len(p.params); i++ {
+		n := p.params[i]
+		switch {
+		case n <= 0:
+			*a = defaultAttr
+		case n == 1:
+			a.Flags |= attrBold
+		case n == 2:
+			a.Flags |= attrDim
+		case n == 3:
+			a.Flags |= attrItalic
+		case n == 4:
+			a.Flags |= attrUnderline
+		case n == 5 || n == 6:
+			a.Flags |= attrBlink
+		case n == 7:
+			a.Flags |= attrReverse
+		case n == 8:
+			a.Flags |= attrHidden
+		case n == 9:
+			a.Flags |= attrStrike
+		case n == 21 || n == 22:
+			a.Flags &^= attrBold | attrDim
+		case n == 23:
+			a.Flags &^= attrItalic
+		case n == 24:
+			a.Flags &^= attrUnderline
+		case n == 25:
+			a.Flags &^= attrBlink
+		case n == 27:
+			a.Flags &^= attrReverse
+		case n == 28:
+			a.Flags &^= attrHidden
+		case n == 29:
+			a.Flags &^= attrStrike
+		case n >= 30 && n <= 37:
+			a.FG = Color(n - 30)
+		case n == 38 || n == 48:
+			col, skip := p.extendedColor(i + 1)
+			if n == 38 {
+				a.FG = col
+			} else {
+				a.BG = col
+			}
+			i += skip
+		case n == 39:
+			a.FG = DefaultColor
+		case n >= 40 && n <= 47:
+			a.BG = Color(n - 40)
+		case n == 49:
+			a.BG = DefaultColor
+		case n >= 90 && n <= 97:
+			a.FG = Color(n - 90 + 8)
+		case n >= 100 && n <= 107:
+			a.BG = Color(n - 100 + 8)
+		}
+	}
+}
+
+// extendedColor parses the arguments of SGR 38/48 starting at params[i] and
+// returns the color and the number of parameters consumed.
+func (p *parser) extendedColor(i int) (Color, int) {
+	if i >= len(p.params) {
+		return DefaultColor, 0
+	}
+	switch p.params[i] {
+	case 5:
+		if i+1 < len(p.params) {
+			return Color(clamp(p.params[i+1], 0, 255)), 2
+		}
+		return DefaultColor, 1
+	case 2:
+		if i+3 < len(p.params) {
+			return RGB(uint8(clamp(p.params[i+1], 0, 255)),
+				uint8(clamp(p.params[i+2], 0, 255)),
+				uint8(clamp(p.params[i+3], 0, 255))), 4
+		}
+		return DefaultColor, len(p.params) - i
+	}
+	return DefaultColor, 1
+}
+
+func (p *parser) oscDone(s *Screen) {
+	p.state = stateGround
+	// Only the window title affects what a reconnecting client should see.
+	osc := string(p.osc)
+	for _, prefix := range []string{"0;", "2;"} {
+		if len(osc) > len(prefix) && osc[:len(prefix)] == prefix {
+			s.title = osc[len(prefix):]
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package vt
+
+import (
+	"strings"
+	"testing"
+)
+
+// text returns the rows of the active grid with trailing blanks trimmed.
+func text(s *Screen) []string {
+	rows := make([]string, 0, s.rows)
+	for _, l := range s.buf().lines {
+		var b strings.Builder
+		for _, c := range l {
+			if c.Ch != 0 {
+				b.WriteRune(c.Ch)
+			}
+		}
+		rows = append(rows, strings.TrimRight(b.String(), " "))
+	}
+	return rows
+}
+
+func feed(s *Screen, data string) *Screen {
+	s.Write([]byte(data))
+	return s
+}
+
+func TestScreenText(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		want   []string
+		cx, cy int
+	}{
+		{"plain", "hello", []string{"hello", "", ""}, 5, 0},
+		{"crlf", "ab\r\ncd", []string{"ab", "cd", ""}, 2, 1},
+		{"lf keeps column", "ab\ncd", []string{"ab", "  cd", ""}, 4, 1},
+		{"wrap", "0123456789ab", []string{"0123456789", "ab", ""}, 2, 1},
+		{"pending wrap", "0123456789", []string{"0123456789", "", ""}, 9, 0},
+		{"backspace", "abc\bX", []string{"abX", "", ""}, 3, 0},
+		{"tab", "a\tb", []string{"a       b", "", ""}, 9, 0},
+		{"cursor position", "\x1b[2;4Hx", []string{"", "   x", ""}, 4, 1},
+		{"cursor movement", "\x1b[3B\x1b[5Cx\x1b[2Ay\x1b[3Dz", []string{"    z y", "", "     x"}, 5, 0},
+		{"erase line right", "abcdef\x1b[3G\x1b[K", []string{"ab", "", ""}, 2, 0},
+		{"erase line left", "abcdef\x1b[3G\x1b[1K", []string{"   def", "", ""}, 2, 0},
+		{"erase display", "ab\r\ncd\r\nef\x1b[2;1H\x1b[J", []string{"ab", "", ""}, 0, 1},
+		{"erase all", "ab\r\ncd\x1b[2J", []string{"", "", ""}, 2, 1},
+		{"insert chars", "abcd\x1b[2G\x1b[2@", []string{"a  bcd", "", ""}, 1, 0},
+		{"delete chars", "abcd\x1b[2G\x1b[2P", []string{"ad", "", ""}, 1, 0},
+		{"scroll", "1\r\n2\r\n3\r\n4", []string{"2", "3", "4"}, 1, 2},
+		{"insert line", "1\r\n2\r\n3\x1b[2H\x1b[L", []string{"1", "", "2"}, 0, 1},
+		{"delete line", "1\r\n2\r\n3\x1b[1H\x1b[M", []string{"2", "3", ""}, 0, 0},
+		{"reverse index", "1\x1b[H\x1bM", []string{"", "1", ""}, 0, 0},
+		{"save restore", "ab\x1b7\x1b[3;5Hx\x1b8y", []string{"aby", "", "    x"}, 3, 0},
+		{"wide", "a世b", []string{"a世b", "", ""}, 4, 0},
+		{"wide at margin", "012345678世", []string{"012345678", "世", ""}, 2, 1},
+		{"combining dropped", "éx", []string{"ex", "", ""}, 2, 0},
+		{"charset ignored", "\x1b(Bab", []string{"ab", "", ""}, 2, 0},
+		{"osc ignored", "\x1b]8;;http://x\x07ab", []string{"ab", "", ""}, 2, 0},
+		{"dcs ignored", "\x1bPq#0\x1b\\ab", []string{"ab", "", ""}, 2, 0},
+		{"cancel", "\x1b[1\x18ab", []string{"ab", "", ""}, 2, 0},
+		{"no autowrap", "\x1b[?7l0123456789ab", []string{"012345678b", "", ""}, 9, 0},
+		{"insert mode", "abc\x1b[1G\x1b[4hX", []string{"Xabc", "", ""}, 1, 0},
+		{"reset", "abc\x1bc", []string{"", "", ""}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := feed(NewScreen(3, 10, 100), tt.input)
+			if got := text(s); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("text = %q, want %q", got, tt.want)
+			}
+			if c := s.cur(); c.x != tt.cx || c.y != tt.cy {
+				t.Errorf("cursor = %d,%d, want %d,%d", c.x, c.y, tt.cx, tt.cy)
+			}
+		})
+	}
+}
+
+func TestScreenSplitUTF8(t *testing.T) {
+	s := NewScreen(2, 10, 0)
+	b := []byte("é世")
+	for i := range b {
+		s.Write(b[i : i+1])
+	}
+	if got := text(s)[0]; got != "é世" {
+		t.Errorf("text = %q, want %q", got, "é世")
+	}
+}
+
+func TestScreenSGR(t *testing.T) {
+	s := feed(NewScreen(1, 20, 0),
+		"\x1b[1;31ma\x1b[22;44mb\x1b[38;5;200mc\x1b[38;2;1;2;3;48;5;7md\x1b[0me\x1b[97;101mf\x1b[39;49;7mg")
+	want := []Attr{
+		{FG: 1, BG: DefaultColor, Flags: attrBold},
+		{FG: 1, BG: 4},
+		{FG: 200, BG: 4},
+		{FG: RGB(1, 2, 3), BG: 7},
+		defaultAttr,
+		{FG: 15, BG: 9},
+		{FG: DefaultColor, BG: DefaultColor, Flags: attrReverse},
+	}
+	for i, a := range want {
+		if got := s.main.lines[0][i].Attr; got != a {
+			t.Errorf("cell %d attr = %+v, want %+v", i, got, a)
+		}
+	}
+}
+
+func TestScreenScrollback(t *testing.T) {
+	s := feed(NewScreen(2, 10, 2), "1\r\n2\r\n3\r\n4\r\n5")
+	if len(s.scrollback) != 2 {
+		t.Fatalf("scrollback has %d lines, want 2", len(s.scrollback))
+	}
+	if got := string(s.scrollback[0][0].Ch) + string(s.scrollback[1][0].Ch); got != "23" {
+		t.Errorf("scrollback = %q, want %q", got, "23")
+	}
+	feed(s, "\x1b[3J")
+	if len(s.scrollback) != 0 {
+		t.Errorf("scrollback not cleared by ED 3")
+	}
+}
+
+func TestScreenScrollRegion(t *testing.T) {
+	s := feed(NewScreen(4, 10, 100), "a\r\nb\r\nc\r\nd\x1b[2;3r\x1b[3H\r\nx")
+	if got, want := strings.Join(text(s), "|"), "a|c|x|d"; got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+	if len(s.scrollback) != 0 {
+		t.Errorf("lines scrolled out of a partial region went to the scrollback")
+	}
+	if s.top != 1 || s.bottom != 2 {
+		t.Errorf("region = %d-%d, want 1-2", s.top, s.bottom)
+	}
+}
+
+func TestScreenAltScreen(t *testing.T) {
+	s := feed(NewScreen(3, 10, 100), "main\x1b[?1049halt")
+	if !s.altActive {
+		t.Fatal("alternate screen not active")
+	}
+	if got := text(s)[0]; got != "    alt" {
+		t.Errorf("alt text = %q", got)
+	}
+	feed(s, "\x1b[?1049l")
+	if s.altActive {
+		t.Fatal("alternate screen still active")
+	}
+	if got := text(s)[0]; got != "main" {
+		t.Errorf("main text = %q, want %q", got, "main")
+	}
+	if c := s.cur(); c.x != 4 || c.y != 0 {
+		t.Errorf("cursor = %d,%d, want restored 4,0", c.x, c.y)
+	}
+}
+
+func TestScreenModes(t *testing.T) {
+	s := feed(NewScreen(3, 10, 0), "\x1b[?1h\x1b=\x1b[?2004h\x1b[?1002h\x1b[?1006h\x1b[?1004h\x1b[?25l\x1b]2;title\x07")
+	if !s.appCursorKeys || !s.appKeypad || !s.bracketedPaste || s.mouseMode != 1002 ||
+		!s.mouseSGR || !s.focusEvents || !s.cursorHidden || s.title != "title" {
+		t.Errorf("modes not set: %+v", s)
+	}
+	feed(s, "\x1b[?1000l")
+	if s.mouseMode != 1002 {
+		t.Errorf("resetting another mouse mode cleared %d", s.mouseMode)
+	}
+	feed(s, "\x1b[?1002l")
+	if s.mouseMode != mouseNone {
+		t.Errorf("mouse mode = %d after reset", s.mouseMode)
+	}
+}
+
+func TestScreenResize(t *testing.T) {
+	s := feed(NewScreen(4, 10, 100), "1\r\n2\r\n3\r\n4")
+	s.Resize(2, 5)
+	if got, want := strings.Join(text(s), "|"), "3|4"; got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+	if len(s.scrollback) != 2 {
+		t.Errorf("scrollback has %d lines, want 2", len(s.scrollback))
+	}
+	if c := s.cur(); c.x != 1 || c.y != 1 {
+		t.Errorf("cursor = %d,%d, want 1,1", c.x, c.y)
+	}
+
+	s.Resize(3, 20)
+	if rows, cols := s.Size(); rows != 3 || cols != 20 {
+		t.Errorf("size = %dx%d, want 3x20", rows, cols)
+	}
+	if got, want := strings.Join(text(s), "|"), "3|4|"; got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+}
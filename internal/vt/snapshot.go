@@ -0,0 +1,168 @@
+package vt
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// Snapshot renders the screen as an escape sequence stream that, written to
+// a freshly reset terminal of the same size, reproduces the visible grid,
+// up to scrollback lines of history, the cursor and the active modes.
+func (s *Screen) Snapshot(scrollback int) []byte {
+	var out bytes.Buffer
+	// Full reset so a reconnecting terminal does not keep stale content.
+	out.WriteString("\x1bc")
+
+	if s.title != "" {
+		fmt.Fprintf(&out, "\x1b]0;%s\x07", s.title)
+	}
+
+	// Scrollback followed by the main grid, joined by newlines, leaves the
+	// grid on screen and pushes the scrollback into the client's history.
+	sb := s.scrollback
+	if scrollback >= 0 && len(sb) > scrollback {
+		sb = sb[len(sb)-scrollback:]
+	}
+	r := renderer{out: &out, attr: defaultAttr}
+	for _, l := range sb {
+		r.line(l)
+		r.newline()
+	}
+	for y, l := range s.main.lines {
+		r.line(l)
+		if y < len(s.main.lines)-1 {
+			r.newline()
+		}
+	}
+
+	if s.altActive {
+		r.setAttr(defaultAttr)
+		r.out.WriteString("\x1b[?1049h\x1b[H\x1b[2J")
+		for y, l := range s.alt.lines {
+			fmt.Fprintf(r.out, "\x1b[%dH", y+1)
+			r.line(l)
+		}
+	}
+
+	if s.top != 0 || s.bottom != s.rows-1 {
+		fmt.Fprintf(&out, "\x1b[%d;%dr", s.top+1, s.bottom+1)
+	}
+	if !s.autowrap {
+		out.WriteString("\x1b[?7l")
+	}
+	if s.insertMode {
+		out.WriteString("\x1b[4h")
+	}
+	if s.appCursorKeys {
+		out.WriteString("\x1b[?1h")
+	}
+	if s.appKeypad {
+		out.WriteString("\x1b=")
+	}
+	if s.bracketedPaste {
+		out.WriteString("\x1b[?2004h")
+	}
+	if s.mouseMode != mouseNone {
+		fmt.Fprintf(&out, "\x1b[?%dh", s.mouseMode)
+	}
+	if s.mouseSGR {
+		out.WriteString("\x1b[?1006h")
+	}
+	if s.focusEvents {
+		out.WriteString("\x1b[?1004h")
+	}
+
+	c := s.cur()
+	fmt.Fprintf(&out, "\x1b[%d;%dH", c.y+1, c.x+1)
+	if c.originMode {
+		// DECOM homes the cursor, so restore the absolute position after.
+		fmt.Fprintf(&out, "\x1b[?6h\x1b[%d;%dH", c.y-s.top+1, c.x+1)
+	}
+	r.setAttr(c.attr)
+	if s.cursorHidden {
+		out.WriteString("\x1b[?25l")
+	}
+	return out.Bytes()
+}
+
+type renderer struct {
+	out  *bytes.Buffer
+	attr Attr
+}
+
+func (r *renderer) newline() {
+	r.out.WriteString("\r\n")
+}
+
+// line writes the cells of l, omitting trailing blanks that carry no
+// background color.
+func (r *renderer) line(l line) {
+	end := len(l)
+	for end > 0 {
+		c := l[end-1]
+		if (c.Ch != ' ' && c.Ch != 0) || c.Attr.BG != DefaultColor || c.Attr.Flags&attrReverse != 0 {
+			break
+		}
+		end--
+	}
+	for _, c := range l[:end] {
+		if c.Ch == 0 {
+			continue // right half of a wide character
+		}
+		r.setAttr(c.Attr)
+		r.out.WriteRune(c.Ch)
+	}
+	r.setAttr(defaultAttr)
+}
+
+func (r *renderer) setAttr(a Attr) {
+	if a == r.attr {
+		return
+	}
+	r.out.WriteString(sgr(a))
+	r.attr = a
+}
+
+// sgr returns the sequence that sets a from the default rendition.
+func sgr(a Attr) string {
+	params := []byte("0")
+	add := func(v string) {
+		params = append(params, ';')
+		params = append(params, v...)
+	}
+	flags := []struct {
+		bit  uint16
+		code string
+	}{
+		{attrBold, "1"}, {attrDim, "2"}, {attrItalic, "3"}, {attrUnderline, "4"},
+		{attrBlink, "5"}, {attrReverse, "7"}, {attrHidden, "8"}, {attrStrike, "9"},
+	}
+	for _, f := range flags {
+		if a.Flags&f.bit != 0 {
+			add(f.code)
+		}
+	}
+	if c := colorParams(a.FG, 30, 90, "38"); c != "" {
+		add(c)
+	}
+	if c := colorParams(a.BG, 40, 100, "48"); c != "" {
+		add(c)
+	}
+	return "\x1b[" + string(params) + "m"
+}
+
+func colorParams(c Color, base, brightBase int, ext string) string {
+	switch {
+	case c == DefaultColor:
+		return ""
+	case c&rgbFlag != 0:
+		return fmt.Sprintf("%s;2;%d;%d;%d", ext, (c>>16)&0xff, (c>>8)&0xff, c&0xff)
+	case c < 8:
+		return strconv.Itoa(base + int(c))
+	case c < 16:
+		return strconv.Itoa(brightBase + int(c) - 8)
+	default:
+		return ext + ";5;" + strconv.Itoa(int(c))
+	}
+}
@@ -0,0 +1,103 @@
+package vt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// roundTrip writes the snapshot of s to a fresh screen of the same size.
+func roundTrip(s *Screen, scrollback int) *Screen {
+	out := NewScreen(s.rows, s.cols, s.maxScrollback)
+	out.Write([]byte("garbage\r\nleft over"))
+	out.Write(s.Snapshot(scrollback))
+	return out
+}
+
+func assertSameScreen(t *testing.T, got, want *Screen) {
+	t.Helper()
+	if !reflect.DeepEqual(got.main.lines, want.main.lines) {
+		t.Errorf("main grid = %q, want %q", text(got), text(want))
+	}
+	if got.altActive != want.altActive {
+		t.Fatalf("altActive = %v, want %v", got.altActive, want.altActive)
+	}
+	if want.altActive && !reflect.DeepEqual(got.alt.lines, want.alt.lines) {
+		t.Errorf("alt grid = %q, want %q", text(got), text(want))
+	}
+	gc, wc := got.cur(), want.cur()
+	if gc.x != wc.x || gc.y != wc.y || gc.attr != wc.attr || gc.originMode != wc.originMode {
+		t.Errorf("cursor = %+v, want %+v", *gc, *wc)
+	}
+	if got.top != want.top || got.bottom != want.bottom {
+		t.Errorf("region = %d-%d, want %d-%d", got.top, got.bottom, want.top, want.bottom)
+	}
+	type modes struct {
+		autowrap, insert, hidden, appCursor, appKeypad, paste bool
+		mouse                                                 int
+		mouseSGR, focus                                       bool
+		title                                                 string
+	}
+	m := func(s *Screen) modes {
+		return modes{s.autowrap, s.insertMode, s.cursorHidden, s.appCursorKeys, s.appKeypad,
+			s.bracketedPaste, s.mouseMode, s.mouseSGR, s.focusEvents, s.title}
+	}
+	if m(got) != m(want) {
+		t.Errorf("modes = %+v, want %+v", m(got), m(want))
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"empty", ""},
+		{"text", "hello\r\nworld"},
+		{"colors", "\x1b[1;31mred\x1b[0m plain \x1b[38;2;10;20;30;48;5;100mrgb\x1b[0m\r\n\x1b[7minverse\x1b[0m"},
+		{"background to margin", "\x1b[44m\x1b[K\x1b[0mx"},
+		{"pen carried", "abc\x1b[4;32m"},
+		{"wide", "世界 ok\r\n"},
+		{"full line", "0123456789\r\nnext"},
+		{"cursor mid screen", "a\r\nb\r\nc\x1b[2;5H"},
+		{"alt screen", "shell$ \x1b[?1049h\x1b[Hvim\x1b[3;2Hx"},
+		{"scroll region", "\x1b[2;3r\x1b[3;1H"},
+		{"origin mode", "\x1b[2;3r\x1b[?6h\x1b[2;4H"},
+		{"modes", "\x1b[?7l\x1b[4h\x1b[?1h\x1b=\x1b[?2004h\x1b[?1000h\x1b[?1006h\x1b[?1004h\x1b[?25l"},
+		{"title", "\x1b]0;my title\x07$ "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := feed(NewScreen(4, 10, 100), tt.input)
+			assertSameScreen(t, roundTrip(s, 100), s)
+		})
+	}
+}
+
+func TestSnapshotScrollback(t *testing.T) {
+	s := feed(NewScreen(2, 10, 100), "1\r\n2\r\n3\r\n4\r\n5")
+	got := roundTrip(s, 2)
+	assertSameScreen(t, got, s)
+	if len(got.scrollback) != 2 {
+		t.Fatalf("scrollback has %d lines, want 2", len(got.scrollback))
+	}
+	if !reflect.DeepEqual(got.scrollback, s.scrollback[1:]) {
+		t.Errorf("scrollback differs")
+	}
+}
+
+func TestSnapshotStartsWithReset(t *testing.T) {
+	s := feed(NewScreen(2, 10, 0), "x")
+	if snap := s.Snapshot(0); !bytes.HasPrefix(snap, []byte("\x1bc")) {
+		t.Errorf("snapshot %q does not start with a reset", snap)
+	}
+}
+
+func TestSnapshotResumesOutput(t *testing.T) {
+	// A snapshot followed by later output must match feeding everything.
+	before, after := "$ ls\r\nfile\r\n$ \x1b[1m", "bold\x1b[0m\r\n$ "
+	s := feed(NewScreen(3, 10, 100), before)
+	got := roundTrip(s, 100)
+	feed(got, after)
+	assertSameScreen(t, got, feed(s, after))
+}
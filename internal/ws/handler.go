@@ -1,35 +1,64 @@
 package ws
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/websocket"
 
+	"github.com/shafqat-a/ai-dev-conductor/internal/audit"
+	"github.com/shafqat-a/ai-dev-conductor/internal/auth"
 	"github.com/shafqat-a/ai-dev-conductor/internal/session"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
-}
-
 const (
 	pingInterval = 30 * time.Second
 	pongWait     = 60 * time.Second
 	writeWait    = 10 * time.Second
+
+	outputChunkSize = 32 << 10
+
+	// Recorded input is written to the audit log a line at a time, or
+	// every inputFlushSize bytes for input without line breaks.
+	inputFlushSize = 4 << 10
 )
 
-func HandleWebSocket(mgr *session.Manager) http.HandlerFunc {
+// HandleWebSocket attaches clients to sessions. Only pages from allowed
+// origins may connect, so other sites can't open a shell with the
+// browser's credentials. Attaches and detaches are written to auditLog,
+// along with everything clients type if recordInput is set.
+func HandleWebSocket(mgr *session.Manager, origins *auth.OriginPolicy, auditLog *audit.Log, recordInput bool) http.HandlerFunc {
+	upgrader := websocket.Upgrader{CheckOrigin: origins.Allowed}
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := chi.URLParam(r, "id")
+		p := auth.PrincipalFrom(r.Context())
 		sess, ok := mgr.Get(id)
-		if !ok {
+		if !ok || !p.CanView(sess.ID, sess.Owner) {
 			http.Error(w, "session not found", http.StatusNotFound)
 			return
 		}
+		// Users who may only watch always attach as spectators; others can
+		// ask to with ?mode=spectate.
+		mode := ModeControl
+		if !p.CanControl(sess.ID, sess.Owner) || r.URL.Query().Get("mode") == ModeSpectate {
+			mode = ModeSpectate
+		}
+
+		// Clients may pass their size up front so the snapshot is rendered
+		// for the terminal that will display it.
+		rows, _ := strconv.ParseUint(r.URL.Query().Get("rows"), 10, 16)
+		cols, _ := strconv.ParseUint(r.URL.Query().Get("cols"), 10, 16)
+		if mode == ModeControl && rows > 0 && cols > 0 {
+			sess.Resize(uint16(rows), uint16(cols))
+		}
 
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
@@ -37,28 +66,102 @@ func HandleWebSocket(mgr *session.Manager) http.HandlerFunc {
 			return
 		}
 
-		client := sess.AddClient()
-		log.Printf("client connected to session %s", id)
+		client, snapshot := sess.AddClient()
+		log.Printf("client %s connected to session %s (%s)", p.Username, id, mode)
+		trail := &auditTrail{
+			log:   auditLog,
+			base:  audit.Event{User: p.Username, Addr: auth.ClientIP(r), Session: sess.ID},
+			input: recordInput && mode == ModeControl,
+		}
+		trail.record(audit.Event{Action: audit.ActionAttach, Detail: mode})
 
-		// Send history on connect
-		history, err := session.ReadHistory(mgr.DataDir(), id)
-		if err == nil && len(history) > 0 {
-			msg := Message{Type: MessageTypeOutput, Data: string(history)}
-			if payload, err := json.Marshal(msg); err == nil {
-				conn.WriteMessage(websocket.TextMessage, payload)
+		// Tell the client its mode, then send the current screen instead of
+		// replaying raw history
+		if err := writeMessage(conn, Message{Type: MessageTypeMode, Data: mode}); err != nil {
+			sess.RemoveClient(client)
+			conn.Close()
+			return
+		}
+		if err := sendOutput(conn, bytes.NewReader(snapshot)); err != nil {
+			sess.RemoveClient(client)
+			conn.Close()
+			return
+		}
+		// Then the output produced while the snapshot was on its way.
+		for pending := sess.CatchUp(client); len(pending) > 0; pending = sess.CatchUp(client) {
+			if err := sendOutput(conn, bytes.NewReader(pending)); err != nil {
+				sess.RemoveClient(client)
+				conn.Close()
+				return
 			}
 		}
 
-		go writePump(conn, client)
-		go readPump(conn, sess, client)
+		go writePump(conn, client, p)
+		go readPump(conn, sess, client, mode == ModeSpectate, trail)
+	}
+}
+
+// sendOutput sends r to the client as a series of output messages of at
+// most outputChunkSize bytes, split on UTF-8 boundaries.
+func sendOutput(conn *websocket.Conn, r io.Reader) error {
+	buf := make([]byte, outputChunkSize+utf8.UTFMax)
+	pending := 0
+	for {
+		n, err := r.Read(buf[pending:outputChunkSize])
+		n += pending
+		pending = 0
+		if n > 0 {
+			// Hold back an incomplete trailing rune for the next chunk.
+			cut := n
+			for i := n - 1; i >= 0 && i >= n-utf8.UTFMax; i-- {
+				if utf8.RuneStart(buf[i]) {
+					if !utf8.FullRune(buf[i:n]) {
+						cut = i
+					}
+					break
+				}
+			}
+			if cut > 0 {
+				if werr := writeOutput(conn, buf[:cut]); werr != nil {
+					return werr
+				}
+			}
+			pending = copy(buf, buf[cut:n])
+		}
+		if err == io.EOF {
+			if pending > 0 {
+				return writeOutput(conn, buf[:pending])
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 	}
 }
 
-func readPump(conn *websocket.Conn, sess *session.Session, client *session.Client) {
+func writeOutput(conn *websocket.Conn, data []byte) error {
+	return writeMessage(conn, Message{Type: MessageTypeOutput, Data: string(data)})
+}
+
+func writeMessage(conn *websocket.Conn, msg Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteMessage(websocket.TextMessage, payload)
+}
+
+// readPump applies the client's input and resize messages to the session;
+// a spectator's are read (to keep the connection alive) but ignored.
+func readPump(conn *websocket.Conn, sess *session.Session, client *session.Client, spectate bool, trail *auditTrail) {
 	defer func() {
 		sess.RemoveClient(client)
 		conn.Close()
 		log.Printf("client disconnected from session %s", sess.ID)
+		trail.flush()
+		trail.record(audit.Event{Action: audit.ActionDetach})
 	}()
 
 	conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -72,9 +175,13 @@ func readPump(conn *websocket.Conn, sess *session.Session, client *session.Clien
 		if err != nil {
 			return
 		}
+		if spectate {
+			continue
+		}
 
 		// Binary messages are raw PTY input (e.g. image paste)
 		if msgType == websocket.BinaryMessage {
+			trail.binary(raw)
 			sess.WriteInput(raw)
 			continue
 		}
@@ -86,6 +193,7 @@ func readPump(conn *websocket.Conn, sess *session.Session, client *session.Clien
 
 		switch msg.Type {
 		case MessageTypeInput:
+			trail.text(msg.Data)
 			sess.WriteInput([]byte(msg.Data))
 		case MessageTypeResize:
 			if msg.Cols > 0 && msg.Rows > 0 {
@@ -95,7 +203,49 @@ func readPump(conn *websocket.Conn, sess *session.Session, client *session.Clien
 	}
 }
 
-func writePump(conn *websocket.Conn, client *session.Client) {
+// auditTrail writes a connection's events to the audit log. Typed input is
+// collected and written a line at a time rather than per keystroke.
+type auditTrail struct {
+	log   *audit.Log
+	base  audit.Event // who, from where, to which session
+	input bool        // record input
+	buf   []byte
+}
+
+func (t *auditTrail) record(e audit.Event) {
+	e.User, e.Addr, e.Session = t.base.User, t.base.Addr, t.base.Session
+	t.log.Record(e)
+}
+
+func (t *auditTrail) text(data string) {
+	if !t.input {
+		return
+	}
+	t.buf = append(t.buf, data...)
+	if len(t.buf) >= inputFlushSize || strings.ContainsAny(data, "\r\n") {
+		t.flush()
+	}
+}
+
+func (t *auditTrail) binary(data []byte) {
+	if !t.input {
+		return
+	}
+	t.flush()
+	t.record(audit.Event{Action: audit.ActionInput, Data: data})
+}
+
+func (t *auditTrail) flush() {
+	if len(t.buf) == 0 {
+		return
+	}
+	t.record(audit.Event{Action: audit.ActionInput, Detail: string(t.buf)})
+	t.buf = t.buf[:0]
+}
+
+// writePump relays session output to the client. It also ends the
+// connection once the principal's token or invite is revoked or expires.
+func writePump(conn *websocket.Conn, client *session.Client, p *auth.Principal) {
 	ticker := time.NewTicker(pingInterval)
 	defer func() {
 		ticker.Stop()
@@ -120,6 +270,12 @@ func writePump(conn *websocket.Conn, client *session.Client) {
 		case <-client.Done():
 			return
 		case <-ticker.C:
+			if !p.Active() {
+				conn.SetWriteDeadline(time.Now().Add(writeWait))
+				conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "access revoked"))
+				return
+			}
 			conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
@@ -6,6 +6,16 @@ const (
 	MessageTypeInput  MessageType = "input"
 	MessageTypeOutput MessageType = "output"
 	MessageTypeResize MessageType = "resize"
+	// MessageTypeMode is sent once on connect with Data set to ModeControl
+	// or ModeSpectate.
+	MessageTypeMode MessageType = "mode"
+)
+
+// Attachment modes. A spectator receives output but its input and resize
+// messages are ignored.
+const (
+	ModeControl  = "control"
+	ModeSpectate = "spectate"
 )
 
 type Message struct {
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"embed"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/fs"
@@ -11,8 +12,11 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -21,8 +25,15 @@ import (
 
 	"github.com/shafqat-a/ai-dev-conductor/api"
 	"github.com/shafqat-a/ai-dev-conductor/config"
+	"github.com/shafqat-a/ai-dev-conductor/internal/audit"
 	"github.com/shafqat-a/ai-dev-conductor/internal/auth"
+	"github.com/shafqat-a/ai-dev-conductor/internal/cgroup"
+	"github.com/shafqat-a/ai-dev-conductor/internal/health"
+	"github.com/shafqat-a/ai-dev-conductor/internal/listen"
+	"github.com/shafqat-a/ai-dev-conductor/internal/sdnotify"
 	"github.com/shafqat-a/ai-dev-conductor/internal/session"
+	"github.com/shafqat-a/ai-dev-conductor/internal/tlsconf"
+	"github.com/shafqat-a/ai-dev-conductor/internal/upgrade"
 	"github.com/shafqat-a/ai-dev-conductor/internal/ws"
 )
 
@@ -33,62 +44,259 @@ var templateFS embed.FS
 var staticFS embed.FS
 
 func main() {
+	// The same binary doubles as the per-session PTY supervisor.
+	if len(os.Args) > 1 && os.Args[1] == session.SupervisorCommand {
+		if err := session.RunSupervisor(); err != nil {
+			log.Fatalf("supervisor: %v", err)
+		}
+		return
+	}
+
+	// Catch signals from the start, so one sent while starting up is acted
+	// on once the server is running; ignore SIGHUP so we don't crash when
+	// backgrounded
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	signal.Ignore(syscall.SIGHUP)
+
 	cfg, err := config.Load()
 	if err != nil {
 		log.Fatalf("config: %v", err)
 	}
 
-	authSvc, err := auth.NewAuthService(cfg.Password)
+	// Listen before reporting ready, so systemd only starts dependent units
+	// once connections are accepted. When replacing an old server, the
+	// sockets are its own and connections wait in them until it has let go
+	// of the sessions and state this one takes over.
+	predecessor, err := upgrade.Inherited()
+	if err != nil {
+		log.Fatalf("upgrade: %v", err)
+	}
+	listeners, err := listen.Listen(listen.Options{
+		Addrs:       cfg.ListenAddrs,
+		SocketMode:  cfg.SocketMode,
+		SocketGroup: cfg.SocketGroup,
+	})
+	if err != nil {
+		log.Fatalf("server: %v", err)
+	}
+
+	// The password only seeds the admin account of a new user file.
+	users, err := auth.OpenUserStore(filepath.Join(cfg.StateDir, "users.json"), cfg.Password)
+	if err != nil {
+		log.Fatalf("users: %v", err)
+	}
+
+	var sessionStore *auth.SessionStore
+	if cfg.PersistLogins {
+		sessionStore, err = auth.OpenSessionStore(filepath.Join(cfg.StateDir, "logins.json"))
+		if err != nil {
+			log.Fatalf("logins: %v", err)
+		}
+	} else {
+		sessionStore = auth.NewSessionStore()
+	}
+	invites, err := auth.OpenInviteStore(filepath.Join(cfg.StateDir, "invites.json"))
+	if err != nil {
+		log.Fatalf("invites: %v", err)
+	}
+	apiKeys, err := auth.OpenAPIKeyStore(filepath.Join(cfg.StateDir, "api-keys.json"))
+	if err != nil {
+		log.Fatalf("api keys: %v", err)
+	}
+	auditLog, err := audit.Open(cfg.AuditLog)
 	if err != nil {
-		log.Fatalf("auth: %v", err)
+		log.Fatalf("%v", err)
+	}
+	defer auditLog.Close()
+	authn := &auth.Authenticator{Sessions: sessionStore, Users: users, Invites: invites, APIKeys: apiKeys, Audit: auditLog}
+	if cfg.ProxyAuth != nil {
+		if authn.Proxy, err = auth.NewProxyAuth(*cfg.ProxyAuth); err != nil {
+			log.Fatalf("proxy auth: %v", err)
+		}
+	}
+	if cfg.TLSClientCA != "" {
+		authn.Certs = &auth.CertAuth{Field: cfg.TLSClientUser}
 	}
 
-	sessionStore := auth.NewSessionStore()
-	sessionMgr := session.NewManager(cfg.Shell, cfg.DataDir)
+	if err := checkRunAs(cfg, users); err != nil {
+		log.Fatalf("runAs: %v", err)
+	}
+	if cfg.CgroupRoot != "" {
+		if err := cgroup.Setup(cfg.CgroupRoot); err != nil {
+			log.Fatalf("cgroup: %v", err)
+		}
+	}
+	sessionMgr := session.NewManager(session.Options{
+		Shell:   cfg.Shell,
+		DataDir: cfg.DataDir,
+		History: session.HistoryOptions{
+			SegmentSize: cfg.HistorySegmentSize,
+			MaxSize:     cfg.HistoryMaxSize,
+			MaxAge:      cfg.HistoryMaxAge,
+			Compress:    cfg.HistoryCompress,
+		},
+		Scrollback: cfg.Scrollback,
+		Record:     cfg.Record,
+		RecordMax:  cfg.RecordMaxSize,
+		Templates:  cfg.Templates,
+		CgroupRoot: cfg.CgroupRoot,
+		Limits:     cfg.CgroupLimits,
+		RunAs:      cfg.RunAs,
+	})
 
 	// Parse templates — use fs.Sub to strip prefix so template names are just "login.html" etc.
 	templateSub, _ := fs.Sub(templateFS, "web/templates")
 	tmpl := template.Must(template.ParseFS(templateSub, "*.html"))
 
 	// Router
+	origins, err := auth.NewOriginPolicy(cfg.AllowedOrigins)
+	if err != nil {
+		log.Fatalf("origins: %v", err)
+	}
+	metrics := api.NewMetrics(sessionMgr)
+	auditLog.Subscribe(metrics.CountLogin)
+
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)
+	r.Use(requestLogger)
 	r.Use(middleware.Recoverer)
-	r.Use(corsMiddleware)
+	proxies := cfg.TrustedProxies
+	if cfg.ProxyAuth != nil {
+		proxies = slices.Concat(proxies, cfg.ProxyAuth.TrustedProxies)
+	}
+	if len(proxies) > 0 {
+		trusted, err := auth.NewTrustedProxies(proxies)
+		if err != nil {
+			log.Fatalf("trusted proxies: %v", err)
+		}
+		r.Use(auth.ForwardedFor(trusted))
+	}
+	r.Use(metrics.Instrument)
+	r.Use(corsMiddleware(origins))
+	r.Use(auth.CSRFCookie)
 
 	// Static files
 	staticSub, _ := fs.Sub(staticFS, "web/static")
 	r.Handle("/static/*", http.StripPrefix("/static/", http.FileServer(http.FS(staticSub))))
 
 	// Public routes
-	r.Get("/api/health", api.HandleHealthCheck())
+	liveness := health.NewChecker(api.LivenessChecks(sessionMgr))
+	r.Get("/api/health", api.HandleHealthChecks(liveness))
+	r.Get("/api/health/live", api.HandleHealthChecks(liveness))
+	r.Get("/api/health/ready", api.HandleHealthChecks(health.NewChecker(api.ReadinessChecks(sessionMgr, cfg.StateDir, cfg.MinFreeDisk))))
+	if !cfg.MetricsAuth {
+		r.Method(http.MethodGet, "/metrics", metrics.Handler())
+	}
+	var oidc *auth.OIDCProvider
+	if cfg.OIDC != nil {
+		oidc = auth.NewOIDCProvider(*cfg.OIDC)
+		r.Get("/auth/oidc/login", api.HandleOIDCLogin(oidc))
+		r.Get("/auth/oidc/callback", api.HandleOIDCCallback(oidc, users, sessionStore, auditLog, cfg.SessionTimeout))
+	}
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		tmpl.ExecuteTemplate(w, "login.html", nil)
+		// Users the proxy or their certificate already signed in skip the
+		// login page.
+		if authn.SignedInExternally(r) {
+			http.Redirect(w, r, "/terminal", http.StatusSeeOther)
+			return
+		}
+		var page struct{ SSO string }
+		if oidc != nil {
+			page.SSO = oidc.Name()
+		}
+		tmpl.ExecuteTemplate(w, "login.html", page)
+	})
+	loginLimiter := auth.NewLoginLimiter(cfg.LoginLimits)
+	r.Post("/api/login", api.HandleLogin(users, sessionStore, loginLimiter, auditLog, cfg.SessionTimeout, cfg.RequireTOTP))
+	r.Get("/invite/{token}", api.HandleRedeemInvite(authn, auditLog))
+
+	// Routes open to logins that still have to enroll in two-factor auth
+	r.Group(func(r chi.Router) {
+		r.Use(auth.RequireAuthOrEnrolling(authn))
+		r.Use(api.AuditRequests(auditLog))
+		r.Get("/api/me", api.HandleMe())
+		r.Post("/api/logout", api.HandleLogout(sessionStore))
+
+		r.Group(func(r chi.Router) {
+			r.Use(auth.RequireUser)
+			r.Post("/api/me/totp", api.HandleBeginTOTP(users))
+			r.Post("/api/me/totp/confirm", api.HandleConfirmTOTP(users, sessionStore))
+			r.Delete("/api/me/totp", api.HandleDisableTOTP(users, loginLimiter, auditLog))
+			r.Post("/api/me/totp/recovery-codes", api.HandleNewRecoveryCodes(users, loginLimiter, auditLog))
+		})
 	})
-	r.Post("/api/login", api.HandleLogin(authSvc, sessionStore, cfg.SessionTimeout))
 
 	// Protected routes
 	r.Group(func(r chi.Router) {
-		r.Use(auth.RequireAuth(sessionStore))
+		r.Use(auth.RequireAuth(authn))
+		r.Use(api.AuditRequests(auditLog))
 
 		r.Get("/terminal", func(w http.ResponseWriter, r *http.Request) {
 			tmpl.ExecuteTemplate(w, "terminal.html", nil)
 		})
+		if cfg.MetricsAuth {
+			r.With(auth.RequireAdminScope(auth.ScopeMetricsRead)).Method(http.MethodGet, "/metrics", metrics.Handler())
+		}
 
+		r.Get("/api/templates", api.HandleListTemplates(sessionMgr))
 		r.Get("/api/sessions", api.HandleListSessions(sessionMgr))
-		r.Post("/api/sessions", api.HandleCreateSession(sessionMgr))
+		r.Post("/api/sessions", api.HandleCreateSession(sessionMgr, users))
+		r.Get("/api/sessions/ended", api.HandleListEndedSessions(sessionMgr))
+		r.Get("/api/sessions/{id}", api.HandleGetSession(sessionMgr))
+		r.Get("/api/sessions/{id}/history", api.HandleSessionHistory(sessionMgr))
+		r.Get("/api/sessions/{id}/recording", api.HandleSessionRecording(sessionMgr))
 		r.Put("/api/sessions/{id}", api.HandleRenameSession(sessionMgr))
 		r.Delete("/api/sessions/{id}", api.HandleDeleteSession(sessionMgr))
-		r.Get("/ws/{id}", ws.HandleWebSocket(sessionMgr))
+		r.Post("/api/sessions/{id}/invites", api.HandleCreateInvite(sessionMgr, invites))
+		r.Get("/api/invites", api.HandleListInvites(invites))
+		r.Delete("/api/invites/{id}", api.HandleRevokeInvite(invites))
+		r.Get("/ws/{id}", ws.HandleWebSocket(sessionMgr, origins, auditLog, cfg.AuditInput))
+
+		// Account management needs a password login, not an API key or invite
+		r.Group(func(r chi.Router) {
+			r.Use(auth.RequireUser)
+			r.Put("/api/me/password", api.HandleChangePassword(users, sessionStore, loginLimiter, auditLog))
+			r.Get("/api/keys", api.HandleListAPIKeys(apiKeys))
+			r.Post("/api/keys", api.HandleCreateAPIKey(apiKeys))
+			r.Delete("/api/keys/{id}", api.HandleRevokeAPIKey(apiKeys))
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(auth.RequireRole(auth.RoleAdmin))
+			r.Get("/api/users", api.HandleListUsers(users))
+			r.Post("/api/users", api.HandleCreateUser(users))
+			r.Put("/api/users/{username}", api.HandleUpdateUser(users, sessionStore))
+			r.Delete("/api/users/{username}", api.HandleDeleteUser(users, sessionStore, apiKeys, invites))
+			r.Get("/api/logins", api.HandleListLogins(sessionStore))
+			r.Delete("/api/logins/{id}", api.HandleRevokeLogin(sessionStore))
+			r.Get("/api/audit", api.HandleQueryAudit(auditLog))
+			r.Get("/api/audit/verify", api.HandleVerifyAudit(auditLog))
+		})
 	})
 
 	// Server with graceful shutdown
+	conns := &connTracker{busy: make(map[net.Conn]time.Time)}
 	srv := &http.Server{
-		Addr:         cfg.ListenAddr,
 		Handler:      r,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
+		ConnState:    conns.track,
+	}
+
+	scheme := "http"
+	if cfg.TLSCert != "" {
+		certs, err := tlsconf.New(tlsconf.Options{
+			CertFile:          cfg.TLSCert,
+			KeyFile:           cfg.TLSKey,
+			ClientCAFile:      cfg.TLSClientCA,
+			RequireClientCert: cfg.TLSClientAuth == "require",
+		})
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		srv.TLSConfig = certs.Config()
+		scheme = "https"
 	}
 
 	// Write PID file if configured
@@ -99,25 +307,53 @@ func main() {
 		log.Printf("PID file: %s", cfg.PIDFile)
 	}
 
-	go func() {
-		log.Printf("Shell: %s", cfg.Shell)
-		log.Printf("Listening on %s", cfg.ListenAddr)
-		for _, addr := range getAccessURLs(cfg.ListenAddr) {
-			log.Printf("  -> %s", addr)
+	// Everything that can fail has been done, so an old server being
+	// replaced can let go now. The state it may have changed since is read
+	// again; a file that can no longer be read keeps what was read before.
+	if predecessor != nil {
+		log.Println("Upgrade: waiting for the old server to hand over")
+		if err := predecessor.Takeover(); err != nil {
+			log.Fatalf("upgrade: %v", err)
 		}
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("server: %v", err)
+		for _, s := range []struct {
+			name  string
+			store interface{ Reload() error }
+		}{{"users", users}, {"logins", sessionStore}, {"invites", invites}, {"api keys", apiKeys}} {
+			if err := s.store.Reload(); err != nil {
+				log.Printf("%s: %v; keeping what was read before the handover", s.name, err)
+			}
 		}
-	}()
+	}
+	if n := sessionMgr.Recover(); n > 0 {
+		log.Printf("Re-attached %d running session(s)", n)
+	}
 
-	// Wait for interrupt; ignore SIGHUP so we don't crash when backgrounded
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	signal.Ignore(syscall.SIGHUP)
-	<-quit
+	log.Printf("Shell: %s", cfg.Shell)
+	for _, ln := range listeners {
+		go serve(srv, ln, scheme)
+	}
+
+	if ok, err := sdnotify.Notify(sdnotify.Ready + "\n" + sdnotify.Status(statusText(sessionMgr))); err != nil {
+		log.Printf("systemd: %v", err)
+	} else if ok {
+		go notifySystemd(sessionMgr, liveness)
+	}
+
+	// Wait for interrupt, or SIGUSR2 to hand over to a new binary
+	for sig := range quit {
+		if sig != syscall.SIGUSR2 {
+			break
+		}
+		if successor := startUpgrade(listeners); successor != nil {
+			handOver(srv, listeners, conns, sessionMgr, successor)
+			return
+		}
+	}
 
 	log.Println("Shutting down...")
-	sessionMgr.CloseAll()
+	sdnotify.Notify(sdnotify.Stopping + "\n" + sdnotify.Status("Shutting down"))
+	// Shells keep running under their supervisors; the next start re-attaches.
+	sessionMgr.DetachAll()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
@@ -131,24 +367,231 @@ func main() {
 	log.Println("Server stopped")
 }
 
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		origin := r.Header.Get("Origin")
-		if origin != "" {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Session-Token")
-			w.Header().Set("Access-Control-Max-Age", "3600")
-		}
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusNoContent)
+// checkRunAs checks that the server can start sessions as every account
+// the config and users name in runAs, so a server that isn't root fails at
+// startup rather than on every session.
+func checkRunAs(cfg *config.Config, users *auth.UserStore) error {
+	if cfg.RunAs != nil {
+		if err := session.CheckRunAs(cfg.RunAs); err != nil {
+			return err
+		}
+	}
+	for _, t := range cfg.Templates {
+		if t.RunAs != nil {
+			if err := session.CheckRunAs(t.RunAs); err != nil {
+				return fmt.Errorf("template %q: %w", t.Name, err)
+			}
+		}
+	}
+	for _, u := range users.List() {
+		if u.RunAs != nil {
+			if err := session.CheckRunAs(u.RunAs); err != nil {
+				return fmt.Errorf("user %q: %w", u.Username, err)
+			}
+		}
+	}
+	return nil
+}
+
+// upgradeTimeout bounds how long a new binary may take to be ready to take
+// over.
+const upgradeTimeout = 30 * time.Second
+
+// startUpgrade starts the binary now on disk as a new server on the same
+// listeners, and waits for it to be ready to take over. It returns nil,
+// and this server carries on, if the new one fails.
+func startUpgrade(listeners []net.Listener) *upgrade.Successor {
+	log.Println("Upgrade: starting new server")
+	successor, err := upgrade.Start(listeners)
+	if err == nil {
+		err = successor.WaitReady(upgradeTimeout)
+	}
+	if err != nil {
+		log.Printf("upgrade: %v; carrying on", err)
+		return nil
+	}
+	return successor
+}
+
+// handOver stops this server and lets successor take over the listeners
+// and sessions. Shells keep running under their supervisors, and clients
+// reconnect to the new server.
+func handOver(srv *http.Server, listeners []net.Listener, conns *connTracker, mgr *session.Manager, successor *upgrade.Successor) {
+	log.Printf("Upgrade: handing over to new server (pid %d)", successor.Pid())
+	sdnotify.Notify(sdnotify.MainPID(successor.Pid()) + "\n" + sdnotify.Status("Handing over to new server"))
+
+	// Stop accepting first, so new connections wait for the new server, and
+	// let requests already accepted finish: Shutdown would drop those whose
+	// request hadn't been read yet.
+	srv.SetKeepAlivesEnabled(false)
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	conns.wait(ctx)
+	srv.Shutdown(ctx)
+	mgr.DetachAll()
+	successor.Release()
+	log.Println("Server stopped")
+}
+
+// serve serves HTTP on ln until the server is shut down.
+func serve(srv *http.Server, ln net.Listener, scheme string) {
+	addr := ln.Addr()
+	if addr.Network() == "unix" {
+		log.Printf("Listening on %s%s", listen.UnixPrefix, addr)
+	} else {
+		log.Printf("Listening on %s", addr)
+		for _, url := range getAccessURLs(scheme, addr.String()) {
+			log.Printf("  -> %s", url)
+		}
+	}
+	var err error
+	if scheme == "https" {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+		log.Fatalf("server: %v", err)
+	}
+}
+
+// connTracker keeps track of HTTP connections in the middle of a request.
+type connTracker struct {
+	mu   sync.Mutex
+	busy map[net.Conn]time.Time // when connections still to send a request were opened
+}
+
+// idleNewConn is how long a connection may go without sending a request
+// before it's taken to be idle, as http.Server.Shutdown does.
+const idleNewConn = 5 * time.Second
+
+func (t *connTracker) track(c net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		t.busy[c] = time.Now()
+	case http.StateActive:
+		t.busy[c] = time.Time{}
+	default:
+		delete(t.busy, c)
+	}
+}
+
+// wait waits until no connection is in the middle of a request, or ctx is
+// done.
+func (t *connTracker) wait(ctx context.Context) {
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		t.mu.Lock()
+		busy := 0
+		for _, opened := range t.busy {
+			if opened.IsZero() || time.Since(opened) < idleNewConn {
+				busy++
+			}
+		}
+		t.mu.Unlock()
+		if busy == 0 {
 			return
 		}
-		next.ServeHTTP(w, r)
-	})
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// statusInterval is how often the status systemd shows is refreshed when
+// there is no watchdog.
+const statusInterval = 10 * time.Second
+
+// notifySystemd keeps systemd's status line current and, if the watchdog
+// is enabled, pings it while the server passes its liveness checks, so
+// systemd restarts a server that has hung.
+func notifySystemd(mgr *session.Manager, liveness *health.Checker) {
+	interval, watchdog := sdnotify.WatchdogInterval()
+	if !watchdog || interval > statusInterval {
+		interval = statusInterval
+	}
+	for range time.Tick(interval) {
+		state := sdnotify.Status(statusText(mgr))
+		if watchdog {
+			rep := liveness.Run(context.Background())
+			if rep.Status == "ok" {
+				state += "\n" + sdnotify.Watchdog
+			} else {
+				for name, res := range rep.Checks {
+					if res.Error != "" {
+						log.Printf("systemd: withholding watchdog ping, %s check failed: %s", name, res.Error)
+					}
+				}
+			}
+		}
+		if _, err := sdnotify.Notify(state); err != nil {
+			log.Printf("systemd: %v", err)
+		}
+	}
+}
+
+// statusText summarizes the server's state for systemctl status.
+func statusText(mgr *session.Manager) string {
+	stats := mgr.Stats()
+	clients := 0
+	for _, s := range stats {
+		clients += s.Clients
+	}
+	return fmt.Sprintf("%d sessions, %d clients attached", len(stats), clients)
+}
+
+// requestLogger logs requests like middleware.Logger, with invite and login
+// tokens left out.
+var requestLogger = middleware.RequestLogger(redactingFormatter{
+	&middleware.DefaultLogFormatter{Logger: log.New(os.Stdout, "", log.LstdFlags)},
+})
+
+type redactingFormatter struct {
+	middleware.LogFormatter
+}
+
+func (f redactingFormatter) NewLogEntry(r *http.Request) middleware.LogEntry {
+	r = r.WithContext(r.Context())
+	r.RequestURI = auth.RedactURI(r.RequestURI)
+	return f.LogFormatter.NewLogEntry(r)
+}
+
+// corsMiddleware turns away requests from pages on origins that aren't
+// allowed, and lets allowed ones read the responses.
+func corsMiddleware(origins *auth.OriginPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Origin")
+			origin := r.Header.Get("Origin")
+			if origin != "" {
+				if !origins.Allowed(r) {
+					log.Printf("rejected request from origin %q: %s %s", origin, r.Method, auth.RedactURI(r.URL.Path))
+					http.Error(w, `{"error":"origin not allowed"}`, http.StatusForbidden)
+					return
+				}
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Session-Token, Authorization, X-CSRF-Token")
+				w.Header().Set("Access-Control-Max-Age", "3600")
+			}
+			if r.Method == "OPTIONS" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
-func getAccessURLs(listenAddr string) []string {
+func getAccessURLs(scheme, listenAddr string) []string {
 	_, port, _ := net.SplitHostPort(listenAddr)
 	if port == "" {
 		port = "8080"
@@ -157,7 +600,7 @@ func getAccessURLs(listenAddr string) []string {
 	var urls []string
 	ifaces, err := net.Interfaces()
 	if err != nil {
-		return []string{fmt.Sprintf("http://%s", listenAddr)}
+		return []string{fmt.Sprintf("%s://%s", scheme, listenAddr)}
 	}
 
 	for _, iface := range ifaces {
@@ -173,12 +616,12 @@ func getAccessURLs(listenAddr string) []string {
 			if ip.To4() == nil {
 				continue // skip IPv6
 			}
-			urls = append(urls, fmt.Sprintf("http://%s:%s", ip.String(), port))
+			urls = append(urls, fmt.Sprintf("%s://%s:%s", scheme, ip.String(), port))
 		}
 	}
 
 	if len(urls) == 0 {
-		return []string{fmt.Sprintf("http://localhost:%s", port)}
+		return []string{fmt.Sprintf("%s://localhost:%s", scheme, port)}
 	}
 
 	// Always include localhost
@@ -190,7 +633,7 @@ func getAccessURLs(listenAddr string) []string {
 		}
 	}
 	if !hasLocal {
-		urls = append([]string{fmt.Sprintf("http://localhost:%s", port)}, urls...)
+		urls = append([]string{fmt.Sprintf("%s://localhost:%s", scheme, port)}, urls...)
 	}
 
 	return urls
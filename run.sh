@@ -1,6 +1,6 @@
 #!/bin/sh
 # Run AI Dev Conductor in the background on port 5050
-# Usage: ./run.sh [start|stop|status]
+# Usage: ./run.sh [start|stop|status|upgrade]
 
 DIR="$(cd "$(dirname "$0")" && pwd)"
 PID_FILE="$DIR/ai-dev-conductor.pid"
@@ -49,6 +49,29 @@ case "${1:-start}" in
         fi
         ;;
 
+    upgrade)
+        if ! [ -f "$PID_FILE" ] || ! kill -0 "$(cat "$PID_FILE")" 2>/dev/null; then
+            echo "Not running"
+            exit 1
+        fi
+        OLD=$(cat "$PID_FILE")
+
+        echo "Building..."
+        cd "$DIR" && go build -o ai-dev-conductor . || exit 1
+
+        echo "Handing over from PID $OLD..."
+        kill -USR2 "$OLD"
+        for i in 1 2 3 4 5 6 7 8 9 10; do
+            sleep 1
+            if ! kill -0 "$OLD" 2>/dev/null; then
+                echo "Upgraded (PID $(cat "$PID_FILE"))"
+                exit 0
+            fi
+        done
+        echo "Still running the old binary. Check $LOG_FILE"
+        exit 1
+        ;;
+
     status)
         if [ -f "$PID_FILE" ] && kill -0 "$(cat "$PID_FILE")" 2>/dev/null; then
             echo "Running (PID $(cat "$PID_FILE"))"
@@ -59,7 +82,7 @@ case "${1:-start}" in
         ;;
 
     *)
-        echo "Usage: $0 {start|stop|status}"
+        echo "Usage: $0 {start|stop|status|upgrade}"
         exit 1
         ;;
 esac
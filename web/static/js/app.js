@@ -10,6 +10,8 @@ class TerminalManager {
         this.reconnectAttempts = 0;
         this.reconnectTimer = null;
         this.maxReconnectAttempts = 20;
+        this.spectate = false;  // requested spectator mode
+        this.readOnly = false;  // mode granted by the server
 
         // Server management
         this.servers = this.loadServers();
@@ -18,12 +20,21 @@ class TerminalManager {
         this.sessionListEl = document.getElementById('session-list');
         this.placeholderEl = document.getElementById('placeholder');
         this.containerEl = document.getElementById('terminal-container');
+        this.spectatorBadgeEl = document.getElementById('spectator-badge');
 
         document.getElementById('btn-new-session').addEventListener('click', () => this.createSession());
         document.getElementById('btn-add-server').addEventListener('click', () => this.addServer());
         window.addEventListener('resize', () => this.handleResize());
 
-        this.loadAllSessions();
+        this.loadAllSessions().then(() => this.openFromHash());
+    }
+
+    // Invite links land on /terminal#session=<id>
+    openFromHash() {
+        const match = window.location.hash.match(/session=([^&]+)/);
+        if (!match) return;
+        history.replaceState(null, '', window.location.pathname);
+        this.connectToSession('local', decodeURIComponent(match[1]));
     }
 
     // --- Server Management ---
@@ -58,7 +69,11 @@ class TerminalManager {
         const url = baseUrl + path;
 
         if (server.isLocal) {
-            return fetch(url, options);
+            // The login cookie only works with the CSRF token alongside it
+            const csrf = document.cookie.match(/(?:^|; )ai_conductor_csrf=([^;]*)/);
+            const headers = { ...(options.headers || {}) };
+            if (csrf) headers['X-CSRF-Token'] = csrf[1];
+            return fetch(url, { ...options, headers });
         }
 
         const headers = { ...(options.headers || {}) };
@@ -92,26 +107,39 @@ class TerminalManager {
     }
 
     async authenticateServer(server) {
-        const password = prompt(`Password for ${server.name}:`);
+        const username = prompt(`Username for ${server.name}:`, 'admin');
+        if (username === null) return false;
+        const password = prompt(`Password for ${username}@${server.name}:`);
         if (password === null) return false;
 
         try {
-            const res = await fetch(server.url + '/api/login', {
-                method: 'POST',
-                headers: { 'Content-Type': 'application/json' },
-                body: JSON.stringify({ password }),
-                credentials: 'omit',
-            });
-            if (res.ok) {
-                const data = await res.json();
-                server.token = data.token;
-                server.connected = true;
-                this.saveServers();
-                return true;
-            } else {
-                alert('Authentication failed');
+            const body = { username, password };
+            let res, data;
+            for (;;) {
+                res = await fetch(server.url + '/api/login', {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify(body),
+                    credentials: 'omit',
+                });
+                data = await res.json();
+                if (res.ok || !data.totpRequired) break;
+                const code = prompt(`${data.error}. Code from your authenticator app (or a recovery code) for ${username}@${server.name}:`);
+                if (code === null) return false;
+                body.code = code;
+            }
+            if (!res.ok) {
+                alert(data.error || 'Authentication failed');
+                return false;
+            }
+            if (data.totpEnrollment) {
+                alert(`${server.name} requires two-factor authentication. Sign in to it in a browser to set it up, then add the server again.`);
                 return false;
             }
+            server.token = data.token;
+            server.connected = true;
+            this.saveServers();
+            return true;
         } catch (err) {
             alert('Cannot connect to ' + server.name + ': ' + err.message);
             return false;
@@ -212,6 +240,24 @@ class TerminalManager {
                 nameSpan.textContent = s.name || s.id;
                 nameSpan.addEventListener('click', () => this.connectToSession(serverId, s.id));
 
+                const watchBtn = document.createElement('button');
+                watchBtn.className = 'btn-watch';
+                watchBtn.title = 'Watch session (read-only)';
+                watchBtn.innerHTML = '&#128065;';
+                watchBtn.addEventListener('click', (e) => {
+                    e.stopPropagation();
+                    this.connectToSession(serverId, s.id, true);
+                });
+
+                const shareBtn = document.createElement('button');
+                shareBtn.className = 'btn-share';
+                shareBtn.title = 'Create invite link';
+                shareBtn.innerHTML = '&#128279;';
+                shareBtn.addEventListener('click', (e) => {
+                    e.stopPropagation();
+                    this.shareSession(serverId, s.id);
+                });
+
                 const renameBtn = document.createElement('button');
                 renameBtn.className = 'btn-rename';
                 renameBtn.title = 'Rename session';
@@ -231,6 +277,8 @@ class TerminalManager {
                 });
 
                 item.appendChild(nameSpan);
+                item.appendChild(watchBtn);
+                item.appendChild(shareBtn);
                 item.appendChild(renameBtn);
                 item.appendChild(deleteBtn);
                 this.sessionListEl.appendChild(item);
@@ -290,15 +338,32 @@ class TerminalManager {
         } else if (connectedServers.length === 1) {
             targetServer = connectedServers[0];
         } else {
-            targetServer = await this.showServerPicker(connectedServers);
+            targetServer = await this.showPicker(connectedServers, s => s.name);
             if (!targetServer) return;
         }
 
+        // Offer the server's session templates, if it defines any
+        let template = '';
+        try {
+            const res = await this.fetchFromServer(targetServer, '/api/templates');
+            const templates = res.ok ? await res.json() : [];
+            if (templates.length > 0) {
+                const choice = await this.showPicker(
+                    [{ name: '' }, ...templates],
+                    t => t.name ? t.name + (t.description ? ' — ' + t.description : '') : 'Shell'
+                );
+                if (!choice) return;
+                template = choice.name;
+            }
+        } catch {
+            // Older servers have no templates endpoint
+        }
+
         try {
             const res = await this.fetchFromServer(targetServer, '/api/sessions', {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/json' },
-                body: JSON.stringify({}),
+                body: JSON.stringify({ template }),
             });
             if (res.status === 401) {
                 if (targetServer.isLocal) {
@@ -316,19 +381,19 @@ class TerminalManager {
         }
     }
 
-    showServerPicker(servers) {
+    showPicker(items, label) {
         return new Promise((resolve) => {
             document.querySelectorAll('.server-picker').forEach(el => el.remove());
 
             const picker = document.createElement('div');
             picker.className = 'server-picker';
-            servers.forEach(s => {
+            items.forEach(item => {
                 const opt = document.createElement('div');
                 opt.className = 'server-picker-item';
-                opt.textContent = s.name;
+                opt.textContent = label(item);
                 opt.addEventListener('click', () => {
                     picker.remove();
-                    resolve(s);
+                    resolve(item);
                 });
                 picker.appendChild(opt);
             });
@@ -369,6 +434,32 @@ class TerminalManager {
         }
     }
 
+    async shareSession(serverId, sessionId) {
+        const access = prompt('Invite access (read or write):', 'read');
+        if (access === null) return;
+        const expiresIn = prompt('Invite expires in (e.g. 30m, 24h):', '24h');
+        if (expiresIn === null) return;
+
+        const server = this.getServerById(serverId);
+        if (!server) return;
+
+        try {
+            const res = await this.fetchFromServer(server, '/api/sessions/' + sessionId + '/invites', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ access: access.trim(), expiresIn: expiresIn.trim() }),
+            });
+            const data = await res.json();
+            if (!res.ok) {
+                alert('Failed to create invite: ' + (data.error || res.status));
+                return;
+            }
+            prompt('Invite link (shown once):', data.url);
+        } catch (err) {
+            console.error('Failed to create invite:', err);
+        }
+    }
+
     async deleteSession(serverId, sessionId) {
         const server = this.getServerById(serverId);
         if (!server) return;
@@ -387,10 +478,12 @@ class TerminalManager {
 
     // --- Terminal Connection ---
 
-    connectToSession(serverId, sessionId) {
+    connectToSession(serverId, sessionId, spectate = false) {
         this.disconnect();
         this.currentServerId = serverId;
         this.currentSessionId = sessionId;
+        this.spectate = spectate;
+        this.setReadOnly(spectate);
         this.manualDisconnect = false;
         this.reconnectAttempts = 0;
 
@@ -443,14 +536,14 @@ class TerminalManager {
 
         // Send terminal input to server
         this.term.onData((data) => {
-            if (this.ws && this.ws.readyState === WebSocket.OPEN) {
+            if (!this.readOnly && this.ws && this.ws.readyState === WebSocket.OPEN) {
                 this.ws.send(JSON.stringify({ type: 'input', data: data }));
             }
         });
 
         // Handle binary data (e.g. image paste, non-UTF8 clipboard content)
         this.term.onBinary((data) => {
-            if (this.ws && this.ws.readyState === WebSocket.OPEN) {
+            if (!this.readOnly && this.ws && this.ws.readyState === WebSocket.OPEN) {
                 const buffer = new Uint8Array(data.length);
                 for (let i = 0; i < data.length; i++) {
                     buffer[i] = data.charCodeAt(i) & 0xff;
@@ -466,14 +559,18 @@ class TerminalManager {
         const server = this.getServerById(serverId);
         if (!server) return;
 
+        // Send our size up front so the server renders its screen snapshot for it
+        let size = this.term ? 'rows=' + this.term.rows + '&cols=' + this.term.cols : '';
+        if (this.spectate) size += '&mode=spectate';
+
         let wsUrl;
         if (server.isLocal) {
             const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-            wsUrl = protocol + '//' + window.location.host + '/ws/' + sessionId;
+            wsUrl = protocol + '//' + window.location.host + '/ws/' + sessionId + '?' + size;
         } else {
             const url = new URL(server.url);
             const protocol = url.protocol === 'https:' ? 'wss:' : 'ws:';
-            wsUrl = protocol + '//' + url.host + '/ws/' + sessionId + '?token=' + encodeURIComponent(server.token || '');
+            wsUrl = protocol + '//' + url.host + '/ws/' + sessionId + '?token=' + encodeURIComponent(server.token || '') + '&' + size;
         }
 
         this.ws = new WebSocket(wsUrl);
@@ -488,6 +585,9 @@ class TerminalManager {
                 const msg = JSON.parse(event.data);
                 if (msg.type === 'output') {
                     this.term.write(msg.data);
+                } else if (msg.type === 'mode') {
+                    this.setReadOnly(msg.data === 'spectate');
+                    if (!this.readOnly) this.sendResize();
                 }
             } catch {
                 // Ignore malformed messages
@@ -555,6 +655,13 @@ class TerminalManager {
         }
         this.currentSessionId = null;
         this.currentServerId = null;
+        this.setReadOnly(false);
+    }
+
+    // Spectators only watch: input is not sent and the PTY is not resized.
+    setReadOnly(readOnly) {
+        this.readOnly = readOnly;
+        this.spectatorBadgeEl.style.display = readOnly ? 'block' : 'none';
     }
 
     showPlaceholder() {
@@ -573,7 +680,7 @@ class TerminalManager {
     }
 
     sendResize() {
-        if (this.ws && this.ws.readyState === WebSocket.OPEN && this.term) {
+        if (!this.readOnly && this.ws && this.ws.readyState === WebSocket.OPEN && this.term) {
             this.ws.send(JSON.stringify({
                 type: 'resize',
                 cols: this.term.cols,